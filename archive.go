@@ -0,0 +1,265 @@
+package osman
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/archive"
+	"github.com/outofforest/osman/infra/storage"
+	"github.com/outofforest/osman/infra/types"
+	"github.com/outofforest/parallel"
+)
+
+const (
+	archiveManifestFile = "manifest.json"
+	streamFormatTar     = "tar"
+)
+
+// archiveManifest describes builds stored in archive, parents are stored before their children.
+type archiveManifest struct {
+	Builds []archivedBuild
+}
+
+type archivedBuild struct {
+	Info types.BuildInfo
+
+	// Format is the format of the stream containing filesystem of the build.
+	Format string
+}
+
+// nativeStreamFormat returns format of native stream supported by storage driver or tar if driver
+// doesn't support any.
+func nativeStreamFormat(s storage.Driver) string {
+	if streamer, ok := s.(storage.Streamer); ok {
+		return streamer.StreamFormat()
+	}
+	return streamFormatTar
+}
+
+// sendBuild writes stream of the image in requested format.
+func sendBuild(ctx context.Context, info types.BuildInfo, streamFormat string, w io.Writer, s storage.Driver) error {
+	if streamFormat == streamFormatTar {
+		return exportTree(ctx, info, w, s)
+	}
+	return s.(storage.Streamer).Send(ctx, info.BuildID, w)
+}
+
+// receiveBuild creates image from the stream and stores its manifest and tags.
+func receiveBuild(
+	ctx context.Context,
+	info types.BuildInfo,
+	streamFormat string,
+	r io.Reader,
+	s storage.Driver,
+) (types.BuildInfo, error) {
+	// Tags are set later to move them from existing builds.
+	tags := info.Tags
+	info.Tags = nil
+
+	var err error
+	if streamFormat == streamFormatTar {
+		err = importTree(ctx, info, r, s)
+	} else {
+		err = s.(storage.Streamer).Receive(ctx, info, r)
+	}
+	if err != nil {
+		return types.BuildInfo{}, err
+	}
+
+	// CreatedAt is stored explicitly, because drivers receiving tar stream create the build from scratch.
+	if err := s.StoreManifest(ctx, types.ImageManifest{
+		BuildID:    info.BuildID,
+		BasedOn:    info.BasedOn,
+		CreatedAt:  info.CreatedAt,
+		Params:     info.Params,
+		Boots:      info.Boots,
+		Env:        info.Env,
+		WorkDir:    info.WorkDir,
+		User:       info.User,
+		Args:       info.Args,
+		Labels:     info.Labels,
+		CacheKey:   info.CacheKey,
+		Provenance: info.Provenance,
+	}); err != nil {
+		return types.BuildInfo{}, err
+	}
+	for _, tag := range tags {
+		if err := s.Tag(ctx, info.BuildID, tag); err != nil {
+			return types.BuildInfo{}, err
+		}
+	}
+	return s.Info(ctx, info.BuildID)
+}
+
+// replicateBuild copies image from source to target storage.
+func replicateBuild(
+	ctx context.Context,
+	info types.BuildInfo,
+	streamFormat string,
+	s storage.Driver,
+	target storage.Driver,
+) (types.BuildInfo, error) {
+	info = types.BuildInfo{
+		BuildID:   info.BuildID,
+		BasedOn:   info.BasedOn,
+		CreatedAt: info.CreatedAt,
+		Name:      info.Name,
+		Tags:      info.Tags,
+		Params:    info.Params,
+		Boots:     info.Boots,
+		Env:       info.Env,
+		WorkDir:   info.WorkDir,
+		User:      info.User,
+		Args:      info.Args,
+		Labels:    info.Labels,
+
+		CacheKey:   info.CacheKey,
+		Provenance: info.Provenance,
+
+		// Encryption is required to decide if build is received as a clone of its parent.
+		Encryption: info.Encryption,
+	}
+
+	var replicated types.BuildInfo
+	pr, pw := io.Pipe()
+	err := parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("send", parallel.Continue, func(ctx context.Context) error {
+			err := sendBuild(ctx, info, streamFormat, pw, s)
+			pw.CloseWithError(err)
+			return err
+		})
+		spawn("receive", parallel.Continue, func(ctx context.Context) error {
+			var err error
+			replicated, err = receiveBuild(ctx, info, streamFormat, pr, target)
+			pr.CloseWithError(err)
+			return err
+		})
+		return nil
+	})
+	if err != nil {
+		return types.BuildInfo{}, err
+	}
+	return replicated, nil
+}
+
+// exportTree writes filesystem of the image as tar stream.
+func exportTree(ctx context.Context, info types.BuildInfo, w io.Writer, s storage.Driver) (retErr error) {
+	path, dropFn, err := mountTemporarily(ctx, info, s)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := dropFn(); retErr == nil {
+			retErr = err
+		}
+	}()
+
+	return archive.Pack(w, path)
+}
+
+// mountTemporarily clones image to temporary mount, so its filesystem may be read.
+// Returned function drops the mount.
+func mountTemporarily(ctx context.Context, info types.BuildInfo, s storage.Driver) (string, func() error, error) {
+	buildID := types.NewBuildID(types.BuildTypeMount)
+	finalizeFn, path, err := s.Clone(ctx, info.BuildID, info.Name, buildID)
+	if err != nil {
+		return "", nil, err
+	}
+	dropFn := func() error {
+		return s.Drop(ctx, buildID)
+	}
+
+	if err := finalizeFn(); err != nil {
+		_ = dropFn()
+		return "", nil, err
+	}
+	return path, dropFn, nil
+}
+
+// importTree creates image from tar stream. If image is based on another one, the parent is cloned
+// and its content is replaced, so the unchanged files may be shared by storage driver.
+func importTree(ctx context.Context, info types.BuildInfo, r io.Reader, s storage.Driver) (retErr error) {
+	var finalizeFn storage.FinalizeFn
+	var path string
+	var err error
+	if info.BasedOn == "" {
+		finalizeFn, path, err = s.CreateEmpty(ctx, info.Name, info.BuildID)
+	} else {
+		finalizeFn, path, err = s.Clone(ctx, info.BasedOn, info.Name, info.BuildID)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = s.Drop(ctx, info.BuildID)
+		}
+	}()
+
+	if err := archive.Unpack(r, path); err != nil {
+		return err
+	}
+	return finalizeFn()
+}
+
+func buildExists(ctx context.Context, buildID types.BuildID, s storage.Driver) (bool, error) {
+	_, err := s.Info(ctx, buildID)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, types.ErrImageDoesNotExist):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// withParents adds all the ancestors of builds to the list.
+func withParents(ctx context.Context, builds []types.BuildInfo, s storage.Driver) ([]types.BuildInfo, error) {
+	included := map[types.BuildID]bool{}
+	for _, build := range builds {
+		included[build.BuildID] = true
+	}
+
+	res := append([]types.BuildInfo{}, builds...)
+	for _, build := range builds {
+		for build.BasedOn != "" && !included[build.BasedOn] {
+			var err error
+			build, err = s.Info(ctx, build.BasedOn)
+			if err != nil {
+				return nil, err
+			}
+			included[build.BuildID] = true
+			res = append(res, build)
+		}
+	}
+	return res, nil
+}
+
+// sortByParents sorts builds so parents are before their children.
+func sortByParents(builds []types.BuildInfo) []types.BuildInfo {
+	byID := map[types.BuildID]types.BuildInfo{}
+	for _, build := range builds {
+		byID[build.BuildID] = build
+	}
+
+	res := make([]types.BuildInfo, 0, len(builds))
+	added := map[types.BuildID]bool{}
+	var add func(build types.BuildInfo)
+	add = func(build types.BuildInfo) {
+		if added[build.BuildID] {
+			return
+		}
+		added[build.BuildID] = true
+		if parent, exists := byID[build.BasedOn]; exists {
+			add(parent)
+		}
+		res = append(res, build)
+	}
+	for _, build := range builds {
+		add(build)
+	}
+	return res
+}
@@ -47,6 +47,27 @@ func cleanKernel(buildID types.BuildID, bootPrefix string) error {
 	})
 }
 
+// revertKernel replaces kernel of the boot build with the one taken from the image it was created from.
+func revertKernel(ctx context.Context, storage config.Storage, build types.BuildInfo, s storage.Driver) error {
+	image, err := s.Info(ctx, build.BasedOn)
+	if err != nil {
+		return err
+	}
+	path, dropFn, err := mountTemporarily(ctx, image, s)
+	if err != nil {
+		return err
+	}
+	if err := cleanKernel(build.BuildID, bootPrefix(storage.Root)); err != nil {
+		_ = dropFn()
+		return err
+	}
+	if err := copyKernel(path, storage, build.BuildID); err != nil {
+		_ = dropFn()
+		return err
+	}
+	return dropFn()
+}
+
 //go:embed grub.tmpl.cfg
 var grubTemplate string
 var grubTemplateCompiled = template.Must(template.New("grub").Parse(grubTemplate))
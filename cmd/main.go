@@ -9,10 +9,13 @@ import (
 	"github.com/outofforest/isolator/executor"
 	"github.com/outofforest/isolator/wire"
 	"github.com/outofforest/osman/commands"
+	"github.com/outofforest/osman/config"
 	"github.com/outofforest/osman/infra"
 	"github.com/outofforest/osman/infra/base"
 	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
 	"github.com/outofforest/osman/infra/parser"
+	"github.com/outofforest/osman/infra/runner"
 	"github.com/outofforest/osman/infra/storage"
 	"github.com/outofforest/run"
 )
@@ -20,11 +23,12 @@ import (
 func iocBuilder(c *ioc.Container) {
 	c.Singleton(commands.NewCmdFactory)
 	c.Singleton(base.NewDockerInitializer)
+	c.Singleton(runner.NewIsolatorRunner)
 	c.Singleton(infra.NewRepository)
 	c.Transient(infra.NewBuilder)
 
-	c.Singleton(storage.Resolve)
-	c.SingletonNamed("zfs", storage.NewZFSDriver)
+	storage.Register(c)
+	c.Singleton(lock.NewManager)
 
 	c.Singleton(parser.NewResolvingParser)
 	c.SingletonNamed("spec", parser.NewSpecFileParser)
@@ -32,6 +36,7 @@ func iocBuilder(c *ioc.Container) {
 	c.Singleton(format.Resolve)
 	c.SingletonNamed("table", format.NewTableFormatter)
 	c.SingletonNamed("json", format.NewJSONFormatter)
+	c.SingletonNamed(config.FormatterDot, format.NewDotFormatter)
 
 	c.Singleton(commands.NewRootCommand)
 	c.SingletonNamed("build", commands.NewBuildCommand)
@@ -41,6 +46,16 @@ func iocBuilder(c *ioc.Container) {
 	c.SingletonNamed("list", commands.NewListCommand)
 	c.SingletonNamed("drop", commands.NewDropCommand)
 	c.SingletonNamed("tag", commands.NewTagCommand)
+	c.SingletonNamed("label", commands.NewLabelCommand)
+	c.SingletonNamed("revert", commands.NewRevertCommand)
+	c.SingletonNamed("commit", commands.NewCommitCommand)
+	c.SingletonNamed("gc", commands.NewGCCommand)
+	c.SingletonNamed("export", commands.NewExportCommand)
+	c.SingletonNamed("import", commands.NewImportCommand)
+	c.SingletonNamed("replicate", commands.NewReplicateCommand)
+	c.SingletonNamed("inspect", commands.NewInspectCommand)
+	c.SingletonNamed("diff", commands.NewDiffCommand)
+	c.SingletonNamed("migrate", commands.NewMigrateCommand)
 }
 
 func main() {
@@ -49,6 +64,7 @@ func main() {
 		WithFlavour(executor.NewFlavour(executor.Config{
 			Router: executor.NewRouter().
 				RegisterHandler(wire.Execute{}, executor.ExecuteHandler).
+				RegisterHandler(runner.Execute{}, runner.ExecuteHandler).
 				RegisterHandler(wire.InflateDockerImage{}, executor.NewInflateDockerImageHandler()),
 		})).
 		Run(context.Background(), "osman", func(ctx context.Context, rootCmd *cobra.Command) error {
@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -10,8 +11,11 @@ import (
 	"github.com/outofforest/ioc/v2"
 	"github.com/outofforest/osman"
 	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra"
 	"github.com/outofforest/osman/infra/description"
 	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
+	"github.com/outofforest/osman/infra/storage"
 	"github.com/outofforest/osman/infra/types"
 )
 
@@ -29,10 +33,38 @@ func NewBuildCommand(cmdF *CmdFactory) *cobra.Command {
 			c.Singleton(storageF.Config)
 			c.Singleton(formatF.Config)
 			c.Singleton(buildF.Config)
-		}, func(c *ioc.Container, formatter format.Formatter) error {
+		}, func(
+			ctx context.Context,
+			c *ioc.Container,
+			storageConfig config.Storage,
+			s storage.Driver,
+			formatter format.Formatter,
+			locks *lock.Manager,
+		) (retErr error) {
+			if err := storageConfig.Validate(); err != nil {
+				return err
+			}
+
+			// Build may run for hours, so storage is locked only while it is modified. Builds lock protects
+			// images which are not tagged yet from being collected by gc.
+			unlock, err := locks.Builds(ctx, storageConfig, lock.Shared)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := unlock(); retErr == nil {
+					retErr = err
+				}
+			}()
+
+			buildC := c.SubContainer()
+			buildC.Singleton(func() storage.Driver {
+				return storage.NewLockedDriver(s, storageConfig, locks)
+			})
+			buildC.Transient(infra.NewBuilder)
+
 			var builds []types.BuildInfo
-			var err error
-			c.Call(osman.Build, &builds, &err)
+			buildC.Call(osman.Build, &builds, &err)
 			if err != nil {
 				return err
 			}
@@ -41,6 +73,7 @@ func NewBuildCommand(cmdF *CmdFactory) *cobra.Command {
 		}),
 	}
 	storageF = cmdF.AddStorageFlags(cmd)
+	cmdF.AddEncryptFlag(cmd, storageF)
 	formatF = cmdF.AddFormatFlags(cmd)
 	cmd.Flags().StringSliceVar(&buildF.Names, "name", []string{},
 		"Name of built image, if empty name is derived from corresponding specfile")
@@ -48,6 +81,12 @@ func NewBuildCommand(cmdF *CmdFactory) *cobra.Command {
 		"Tags assigned to created build")
 	cmd.Flags().BoolVar(&buildF.Rebuild, "rebuild", false,
 		"If set, all parent images are rebuilt even if they exist")
+	cmd.Flags().BoolVar(&buildF.NoCache, "no-cache", false,
+		"If set, image is built even if the one built from the same parent and instructions exists")
+	cmd.Flags().StringArrayVar(&buildF.BuildArgs, "build-arg", nil,
+		"Value of the argument declared in spec file, in the form of name=value")
+	cmd.Flags().BoolVar(&buildF.KeepStages, "keep-stages", false,
+		"If set, images built by intermediate stages are kept, they are named <image name>-stage-<stage name or index>")
 	cmd.Flags().StringVar(&buildF.CacheDir, "cache-dir", must.String(os.UserCacheDir())+"/osman",
 		"Path to a directory where files are cached")
 	return cmd
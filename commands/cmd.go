@@ -1,8 +1,10 @@
 package commands
 
 import (
+	"context"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/ridge/must"
 	"github.com/spf13/cobra"
@@ -10,19 +12,22 @@ import (
 	"github.com/outofforest/ioc/v2"
 	"github.com/outofforest/osman/config"
 	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
 	"github.com/outofforest/osman/infra/storage"
 )
 
 // NewCmdFactory returns new CmdFactory.
 func NewCmdFactory(c *ioc.Container) *CmdFactory {
 	return &CmdFactory{
-		c: c,
+		c:     c,
+		lockF: &config.LockFactory{},
 	}
 }
 
 // CmdFactory is a wrapper around cobra RunE.
 type CmdFactory struct {
-	c *ioc.Container
+	c     *ioc.Container
+	lockF *config.LockFactory
 }
 
 // Cmd returns function compatible with RunE.
@@ -31,6 +36,7 @@ func (f *CmdFactory) Cmd(setupFunc interface{}, cmdFunc interface{}) func(cmd *c
 		f.c.Singleton(func() config.Args {
 			return args
 		})
+		f.c.Singleton(f.lockF.Config)
 		if setupFunc != nil {
 			f.c.Call(setupFunc)
 		}
@@ -40,6 +46,32 @@ func (f *CmdFactory) Cmd(setupFunc interface{}, cmdFunc interface{}) func(cmd *c
 	}
 }
 
+// StorageCmd returns function compatible with RunE. Command is executed while storage is locked in the mode.
+func (f *CmdFactory) StorageCmd(
+	mode lock.Mode,
+	setupFunc interface{},
+	cmdFunc interface{},
+) func(cmd *cobra.Command, args []string) error {
+	return f.Cmd(setupFunc, func(ctx context.Context, storage config.Storage, locks *lock.Manager) (retErr error) {
+		if err := storage.Validate(); err != nil {
+			return err
+		}
+
+		unlock, err := locks.Storage(ctx, storage, mode)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := unlock(); retErr == nil {
+				retErr = err
+			}
+		}()
+
+		f.c.Call(cmdFunc, &retErr)
+		return retErr
+	})
+}
+
 // AddStorageFlags adds storage flags to command.
 func (f *CmdFactory) AddStorageFlags(cmd *cobra.Command) *config.StorageFactory {
 	storageF := &config.StorageFactory{}
@@ -48,10 +80,31 @@ func (f *CmdFactory) AddStorageFlags(cmd *cobra.Command) *config.StorageFactory
 		"Location where built images are stored")
 	cmd.Flags().StringVar(&storageF.Driver, "storage-driver", "zfs",
 		"Storage driver to use: "+strings.Join(f.c.Names((*storage.Driver)(nil)), " | "))
+	cmd.Flags().StringVar(&f.lockF.Dir, "lock-dir", "/run/lock/osman",
+		"Directory where locks protecting storage and VM network are stored")
+	cmd.Flags().DurationVar(&f.lockF.Timeout, "lock-timeout", 10*time.Minute,
+		"Maximum time spent on waiting for lock held by another osman process, 0 means waiting forever")
 
 	return storageF
 }
 
+// AddEncryptFlag adds flag enabling encryption of created builds and flags specifying the key.
+func (f *CmdFactory) AddEncryptFlag(cmd *cobra.Command, storageF *config.StorageFactory) {
+	cmd.Flags().BoolVar(&storageF.Encrypt, "encrypt", false,
+		"Encrypt created builds, builds created from encrypted images are always encrypted")
+	f.AddKeyFlags(cmd, storageF)
+}
+
+// AddKeyFlags adds flags specifying the key used by encrypted builds created by the command.
+func (f *CmdFactory) AddKeyFlags(cmd *cobra.Command, storageF *config.StorageFactory) {
+	cmd.Flags().StringVar(&storageF.KeyFile, "key-file", "",
+		"File containing the key used to encrypt builds")
+	cmd.Flags().StringVar(&storageF.KeyProvider, "key-provider", "",
+		"Command printing the key used to encrypt builds to its standard output")
+	cmd.Flags().StringVar(&storageF.KeyFormat, "key-format", "passphrase",
+		"Format of the key used to encrypt builds: raw | hex | passphrase")
+}
+
 // AddFilterFlags adds filtering flags to command.
 func (f *CmdFactory) AddFilterFlags(cmd *cobra.Command, defaultTypes []string) *config.FilterFactory {
 	filterF := &config.FilterFactory{}
@@ -60,6 +113,8 @@ func (f *CmdFactory) AddFilterFlags(cmd *cobra.Command, defaultTypes []string) *
 		"Consider only builds of specified types: "+strings.Join(config.BuildTypes(), " | "))
 	cmd.Flags().BoolVar(&filterF.Untagged, "untagged", false,
 		"If set, only untagged builds are considered")
+	cmd.Flags().StringArrayVar(&filterF.Labels, "label", nil,
+		"Consider only builds having label in the form of key=value")
 
 	return filterF
 }
@@ -70,6 +125,8 @@ func (f *CmdFactory) AddFormatFlags(cmd *cobra.Command) *config.FormatFactory {
 
 	cmd.Flags().StringVar(&formatF.Formatter, "format", "table",
 		"Name of formatter used to format the output: "+strings.Join(f.c.Names((*format.Formatter)(nil)), " | "))
+	cmd.Flags().StringSliceVar(&formatF.Fields, "fields", nil,
+		"Fields to print, if not set the default ones are printed")
 
 	return formatF
 }
@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/outofforest/ioc/v2"
+	"github.com/outofforest/osman"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// NewCommitCommand returns new commit command.
+func NewCommitCommand(cmdF *CmdFactory) *cobra.Command {
+	var storageF *config.StorageFactory
+	var filterF *config.FilterFactory
+	var formatF *config.FormatFactory
+	commitF := &config.CommitFactory{}
+
+	cmd := &cobra.Command{
+		Short: "Creates image from the current content of mount or VM",
+		Args:  cobra.ExactArgs(1),
+		Use:   "commit [flags] buildID | name:tag",
+		RunE: cmdF.StorageCmd(lock.Exclusive, func(c *ioc.Container) {
+			c.Singleton(storageF.Config)
+			c.Singleton(filterF.Config)
+			c.Singleton(formatF.Config)
+			c.Singleton(commitF.Config)
+		}, func(c *ioc.Container, formatter format.Formatter, formatConfig config.Format) error {
+			var builds []types.BuildInfo
+			var err error
+			c.Call(osman.Commit, &builds, &err)
+			if err != nil {
+				return err
+			}
+			fmt.Println(formatter.Format(builds, formatConfig.FieldsOrDefault(defaultFields...)...))
+			return nil
+		}),
+	}
+	storageF = cmdF.AddStorageFlags(cmd)
+	cmdF.AddKeyFlags(cmd, storageF)
+	filterF = cmdF.AddFilterFlags(cmd, []string{config.BuildTypeMount, config.BuildTypeVM})
+	formatF = cmdF.AddFormatFlags(cmd)
+	cmd.Flags().StringVar(&commitF.Name, "name", "", "Name of the image, name of the original image is used by default")
+	cmd.Flags().StringSliceVar(&commitF.Tags, "tag", []string{}, "Tags to be applied on the image")
+	cmd.Flags().StringSliceVar(&commitF.Params, "param", nil,
+		"Params of the image, params of the original image are used by default")
+	cmd.Flags().StringArrayVar(&commitF.Boots, "boot", nil,
+		"Boot option of the image in the form of 'title [params...]', "+
+			"boot options of the original image are used by default")
+	cmd.Flags().BoolVar(&commitF.Pause, "pause", false, "Pause running VM while its content is read")
+	cmd.Flags().StringVar(&commitF.LibvirtAddr, "libvirt-addr", "unix:///var/run/libvirt/libvirt-sock",
+		"Address libvirt listens on")
+	return cmd
+}
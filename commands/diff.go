@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/outofforest/ioc/v2"
+	"github.com/outofforest/osman"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// NewDiffCommand returns new diff command.
+func NewDiffCommand(cmdF *CmdFactory) *cobra.Command {
+	var storageF *config.StorageFactory
+	var formatF *config.FormatFactory
+	diffF := &config.DiffFactory{}
+
+	cmd := &cobra.Command{
+		Short: "Lists paths changed between builds, single build is compared with the one it is based on",
+		Args:  cobra.RangeArgs(1, 2),
+		Use:   "diff [flags] [baseBuildID | [base-name][:tag]] buildID | [name][:tag]",
+		// Diff creates and drops temporary mount builds, which is safe under shared lock. They are private
+		// to this process and never considered by gc, while drop and gc holding exclusive lock can't run
+		// until they are dropped. Concurrent readers only create their own mounts, which don't modify
+		// the builds they are cloned from.
+		RunE: cmdF.StorageCmd(lock.Shared, func(c *ioc.Container) {
+			c.Singleton(storageF.Config)
+			c.Singleton(formatF.Config)
+			c.Singleton(diffF.Config)
+		}, func(c *ioc.Container, formatter format.Formatter, formatConfig config.Format) error {
+			var changes []types.Change
+			var err error
+			c.Call(osman.Diff, &changes, &err)
+			if err != nil {
+				return err
+			}
+			fmt.Println(formatter.Format(changes, formatConfig.FieldsOrDefault()...))
+			return nil
+		}),
+	}
+	storageF = cmdF.AddStorageFlags(cmd)
+	cmdF.AddKeyFlags(cmd, storageF)
+	formatF = cmdF.AddFormatFlags(cmd)
+	cmd.Flags().StringSliceVar(&diffF.Paths, "path", []string{},
+		"Report only changes of paths equal to, located inside or matching the glob pattern")
+	return cmd
+}
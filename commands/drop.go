@@ -11,6 +11,7 @@ import (
 	"github.com/outofforest/osman"
 	"github.com/outofforest/osman/config"
 	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
 )
 
 // NewDropCommand returns new drop command.
@@ -23,7 +24,7 @@ func NewDropCommand(cmdF *CmdFactory) *cobra.Command {
 	cmd := &cobra.Command{
 		Short: "Drops builds",
 		Use:   "drop [flags] [... buildID | [name][:tag]]",
-		RunE: cmdF.Cmd(func(c *ioc.Container) {
+		RunE: cmdF.StorageCmd(lock.Exclusive, func(c *ioc.Container) {
 			c.Singleton(storageF.Config)
 			c.Singleton(filterF.Config)
 			c.Singleton(formatF.Config)
@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/ridge/must"
+	"github.com/spf13/cobra"
+
+	"github.com/outofforest/ioc/v2"
+	"github.com/outofforest/osman"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// NewExportCommand returns new export command.
+func NewExportCommand(cmdF *CmdFactory) *cobra.Command {
+	var storageF *config.StorageFactory
+	var filterF *config.FilterFactory
+	exportF := &config.ExportFactory{}
+
+	cmd := &cobra.Command{
+		Short: "Exports images to archive",
+		Use:   "export [flags] [... buildID | [name][:tag]]",
+		// Export creates and drops temporary mount builds, which is safe under shared lock. They are private
+		// to this process and never considered by gc, while drop and gc holding exclusive lock can't run
+		// until they are dropped. Concurrent readers only create their own mounts, which don't modify
+		// the builds they are cloned from.
+		RunE: cmdF.StorageCmd(lock.Shared, func(c *ioc.Container) {
+			c.Singleton(storageF.Config)
+			c.Singleton(filterF.Config)
+			// --format flag selects format of the archive, so builds are always printed as table.
+			c.Singleton(func() config.Format {
+				return config.Format{Formatter: "table"}
+			})
+			c.Singleton(exportF.Config)
+		}, func(c *ioc.Container, formatter format.Formatter) error {
+			var builds []types.BuildInfo
+			var err error
+			c.Call(osman.Export, &builds, &err)
+			if err != nil {
+				return err
+			}
+			fmt.Println(formatter.Format(builds, defaultFields...))
+			return nil
+		}),
+	}
+	storageF = cmdF.AddStorageFlags(cmd)
+	cmdF.AddKeyFlags(cmd, storageF)
+	filterF = cmdF.AddFilterFlags(cmd, []string{config.BuildTypeImage})
+	cmd.Flags().StringVarP(&exportF.File, "output", "o", "",
+		"Path of archive to create, OCI image layout is stored in directory unless path ends with .tar")
+	cmd.Flags().StringVar(&exportF.Format, "format", config.ExportFormatOsman,
+		"Format of archive: "+config.ExportFormatOsman+" | "+config.ExportFormatOCI)
+	cmd.Flags().BoolVar(&exportF.WithParents, "with-parents", false,
+		"If set, all the parents of exported images are included in the archive")
+	cmd.Flags().BoolVar(&exportF.Tar, "tar", false,
+		"If set, filesystems are stored as tar archives even if storage driver supports native streams, "+
+			"required to import builds using different storage driver")
+	must.OK(cmd.MarkFlagRequired("output"))
+	return cmd
+}
@@ -0,0 +1,98 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/outofforest/ioc/v2"
+	"github.com/outofforest/osman"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// NewGCCommand returns new gc command.
+func NewGCCommand(cmdF *CmdFactory) *cobra.Command {
+	var storageF *config.StorageFactory
+	var filterF *config.FilterFactory
+	var formatF *config.FormatFactory
+	gcF := &config.GCFactory{}
+
+	cmd := &cobra.Command{
+		Short: "Drops untagged images not used by other builds",
+		Use:   "gc [flags] [... buildID | [name][:tag]]",
+		RunE: cmdF.Cmd(func(c *ioc.Container) {
+			c.Singleton(storageF.Config)
+			c.Singleton(filterF.Config)
+			c.Singleton(formatF.Config)
+			c.Singleton(gcF.Config)
+		}, func(
+			ctx context.Context,
+			c *ioc.Container,
+			storageConfig config.Storage,
+			formatter format.Formatter,
+			formatConfig config.Format,
+			locks *lock.Manager,
+		) (retErr error) {
+			if err := storageConfig.Validate(); err != nil {
+				return err
+			}
+
+			// Builds lock is acquired before the storage one, in the same order as build does, so images
+			// being built are not collected.
+			unlock, err := locks.Builds(ctx, storageConfig, lock.Exclusive)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := unlock(); retErr == nil {
+					retErr = err
+				}
+			}()
+
+			unlockStorage, err := locks.Storage(ctx, storageConfig, lock.Exclusive)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := unlockStorage(); retErr == nil {
+					retErr = err
+				}
+			}()
+
+			var plan []types.BuildInfo
+			var results []osman.Result
+			c.Call(osman.GC, &plan, &results, &err)
+			if err != nil {
+				return err
+			}
+			if gcF.DryRun {
+				sort.Slice(plan, func(i int, j int) bool {
+					return plan[i].CreatedAt.Before(plan[j].CreatedAt)
+				})
+				fmt.Println(formatter.Format(plan, formatConfig.FieldsOrDefault(defaultFields...)...))
+				return nil
+			}
+			for _, r := range results {
+				if r.Result != nil {
+					err = errors.New("some drops failed")
+					break
+				}
+			}
+			fmt.Println(formatter.Format(results))
+			return err
+		}),
+	}
+	storageF = cmdF.AddStorageFlags(cmd)
+	filterF = cmdF.AddFilterFlags(cmd, []string{config.BuildTypeImage})
+	formatF = cmdF.AddFormatFlags(cmd)
+	cmd.Flags().IntVar(&gcF.KeepLast, "keep-last", 0, "Number of the most recent builds kept for each image name")
+	cmd.Flags().DurationVar(&gcF.KeepNewer, "keep-newer", 0, "Builds created within this period are kept")
+	cmd.Flags().BoolVar(&gcF.DryRun, "dry-run", false, "Print builds to be dropped instead of dropping them")
+	return cmd
+}
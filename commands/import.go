@@ -0,0 +1,45 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/outofforest/ioc/v2"
+	"github.com/outofforest/osman"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// NewImportCommand returns new import command.
+func NewImportCommand(cmdF *CmdFactory) *cobra.Command {
+	var storageF *config.StorageFactory
+	var formatF *config.FormatFactory
+	importF := &config.ImportFactory{}
+
+	cmd := &cobra.Command{
+		Short: "Imports images from archive",
+		Args:  cobra.ExactArgs(1),
+		Use:   "import [flags] archive",
+		RunE: cmdF.StorageCmd(lock.Exclusive, func(c *ioc.Container) {
+			c.Singleton(storageF.Config)
+			c.Singleton(formatF.Config)
+			c.Singleton(importF.Config)
+		}, func(c *ioc.Container, formatter format.Formatter, formatConfig config.Format) error {
+			var builds []types.BuildInfo
+			var err error
+			c.Call(osman.Import, &builds, &err)
+			if err != nil {
+				return err
+			}
+			fmt.Println(formatter.Format(builds, formatConfig.FieldsOrDefault(defaultFields...)...))
+			return nil
+		}),
+	}
+	storageF = cmdF.AddStorageFlags(cmd)
+	cmdF.AddKeyFlags(cmd, storageF)
+	formatF = cmdF.AddFormatFlags(cmd)
+	return cmd
+}
@@ -0,0 +1,169 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/outofforest/ioc/v2"
+	"github.com/outofforest/osman"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
+)
+
+// NewInspectCommand returns new inspect command.
+func NewInspectCommand(cmdF *CmdFactory) *cobra.Command {
+	var storageF *config.StorageFactory
+	var filterF *config.FilterFactory
+	var formatF *config.FormatFactory
+	inspectF := &config.InspectFactory{}
+
+	cmd := &cobra.Command{
+		Short: "Shows detailed information about build, its ancestors and resources depending on it",
+		Args:  cobra.ExactArgs(1),
+		Use:   "inspect [flags] buildID | [name][:tag]",
+		RunE: cmdF.StorageCmd(lock.Shared, func(c *ioc.Container) {
+			c.Singleton(storageF.Config)
+			c.Singleton(filterF.Config)
+			c.Singleton(formatF.Config)
+			c.Singleton(inspectF.Config)
+		}, func(
+			c *ioc.Container,
+			formatter format.Formatter,
+			formatConfig config.Format,
+			inspectConfig config.Inspect,
+		) error {
+			var inspection osman.Inspection
+			var err error
+			c.Call(osman.Inspect, &inspection, &err)
+			if err != nil {
+				return err
+			}
+			if inspectConfig.Provenance {
+				statement, err := osman.NewProvenanceStatement(inspection.Build)
+				if err != nil {
+					return err
+				}
+				statementRaw, err := json.MarshalIndent(statement, "", "  ")
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				fmt.Println(string(statementRaw))
+				return nil
+			}
+			if formatConfig.Formatter != "table" {
+				fmt.Println(formatter.Format(inspection))
+				return nil
+			}
+			fmt.Println(formatInspection(formatter, formatConfig, inspection))
+			return nil
+		}),
+	}
+	storageF = cmdF.AddStorageFlags(cmd)
+	filterF = cmdF.AddFilterFlags(cmd, config.BuildTypes())
+	formatF = cmdF.AddFormatFlags(cmd)
+	cmd.Flags().StringVar(&inspectF.LibvirtAddr, "libvirt-addr", "unix:///var/run/libvirt/libvirt-sock",
+		"Address libvirt listens on")
+	cmd.Flags().BoolVar(&inspectF.Provenance, "provenance", false,
+		"Print provenance of the build as in-toto statement with SLSA predicate")
+	return cmd
+}
+
+// formatInspection renders detailed view of the build followed by tables of related builds and domains.
+func formatInspection(formatter format.Formatter, formatConfig config.Format, inspection osman.Inspection) string {
+	build := inspection.Build
+	boots := make([]string, 0, len(build.Boots))
+	for _, boot := range build.Boots {
+		boots = append(boots, strings.TrimSpace(boot.Title+" "+strings.Join(boot.Params, " ")))
+	}
+
+	sb := &strings.Builder{}
+	for _, property := range []struct {
+		Name  string
+		Value interface{}
+	}{
+		{Name: "BuildID", Value: build.BuildID},
+		{Name: "Type", Value: build.BuildID.Type()},
+		{Name: "BasedOn", Value: build.BasedOn},
+		{Name: "CreatedAt", Value: build.CreatedAt.Format("2006-01-02 15:04:05")},
+		{Name: "Name", Value: build.Name},
+		{Name: "Tags", Value: build.Tags},
+		{Name: "Params", Value: build.Params},
+		{Name: "Boots", Value: strings.Join(boots, ", ")},
+		{Name: "Env", Value: build.Env},
+		{Name: "WorkDir", Value: build.WorkDir},
+		{Name: "User", Value: build.User},
+		{Name: "Args", Value: build.Args},
+		{Name: "Labels", Value: build.Labels},
+		{Name: "Mounted", Value: build.Mounted},
+		{Name: "CacheKey", Value: build.CacheKey},
+		{Name: "Used", Value: build.Used},
+		{Name: "Referenced", Value: build.Referenced},
+		{Name: "Written", Value: build.Written},
+		{Name: "CompressRatio", Value: build.CompressRatio},
+		{Name: "Encryption", Value: build.Encryption},
+	} {
+		fmt.Fprintf(sb, "%-14s %s\n", property.Name+":", property.Value)
+	}
+
+	fields := formatConfig.FieldsOrDefault(defaultFields...)
+	for _, section := range []struct {
+		Name   string
+		List   interface{}
+		Len    int
+		Fields []string
+	}{
+		{Name: "Ancestors", List: inspection.Ancestors, Len: len(inspection.Ancestors), Fields: fields},
+		{Name: "Children", List: inspection.Children, Len: len(inspection.Children), Fields: fields},
+		{Name: "Mounts", List: inspection.Mounts, Len: len(inspection.Mounts), Fields: fields},
+		{Name: "Boots", List: inspection.Boots, Len: len(inspection.Boots), Fields: fields},
+		{Name: "VMs", List: inspection.VMs, Len: len(inspection.VMs), Fields: fields},
+		{Name: "Domains", List: inspection.Domains, Len: len(inspection.Domains)},
+	} {
+		if section.Len > 0 {
+			fmt.Fprintf(sb, "\n%s:\n%s\n", section.Name, formatter.Format(section.List, section.Fields...))
+		}
+	}
+
+	if provenance := build.Provenance; provenance != nil {
+		fmt.Fprintf(sb, "\nProvenance:\n")
+		specFile := "-"
+		if provenance.SpecFile != nil {
+			specFile = provenance.SpecFile.Path + " (" + provenance.SpecFile.Digest + ")"
+		}
+		includes := make([]string, 0, len(provenance.Includes))
+		for _, include := range provenance.Includes {
+			includes = append(includes, include.Path+" ("+include.Digest+")")
+		}
+		parents := make([]string, 0, len(provenance.Parents))
+		for _, parent := range provenance.Parents {
+			parents = append(parents, string(parent))
+		}
+		for _, property := range []struct {
+			Name  string
+			Value interface{}
+		}{
+			{Name: "SpecFile", Value: specFile},
+			{Name: "Includes", Value: strings.Join(includes, ", ")},
+			{Name: "Parents", Value: strings.Join(parents, ", ")},
+			{Name: "BaseImage", Value: provenance.BaseImage},
+			{Name: "Version", Value: provenance.Version},
+			{Name: "Host", Value: provenance.Host},
+			{Name: "StartedAt", Value: provenance.StartedAt.Format("2006-01-02 15:04:05")},
+			{Name: "Duration", Value: provenance.FinishedAt.Sub(provenance.StartedAt).Round(time.Millisecond)},
+		} {
+			fmt.Fprintf(sb, "%-14s %v\n", property.Name+":", property.Value)
+		}
+		if len(provenance.Steps) > 0 {
+			fmt.Fprintf(sb, "\nSteps:\n%s\n", formatter.Format(provenance.Steps))
+		}
+	}
+
+	// Remove last new line.
+	return strings.TrimSuffix(sb.String(), "\n")
+}
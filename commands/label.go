@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/outofforest/ioc/v2"
+	"github.com/outofforest/osman"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// NewLabelCommand returns new label command.
+func NewLabelCommand(cmdF *CmdFactory) *cobra.Command {
+	var storageF *config.StorageFactory
+	var filterF *config.FilterFactory
+	var formatF *config.FormatFactory
+	labelF := &config.LabelFactory{}
+
+	cmd := &cobra.Command{
+		Short: "Removes and sets labels of the builds",
+		Use:   "label [flags] [... buildID | [name][:tag]]",
+		RunE: cmdF.StorageCmd(lock.Exclusive, func(c *ioc.Container) {
+			c.Singleton(storageF.Config)
+			c.Singleton(filterF.Config)
+			c.Singleton(labelF.Config)
+			c.Singleton(formatF.Config)
+		}, func(c *ioc.Container, formatter format.Formatter, formatConfig config.Format) error {
+			var builds []types.BuildInfo
+			var err error
+			c.Call(osman.Label, &builds, &err)
+			if err != nil {
+				return err
+			}
+			sort.Slice(builds, func(i int, j int) bool {
+				return builds[i].CreatedAt.Before(builds[j].CreatedAt)
+			})
+			fmt.Println(formatter.Format(builds, formatConfig.FieldsOrDefault(defaultFields...)...))
+			return nil
+		}),
+	}
+	storageF = cmdF.AddStorageFlags(cmd)
+	filterF = cmdF.AddFilterFlags(cmd, []string{config.BuildTypeImage})
+	formatF = cmdF.AddFormatFlags(cmd)
+	cmd.Flags().StringSliceVar(&labelF.Remove, "remove", []string{}, "Key of label to be removed")
+	cmd.Flags().StringArrayVar(&labelF.Set, "set", []string{}, "Label to be set in the form of key=value")
+	cmd.Flags().BoolVar(&labelF.All, "all", false,
+		"It is required to set this flag to label builds if no filters are provided")
+	return cmd
+}
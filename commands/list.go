@@ -4,41 +4,59 @@ import (
 	"fmt"
 	"sort"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 
 	"github.com/outofforest/ioc/v2"
 	"github.com/outofforest/osman"
 	"github.com/outofforest/osman/config"
 	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
 	"github.com/outofforest/osman/infra/types"
 )
 
-var defaultFields = []string{"BuildID", "BasedOn", "CreatedAt", "Name", "Tags", "Mounted"}
+var defaultFields = []string{"BuildID", "BasedOn", "CreatedAt", "Name", "Tags", "Mounted", "Encryption"}
 
 // NewListCommand returns new list command.
 func NewListCommand(cmdF *CmdFactory) *cobra.Command {
 	var storageF *config.StorageFactory
 	var filterF *config.FilterFactory
 	var formatF *config.FormatFactory
+	var summary bool
+	var tree bool
 
 	cmd := &cobra.Command{
 		Short: "Lists information about available builds",
 		Use:   "list [flags] [... buildID | [name][:tag]]",
-		RunE: cmdF.Cmd(func(c *ioc.Container) {
+		RunE: cmdF.StorageCmd(lock.Shared, func(c *ioc.Container) {
 			c.Singleton(storageF.Config)
 			c.Singleton(filterF.Config)
 			c.Singleton(formatF.Config)
-		}, func(c *ioc.Container, formatter format.Formatter) error {
+		}, func(c *ioc.Container, formatter format.Formatter, formatConfig config.Format) error {
 			var builds []types.BuildInfo
 			var err error
 			c.Call(osman.List, &builds, &err)
 			if err != nil {
 				return err
 			}
+			if summary {
+				if formatConfig.Formatter == config.FormatterDot {
+					return errors.Errorf("format '%s' can't be used with --summary", formatConfig.Formatter)
+				}
+				fmt.Println(formatter.Format(osman.Summarize(builds), formatConfig.Fields...))
+				return nil
+			}
 			sort.Slice(builds, func(i int, j int) bool {
 				return builds[i].CreatedAt.Before(builds[j].CreatedAt)
 			})
-			fmt.Println(formatter.Format(builds, defaultFields...))
+			if tree {
+				if formatConfig.Formatter != "table" {
+					return errors.New("--tree can be used with table format only")
+				}
+				fmt.Println(format.Tree(builds))
+				return nil
+			}
+			fmt.Println(formatter.Format(builds, formatConfig.FieldsOrDefault(defaultFields...)...))
 			return nil
 		}),
 	}
@@ -47,5 +65,8 @@ func NewListCommand(cmdF *CmdFactory) *cobra.Command {
 	filterF = cmdF.AddFilterFlags(cmd, []string{config.BuildTypeImage, config.BuildTypeMount, config.BuildTypeBoot,
 		config.BuildTypeVM})
 	formatF = cmdF.AddFormatFlags(cmd)
+	formatF.Graph = true
+	cmd.Flags().BoolVar(&summary, "summary", false, "Print space used by builds of each name and type")
+	cmd.Flags().BoolVar(&tree, "tree", false, "Print builds as a forest organized by the builds they are based on, requires table format")
 	return cmd
 }
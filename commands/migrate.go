@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/outofforest/ioc/v2"
+	"github.com/outofforest/osman"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// NewMigrateCommand returns new migrate command.
+func NewMigrateCommand(cmdF *CmdFactory) *cobra.Command {
+	var storageF *config.StorageFactory
+	var formatF *config.FormatFactory
+
+	cmd := &cobra.Command{
+		Short: "Stores info of all the builds using the current version of the schema",
+		Args:  cobra.NoArgs,
+		Use:   "migrate [flags]",
+		RunE: cmdF.StorageCmd(lock.Exclusive, func(c *ioc.Container) {
+			c.Singleton(storageF.Config)
+			c.Singleton(formatF.Config)
+		}, func(c *ioc.Container, formatter format.Formatter, formatConfig config.Format) error {
+			var builds []types.BuildInfo
+			var err error
+			c.Call(osman.Migrate, &builds, &err)
+			if err != nil {
+				return err
+			}
+			fmt.Println(formatter.Format(builds, formatConfig.FieldsOrDefault(defaultFields...)...))
+			return nil
+		}),
+	}
+	storageF = cmdF.AddStorageFlags(cmd)
+	formatF = cmdF.AddFormatFlags(cmd)
+	return cmd
+}
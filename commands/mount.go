@@ -9,6 +9,7 @@ import (
 	"github.com/outofforest/osman"
 	"github.com/outofforest/osman/config"
 	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
 	"github.com/outofforest/osman/infra/types"
 )
 
@@ -23,7 +24,7 @@ func NewMountCommand(cmdF *CmdFactory) *cobra.Command {
 		Short: "Mounts image",
 		Args:  cobra.RangeArgs(1, 2),
 		Use:   "mount [flags] image [name][:tag]",
-		RunE: cmdF.Cmd(func(c *ioc.Container) {
+		RunE: cmdF.StorageCmd(lock.Exclusive, func(c *ioc.Container) {
 			c.Singleton(storageF.Config)
 			c.Singleton(filterF.Config)
 			c.Singleton(formatF.Config)
@@ -40,6 +41,7 @@ func NewMountCommand(cmdF *CmdFactory) *cobra.Command {
 		}),
 	}
 	storageF = cmdF.AddStorageFlags(cmd)
+	cmdF.AddEncryptFlag(cmd, storageF)
 	filterF = cmdF.AddFilterFlags(cmd, []string{config.BuildTypeImage})
 	formatF = cmdF.AddFormatFlags(cmd)
 	cmd.Flags().StringSliceVar(&mountF.Tags, "tag", []string{}, "Tags to be applied on mounts")
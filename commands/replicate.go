@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ridge/must"
+	"github.com/spf13/cobra"
+
+	"github.com/outofforest/ioc/v2"
+	"github.com/outofforest/osman"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
+	"github.com/outofforest/osman/infra/storage"
+)
+
+// NewReplicateCommand returns new replicate command.
+func NewReplicateCommand(cmdF *CmdFactory) *cobra.Command {
+	var storageF *config.StorageFactory
+	var filterF *config.FilterFactory
+	var formatF *config.FormatFactory
+	replicateF := &config.ReplicateFactory{}
+
+	cmd := &cobra.Command{
+		Short: "Copies images to another storage",
+		Use:   "replicate [flags] [... buildID | [name][:tag]]",
+		RunE: cmdF.Cmd(func(c *ioc.Container) {
+			c.Singleton(storageF.Config)
+			c.Singleton(filterF.Config)
+			c.Singleton(formatF.Config)
+			c.Singleton(replicateF.Config)
+		}, func(
+			c *ioc.Container,
+			ctx context.Context,
+			storageConfig config.Storage,
+			filtering config.Filter,
+			replicate config.Replicate,
+			s storage.Driver,
+			formatter format.Formatter,
+			formatConfig config.Format,
+			locks *lock.Manager,
+		) (retErr error) {
+			// Both storages are locked at once, so replications in opposite directions don't deadlock.
+			unlock, err := locks.Storages(ctx,
+				lock.StorageLock{Storage: storageConfig, Mode: lock.Shared},
+				lock.StorageLock{Storage: replicate.Target, Mode: lock.Exclusive},
+			)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := unlock(); retErr == nil {
+					retErr = err
+				}
+			}()
+
+			targetC := c.SubContainer()
+			targetC.Singleton(func() config.Storage {
+				return replicate.Target
+			})
+			storage.Register(targetC)
+			var target storage.Driver
+			targetC.Resolve(&target)
+
+			builds, err := osman.Replicate(ctx, storageConfig, filtering, replicate, s, target)
+			if err != nil {
+				return err
+			}
+			fmt.Println(formatter.Format(builds, formatConfig.FieldsOrDefault(defaultFields...)...))
+			return nil
+		}),
+	}
+	storageF = cmdF.AddStorageFlags(cmd)
+	filterF = cmdF.AddFilterFlags(cmd, []string{config.BuildTypeImage})
+	formatF = cmdF.AddFormatFlags(cmd)
+	cmd.Flags().StringVar(&replicateF.TargetRoot, "target-root", "", "Location where images are replicated to")
+	cmd.Flags().StringVar(&replicateF.TargetDriver, "target-driver", "zfs",
+		"Storage driver used by target storage: "+strings.Join(cmdF.c.Names((*storage.Driver)(nil)), " | "))
+	cmd.Flags().BoolVar(&replicateF.All, "all", false,
+		"It is required to set this flag to replicate builds if no filters are provided")
+	must.OK(cmd.MarkFlagRequired("target-root"))
+	return cmd
+}
@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/outofforest/ioc/v2"
+	"github.com/outofforest/osman"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// NewRevertCommand returns new revert command.
+func NewRevertCommand(cmdF *CmdFactory) *cobra.Command {
+	var storageF *config.StorageFactory
+	var filterF *config.FilterFactory
+	var formatF *config.FormatFactory
+	revertF := &config.RevertFactory{}
+
+	cmd := &cobra.Command{
+		Short: "Reverts builds to the state they had when they were created",
+		Use:   "revert [flags] [... buildID | [name][:tag]]",
+		RunE: cmdF.StorageCmd(lock.Exclusive, func(c *ioc.Container) {
+			c.Singleton(storageF.Config)
+			c.Singleton(filterF.Config)
+			c.Singleton(formatF.Config)
+			c.Singleton(revertF.Config)
+		}, func(c *ioc.Container, formatter format.Formatter, formatConfig config.Format) error {
+			var builds []types.BuildInfo
+			var err error
+			c.Call(osman.Revert, &builds, &err)
+			if err != nil {
+				return err
+			}
+			sort.Slice(builds, func(i int, j int) bool {
+				return builds[i].CreatedAt.Before(builds[j].CreatedAt)
+			})
+			fmt.Println(formatter.Format(builds, formatConfig.FieldsOrDefault(defaultFields...)...))
+			return nil
+		}),
+	}
+	storageF = cmdF.AddStorageFlags(cmd)
+	filterF = cmdF.AddFilterFlags(cmd, []string{config.BuildTypeMount, config.BuildTypeVM, config.BuildTypeBoot})
+	formatF = cmdF.AddFormatFlags(cmd)
+	cmd.Flags().StringVar(&revertF.LibvirtAddr, "libvirt-addr", "unix:///var/run/libvirt/libvirt-sock",
+		"Address libvirt listens on")
+	cmd.Flags().BoolVar(&revertF.All, "all", false,
+		"It is required to set this flag to revert builds if no filters are provided")
+	return cmd
+}
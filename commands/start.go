@@ -11,6 +11,7 @@ import (
 	"github.com/outofforest/osman"
 	"github.com/outofforest/osman/config"
 	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
 	"github.com/outofforest/osman/infra/types"
 )
 
@@ -25,7 +26,7 @@ func NewStartCommand(cmdF *CmdFactory) *cobra.Command {
 		Short: "Starts VMs",
 		Args:  cobra.MinimumNArgs(1),
 		Use:   "start [flags] [name][:tag]",
-		RunE: cmdF.Cmd(func(c *ioc.Container) {
+		RunE: cmdF.StorageCmd(lock.Exclusive, func(c *ioc.Container) {
 			c.Singleton(storageF.Config)
 			c.Singleton(filterF.Config)
 			c.Singleton(formatF.Config)
@@ -42,6 +43,7 @@ func NewStartCommand(cmdF *CmdFactory) *cobra.Command {
 		}),
 	}
 	storageF = cmdF.AddStorageFlags(cmd)
+	cmdF.AddEncryptFlag(cmd, storageF)
 	filterF = cmdF.AddFilterFlags(cmd, []string{config.BuildTypeImage})
 	formatF = cmdF.AddFormatFlags(cmd)
 	cmd.Flags().StringVar(&startF.Tag, "tag", "", "Tag to be applied on VMs")
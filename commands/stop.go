@@ -11,6 +11,7 @@ import (
 	"github.com/outofforest/osman"
 	"github.com/outofforest/osman/config"
 	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
 )
 
 // NewStopCommand creates new stop command.
@@ -23,7 +24,7 @@ func NewStopCommand(cmdF *CmdFactory) *cobra.Command {
 	cmd := &cobra.Command{
 		Short: "Stops VMs",
 		Use:   "stop [flags] [name][:tag]",
-		RunE: cmdF.Cmd(func(c *ioc.Container) {
+		RunE: cmdF.StorageCmd(lock.Shared, func(c *ioc.Container) {
 			c.Singleton(storageF.Config)
 			c.Singleton(filterF.Config)
 			c.Singleton(formatF.Config)
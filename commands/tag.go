@@ -10,6 +10,7 @@ import (
 	"github.com/outofforest/osman"
 	"github.com/outofforest/osman/config"
 	"github.com/outofforest/osman/infra/format"
+	"github.com/outofforest/osman/infra/lock"
 	"github.com/outofforest/osman/infra/types"
 )
 
@@ -23,12 +24,12 @@ func NewTagCommand(cmdF *CmdFactory) *cobra.Command {
 	cmd := &cobra.Command{
 		Short: "Removes and adds tags to the builds",
 		Use:   "tag [flags] [... buildID | [name][:tag]]",
-		RunE: cmdF.Cmd(func(c *ioc.Container) {
+		RunE: cmdF.StorageCmd(lock.Exclusive, func(c *ioc.Container) {
 			c.Singleton(storageF.Config)
 			c.Singleton(filterF.Config)
 			c.Singleton(tagF.Config)
 			c.Singleton(formatF.Config)
-		}, func(c *ioc.Container, formatter format.Formatter) error {
+		}, func(c *ioc.Container, formatter format.Formatter, formatConfig config.Format) error {
 			var builds []types.BuildInfo
 			var err error
 			c.Call(osman.Tag, &builds, &err)
@@ -38,7 +39,7 @@ func NewTagCommand(cmdF *CmdFactory) *cobra.Command {
 			sort.Slice(builds, func(i int, j int) bool {
 				return builds[i].CreatedAt.Before(builds[j].CreatedAt)
 			})
-			fmt.Println(formatter.Format(builds, defaultFields...))
+			fmt.Println(formatter.Format(builds, formatConfig.FieldsOrDefault(defaultFields...)...))
 			return nil
 		}),
 	}
@@ -47,6 +48,8 @@ func NewTagCommand(cmdF *CmdFactory) *cobra.Command {
 	formatF = cmdF.AddFormatFlags(cmd)
 	cmd.Flags().StringSliceVar(&tagF.Remove, "remove", []string{}, "Tag to be removed")
 	cmd.Flags().StringSliceVar(&tagF.Add, "add", []string{}, "Tag to be added")
+	cmd.Flags().StringSliceVar(&tagF.RemoveLabels, "remove-label", []string{}, "Key of label to be removed")
+	cmd.Flags().StringArrayVar(&tagF.AddLabels, "add-label", []string{}, "Label to be set in the form of key=value")
 	cmd.Flags().BoolVar(&tagF.All, "all", false,
 		"It is required to set this flag to tag builds if no filters are provided")
 	return cmd
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/pkg/errors"
 	"github.com/ridge/must"
 
 	"github.com/outofforest/osman/infra/types"
@@ -21,8 +22,17 @@ type BuildFactory struct {
 	// Rebuild forces rebuild of all parent images even if they exist.
 	Rebuild bool
 
+	// NoCache disables reusing existing images built from the same parent and instructions.
+	NoCache bool
+
 	// CacheDir is the directory where cached files are stored.
 	CacheDir string
+
+	// BuildArgs are the values of arguments declared in spec files, in the form of name=value.
+	BuildArgs []string
+
+	// KeepStages causes images built by intermediate stages of multi-stage builds to be kept.
+	KeepStages bool
 }
 
 // Config creates build config.
@@ -34,7 +44,11 @@ func (f BuildFactory) Config(args Args) Build {
 		Names:     f.Names,
 		Tags:      make(types.Tags, 0, len(f.Tags)),
 		Rebuild:   f.Rebuild,
+		NoCache:   f.NoCache,
 		CacheDir:  must.String(filepath.Abs(must.String(filepath.EvalSymlinks(f.CacheDir)))),
+		BuildArgs: map[string]string{},
+
+		KeepStages: f.KeepStages,
 	}
 
 	for i, specFile := range config.SpecFiles {
@@ -45,6 +59,13 @@ func (f BuildFactory) Config(args Args) Build {
 	for _, tag := range f.Tags {
 		config.Tags = append(config.Tags, types.Tag(tag))
 	}
+	for _, buildArg := range f.BuildArgs {
+		name, value, found := strings.Cut(buildArg, "=")
+		if !found || name == "" {
+			panic(errors.Errorf("build arg %s is invalid, name=value expected", buildArg))
+		}
+		config.BuildArgs[name] = value
+	}
 	return config
 }
 
@@ -62,6 +83,15 @@ type Build struct {
 	// Rebuild forces rebuild of all parent images even if they exist.
 	Rebuild bool
 
+	// NoCache disables reusing existing images built from the same parent and instructions.
+	NoCache bool
+
 	// CacheDir is the directory where cached files are stored.
 	CacheDir string
+
+	// BuildArgs are the values of arguments declared in spec files.
+	BuildArgs map[string]string
+
+	// KeepStages causes images built by intermediate stages of multi-stage builds to be kept.
+	KeepStages bool
 }
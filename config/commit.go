@@ -0,0 +1,81 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/types"
+)
+
+// CommitFactory collects data for commit config.
+type CommitFactory struct {
+	// Name is the name of the created image.
+	Name string
+
+	// Tags are the tags applied to the created image.
+	Tags []string
+
+	// Params override params inherited from the original image.
+	Params []string
+
+	// Boots override boot options inherited from the original image.
+	Boots []string
+
+	// Pause pauses running VM while its content is read.
+	Pause bool
+
+	// LibvirtAddr is the address libvirt listens on.
+	LibvirtAddr string
+}
+
+// Config returns new commit config.
+func (f *CommitFactory) Config() Commit {
+	if f.Name != "" && !types.IsNameValid(f.Name) {
+		panic(errors.Errorf("name %s is invalid", f.Name))
+	}
+
+	config := Commit{
+		Name:        f.Name,
+		Tags:        make(types.Tags, 0, len(f.Tags)),
+		Params:      f.Params,
+		Pause:       f.Pause,
+		LibvirtAddr: f.LibvirtAddr,
+	}
+	for _, tag := range f.Tags {
+		t := types.Tag(tag)
+		if !t.IsValid() {
+			panic(errors.Errorf("tag %s is invalid", t))
+		}
+		config.Tags = append(config.Tags, t)
+	}
+	for _, boot := range f.Boots {
+		fields := strings.Fields(boot)
+		if len(fields) == 0 {
+			panic(errors.New("empty boot option passed"))
+		}
+		config.Boots = append(config.Boots, types.Boot{Title: fields[0], Params: fields[1:]})
+	}
+	return config
+}
+
+// Commit stores configuration for commit command.
+type Commit struct {
+	// Name is the name of the created image. If empty, name of the original image is used.
+	Name string
+
+	// Tags are the tags applied to the created image.
+	Tags types.Tags
+
+	// Params override params inherited from the original image.
+	Params types.Params
+
+	// Boots override boot options inherited from the original image.
+	Boots []types.Boot
+
+	// Pause pauses running VM while its content is read.
+	Pause bool
+
+	// LibvirtAddr is the address libvirt listens on.
+	LibvirtAddr string
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"path"
+	"strings"
+)
+
+// DiffFactory collects data for diff config.
+type DiffFactory struct {
+	// Paths are the paths changes are reported for.
+	Paths []string
+}
+
+// Config returns new diff config.
+func (f *DiffFactory) Config(args Args) Diff {
+	config := Diff{
+		Builds: make([]Filter, 0, len(args)),
+		Paths:  make([]string, 0, len(f.Paths)),
+	}
+	for _, arg := range args {
+		filterF := &FilterFactory{Types: BuildTypes()}
+		config.Builds = append(config.Builds, filterF.Config(Args{arg}))
+	}
+	for _, p := range f.Paths {
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		config.Paths = append(config.Paths, path.Clean(p))
+	}
+	return config
+}
+
+// Diff stores configuration for diff command.
+type Diff struct {
+	// Builds select builds to compare, the first one is the base build. If only one is selected,
+	// it is compared with the build it is based on.
+	Builds []Filter
+
+	// Paths are the paths changes are reported for. Path matches if it is equal to the configured one,
+	// is located inside it, or matches it as a glob pattern. All the paths are reported if empty.
+	Paths []string
+}
@@ -0,0 +1,56 @@
+package config
+
+import "github.com/pkg/errors"
+
+const (
+	// ExportFormatOsman is the format of archive containing builds which might be imported by osman.
+	ExportFormatOsman = "osman"
+
+	// ExportFormatOCI is the format of OCI image layout.
+	ExportFormatOCI = "oci"
+)
+
+// ExportFactory collects data for export config.
+type ExportFactory struct {
+	// File is the path of archive to create.
+	File string
+
+	// Format is the format of created archive.
+	Format string
+
+	// WithParents includes all the parents of exported images in the archive.
+	WithParents bool
+
+	// Tar forces builds to be stored as tar archives of their filesystems even if storage driver supports
+	// native streams.
+	Tar bool
+}
+
+// Config returns new export config.
+func (f *ExportFactory) Config() Export {
+	if f.Format != ExportFormatOsman && f.Format != ExportFormatOCI {
+		panic(errors.Errorf("invalid archive format '%s'", f.Format))
+	}
+	return Export{
+		File:        f.File,
+		Format:      f.Format,
+		WithParents: f.WithParents,
+		Tar:         f.Tar,
+	}
+}
+
+// Export stores configuration related to export operation.
+type Export struct {
+	// File is the path of archive to create.
+	File string
+
+	// Format is the format of created archive.
+	Format string
+
+	// WithParents includes all the parents of exported images in the archive.
+	WithParents bool
+
+	// Tar forces builds to be stored as tar archives of their filesystems even if storage driver supports
+	// native streams.
+	Tar bool
+}
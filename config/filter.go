@@ -2,6 +2,7 @@ package config
 
 import (
 	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 
@@ -46,6 +47,9 @@ type FilterFactory struct {
 
 	// Types is the list of build types to return.
 	Types []string
+
+	// Labels is the list of labels, in the form of key=value, builds must have.
+	Labels []string
 }
 
 // Config returns new filter config.
@@ -55,6 +59,7 @@ func (f *FilterFactory) Config(args Args) Filter {
 		Types:     make([]types.BuildType, 0, len(f.Types)),
 		BuildIDs:  make([]types.BuildID, 0, len(args)),
 		BuildKeys: make([]types.BuildKey, 0, len(args)),
+		Labels:    ParseLabels(f.Labels),
 	}
 	for _, t := range f.Types {
 		buildType, exists := typeMapping[t]
@@ -93,4 +98,23 @@ type Filter struct {
 
 	// BuildKeys is the list of build keys to return
 	BuildKeys []types.BuildKey
+
+	// Labels are the labels builds must have to be returned
+	Labels types.Labels
+}
+
+// ParseLabels parses labels in the form of key=value.
+func ParseLabels(labels []string) types.Labels {
+	if len(labels) == 0 {
+		return nil
+	}
+	res := make(types.Labels, len(labels))
+	for _, label := range labels {
+		key, value, found := strings.Cut(label, "=")
+		if !found || !types.IsLabelKeyValid(key) {
+			panic(errors.Errorf("label '%s' is invalid, key=value expected", label))
+		}
+		res[key] = value
+	}
+	return res
 }
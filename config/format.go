@@ -1,15 +1,30 @@
 package config
 
+import "github.com/pkg/errors"
+
+// FormatterDot is the name of formatter describing graph of builds in DOT language.
+const FormatterDot = "dot"
+
 // FormatFactory collects data for format config.
 type FormatFactory struct {
 	// Formatter is the name of formatter to use to convert list into string.
 	Formatter string
+
+	// Fields is the list of fields to print.
+	Fields []string
+
+	// Graph is set if command prints the list of builds which might be formatted as a graph.
+	Graph bool
 }
 
 // Config returns new format config.
 func (f *FormatFactory) Config() Format {
+	if f.Formatter == FormatterDot && !f.Graph {
+		panic(errors.Errorf("format '%s' is not supported by the command", f.Formatter))
+	}
 	return Format{
 		Formatter: f.Formatter,
+		Fields:    f.Fields,
 	}
 }
 
@@ -17,4 +32,15 @@ func (f *FormatFactory) Config() Format {
 type Format struct {
 	// Formatter is the name of formatter to use to convert list into string.
 	Formatter string
+
+	// Fields is the list of fields to print, if empty the default ones are used.
+	Fields []string
+}
+
+// FieldsOrDefault returns configured fields or default ones if none are configured.
+func (f Format) FieldsOrDefault(defaultFields ...string) []string {
+	if len(f.Fields) == 0 {
+		return defaultFields
+	}
+	return f.Fields
 }
@@ -0,0 +1,36 @@
+package config
+
+import "time"
+
+// GCFactory collects data for gc config.
+type GCFactory struct {
+	// KeepLast is the number of the most recent builds kept for each image name.
+	KeepLast int
+
+	// KeepNewer protects builds created within this period.
+	KeepNewer time.Duration
+
+	// DryRun causes builds to be printed instead of being dropped.
+	DryRun bool
+}
+
+// Config returns new gc config.
+func (f *GCFactory) Config() GC {
+	return GC{
+		KeepLast:  f.KeepLast,
+		KeepNewer: f.KeepNewer,
+		DryRun:    f.DryRun,
+	}
+}
+
+// GC stores configuration related to garbage collection.
+type GC struct {
+	// KeepLast is the number of the most recent builds kept for each image name.
+	KeepLast int
+
+	// KeepNewer protects builds created within this period.
+	KeepNewer time.Duration
+
+	// DryRun causes builds to be printed instead of being dropped.
+	DryRun bool
+}
@@ -0,0 +1,17 @@
+package config
+
+// ImportFactory collects data for import config.
+type ImportFactory struct{}
+
+// Config returns new import config.
+func (f *ImportFactory) Config(args Args) Import {
+	return Import{
+		File: args[0],
+	}
+}
+
+// Import stores configuration related to import operation.
+type Import struct {
+	// File is the path of archive to import.
+	File string
+}
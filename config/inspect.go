@@ -0,0 +1,27 @@
+package config
+
+// InspectFactory collects data for inspect config.
+type InspectFactory struct {
+	// LibvirtAddr is the address libvirt listens on.
+	LibvirtAddr string
+
+	// Provenance requests printing provenance of the build as in-toto statement.
+	Provenance bool
+}
+
+// Config returns new inspect config.
+func (f *InspectFactory) Config() Inspect {
+	return Inspect{
+		LibvirtAddr: f.LibvirtAddr,
+		Provenance:  f.Provenance,
+	}
+}
+
+// Inspect stores configuration for inspect command.
+type Inspect struct {
+	// LibvirtAddr is the address libvirt listens on.
+	LibvirtAddr string
+
+	// Provenance requests printing provenance of the build as in-toto statement.
+	Provenance bool
+}
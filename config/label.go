@@ -0,0 +1,47 @@
+package config
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/types"
+)
+
+// LabelFactory collects data for label config.
+type LabelFactory struct {
+	// If no filter is provided it is required to set this flag to label builds.
+	All bool
+
+	// Remove is the list of keys of labels to remove.
+	Remove []string
+
+	// Set is the list of labels, in the form of key=value, to set.
+	Set []string
+}
+
+// Config returns new label config.
+func (f *LabelFactory) Config() Label {
+	config := Label{
+		All:    f.All,
+		Remove: make([]string, 0, len(f.Remove)),
+		Set:    ParseLabels(f.Set),
+	}
+	for _, key := range f.Remove {
+		if !types.IsLabelKeyValid(key) {
+			panic(errors.Errorf("invalid key of label '%s'", key))
+		}
+		config.Remove = append(config.Remove, key)
+	}
+	return config
+}
+
+// Label stores configuration related to label operation.
+type Label struct {
+	// If no filter is provided it is required to set this flag to label builds
+	All bool
+
+	// Remove is the list of keys of labels to remove
+	Remove []string
+
+	// Set are the labels to set
+	Set types.Labels
+}
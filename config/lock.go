@@ -0,0 +1,29 @@
+package config
+
+import "time"
+
+// LockFactory collects data for lock config.
+type LockFactory struct {
+	// Dir is the directory where lock files are stored.
+	Dir string
+
+	// Timeout is the maximum time spent on waiting for lock.
+	Timeout time.Duration
+}
+
+// Config returns new lock config.
+func (f *LockFactory) Config() Lock {
+	return Lock{
+		Dir:     f.Dir,
+		Timeout: f.Timeout,
+	}
+}
+
+// Lock stores configuration of locks protecting state shared by osman processes.
+type Lock struct {
+	// Dir is the directory where lock files are stored.
+	Dir string
+
+	// Timeout is the maximum time spent on waiting for lock. Zero means waiting forever.
+	Timeout time.Duration
+}
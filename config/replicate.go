@@ -0,0 +1,33 @@
+package config
+
+// ReplicateFactory collects data for replicate config.
+type ReplicateFactory struct {
+	// If no filter is provided it is required to set this flag to replicate builds.
+	All bool
+
+	// TargetRoot is the storage root builds are replicated to.
+	TargetRoot string
+
+	// TargetDriver is the storage driver used by target storage.
+	TargetDriver string
+}
+
+// Config returns new replicate config.
+func (f *ReplicateFactory) Config() Replicate {
+	return Replicate{
+		All: f.All,
+		Target: Storage{
+			Root:   f.TargetRoot,
+			Driver: f.TargetDriver,
+		},
+	}
+}
+
+// Replicate stores configuration related to replicate operation.
+type Replicate struct {
+	// If no filter is provided it is required to set this flag to replicate builds.
+	All bool
+
+	// Target is the storage builds are replicated to.
+	Target Storage
+}
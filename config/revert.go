@@ -0,0 +1,27 @@
+package config
+
+// RevertFactory collects data for revert config.
+type RevertFactory struct {
+	// If no filter is provided it is required to set this flag to revert builds.
+	All bool
+
+	// LibvirtAddr is the address libvirt listens on.
+	LibvirtAddr string
+}
+
+// Config returns new revert config.
+func (f *RevertFactory) Config() Revert {
+	return Revert{
+		All:         f.All,
+		LibvirtAddr: f.LibvirtAddr,
+	}
+}
+
+// Revert stores configuration for revert command.
+type Revert struct {
+	// If no filter is provided it is required to set this flag to revert builds.
+	All bool
+
+	// LibvirtAddr is the address libvirt listens on.
+	LibvirtAddr string
+}
@@ -1,5 +1,9 @@
 package config
 
+import (
+	"github.com/pkg/errors"
+)
+
 // StorageFactory collects data for storage config.
 type StorageFactory struct {
 	// Root is the root location for images.
@@ -7,13 +11,29 @@ type StorageFactory struct {
 
 	// Driver specifies storage driver to use.
 	Driver string
+
+	// Encrypt means that created builds are encrypted.
+	Encrypt bool
+
+	// KeyFile is the file containing encryption key.
+	KeyFile string
+
+	// KeyProvider is the command printing encryption key to its standard output.
+	KeyProvider string
+
+	// KeyFormat is the format of encryption key.
+	KeyFormat string
 }
 
 // Config returns new storage config.
 func (f *StorageFactory) Config() Storage {
 	return Storage{
-		Root:   f.Root,
-		Driver: f.Driver,
+		Root:        f.Root,
+		Driver:      f.Driver,
+		Encrypt:     f.Encrypt,
+		KeyFile:     f.KeyFile,
+		KeyProvider: f.KeyProvider,
+		KeyFormat:   f.KeyFormat,
 	}
 }
 
@@ -24,4 +44,30 @@ type Storage struct {
 
 	// Driver specifies storage driver to use.
 	Driver string
+
+	// Encrypt means that created builds are encrypted. Builds created from encrypted ones are always encrypted,
+	// no matter if this flag is set.
+	Encrypt bool
+
+	// KeyFile is the file containing encryption key.
+	KeyFile string
+
+	// KeyProvider is the command printing encryption key to its standard output.
+	KeyProvider string
+
+	// KeyFormat is the format of encryption key: raw, hex or passphrase.
+	KeyFormat string
+}
+
+// Validate returns error if storage can't be used with the config.
+func (s Storage) Validate() error {
+	if s.Encrypt && s.Driver != "zfs" {
+		return errors.Errorf("encryption is not supported by %s storage driver", s.Driver)
+	}
+	return nil
+}
+
+// SameAs returns true if both configs point to the same storage.
+func (s Storage) SameAs(other Storage) bool {
+	return s.Root == other.Root && s.Driver == other.Driver
 }
@@ -16,6 +16,12 @@ type TagFactory struct {
 
 	// Add is the list of tags to add.
 	Add []string
+
+	// RemoveLabels is the list of keys of labels to remove.
+	RemoveLabels []string
+
+	// AddLabels is the list of labels, in the form of key=value, to set.
+	AddLabels []string
 }
 
 // Config returns new tag config.
@@ -24,6 +30,7 @@ func (f *TagFactory) Config() Tag {
 		All:    f.All,
 		Remove: make([]types.Tag, 0, len(f.Remove)),
 		Add:    make([]types.Tag, 0, len(f.Add)),
+		Labels: (&LabelFactory{Remove: f.RemoveLabels, Set: f.AddLabels}).Config(),
 	}
 	for _, t := range f.Remove {
 		tag := types.Tag((t))
@@ -52,4 +59,7 @@ type Tag struct {
 
 	// Add is the list of tags to add
 	Add []types.Tag
+
+	// Labels are the changes of labels
+	Labels Label
 }
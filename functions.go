@@ -2,8 +2,14 @@ package osman
 
 import (
 	"context"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/ridge/must"
@@ -12,7 +18,9 @@ import (
 	"github.com/outofforest/logger"
 	"github.com/outofforest/osman/config"
 	"github.com/outofforest/osman/infra"
+	"github.com/outofforest/osman/infra/archive"
 	"github.com/outofforest/osman/infra/description"
+	"github.com/outofforest/osman/infra/lock"
 	"github.com/outofforest/osman/infra/storage"
 	"github.com/outofforest/osman/infra/types"
 )
@@ -93,7 +101,8 @@ func Start(
 	filtering config.Filter,
 	start config.Start,
 	s storage.Driver,
-) ([]types.BuildInfo, error) {
+	locks *lock.Manager,
+) (retVMs []types.BuildInfo, retErr error) {
 	for i, key := range filtering.BuildKeys {
 		if key.Tag == "" {
 			filtering.BuildKeys[i] = types.NewBuildKey(key.Name, description.DefaultTag)
@@ -138,6 +147,17 @@ func Start(
 		_ = l.Disconnect()
 	}()
 
+	// IP and MAC addresses are allocated from the network shared by all osman processes.
+	unlock, err := locks.Network(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := unlock(); retErr == nil {
+			retErr = err
+		}
+	}()
+
 	vmsToDeploy, err = preprocessDomainDocs(l, vmsToDeploy, start.VolumeDir)
 	if err != nil {
 		return nil, err
@@ -175,7 +195,7 @@ func Start(
 
 // Stop stops VMs.
 func Stop(ctx context.Context, filtering config.Filter, stop config.Stop, s storage.Driver) ([]Result, error) {
-	if !stop.All && len(filtering.BuildIDs) == 0 && len(filtering.BuildKeys) == 0 {
+	if !stop.All && len(filtering.BuildIDs) == 0 && len(filtering.BuildKeys) == 0 && len(filtering.Labels) == 0 {
 		return nil, errors.New("neither filters are provided nor --all is set")
 	}
 
@@ -228,7 +248,7 @@ func List(ctx context.Context, filtering config.Filter, s storage.Driver) ([]typ
 			return nil, err
 		}
 
-		if !listBuild(info, buildTypes, buildIDs, buildKeys, filtering.Untagged) {
+		if !listBuild(info, buildTypes, buildIDs, buildKeys, filtering.Labels, filtering.Untagged) {
 			continue
 		}
 		list = append(list, info)
@@ -236,6 +256,54 @@ func List(ctx context.Context, filtering config.Filter, s storage.Driver) ([]typ
 	return list, nil
 }
 
+// SpaceSummary contains space used by a group of builds.
+type SpaceSummary struct {
+	// GroupBy is the attribute builds are grouped by: name or type.
+	GroupBy string
+
+	// Group is the value of the attribute shared by the builds.
+	Group string
+
+	Builds     int
+	Used       types.Size
+	Referenced types.Size
+	Written    types.Size
+}
+
+// Summarize totals space used by builds per image name and per build type.
+func Summarize(builds []types.BuildInfo) []SpaceSummary {
+	byName := map[string]*SpaceSummary{}
+	byType := map[string]*SpaceSummary{}
+	for _, build := range builds {
+		for _, group := range []struct {
+			Summaries map[string]*SpaceSummary
+			GroupBy   string
+			Group     string
+		}{
+			{Summaries: byName, GroupBy: "name", Group: build.Name},
+			{Summaries: byType, GroupBy: "type", Group: string(build.BuildID.Type())},
+		} {
+			summary := group.Summaries[group.Group]
+			if summary == nil {
+				summary = &SpaceSummary{GroupBy: group.GroupBy, Group: group.Group}
+				group.Summaries[group.Group] = summary
+			}
+			summary.Builds++
+			summary.Used += build.Used
+			summary.Referenced += build.Referenced
+			summary.Written += build.Written
+		}
+	}
+
+	res := make([]SpaceSummary, 0, len(byName)+len(byType))
+	for _, summaries := range []map[string]*SpaceSummary{byName, byType} {
+		for _, group := range slices.Sorted(maps.Keys(summaries)) {
+			res = append(res, *summaries[group])
+		}
+	}
+	return res
+}
+
 // Result contains error realted to build ID.
 type Result struct {
 	BuildID types.BuildID
@@ -249,8 +317,9 @@ func Drop(
 	filtering config.Filter,
 	drop config.Drop,
 	s storage.Driver,
-) ([]Result, error) {
-	if !drop.All && len(filtering.BuildIDs) == 0 && len(filtering.BuildKeys) == 0 {
+	locks *lock.Manager,
+) (retResults []Result, retErr error) {
+	if !drop.All && len(filtering.BuildIDs) == 0 && len(filtering.BuildKeys) == 0 && len(filtering.Labels) == 0 {
 		return nil, errors.New("neither filters are provided nor --all is set")
 	}
 
@@ -276,7 +345,7 @@ func Drop(
 				break
 			}
 			var err error
-			build, err = s.Info(ctx, build.BuildID)
+			build, err = s.Info(ctx, build.BasedOn)
 			if err != nil {
 				return nil, err
 			}
@@ -315,6 +384,16 @@ func Drop(
 		}
 		defer l.Disconnect() //nolint:errcheck // I don't care about the error here
 
+		unlock, err := locks.Network(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := unlock(); retErr == nil {
+				retErr = err
+			}
+		}()
+
 		deletedVMs, err = undeployVMs(ctx, l, vmsToDelete)
 		if err != nil {
 			return nil, err
@@ -349,9 +428,598 @@ func Drop(
 	return results, nil
 }
 
+// GC drops untagged images which are not needed by other builds and not protected by retention rules.
+// In dry-run mode builds are only returned.
+func GC(
+	ctx context.Context,
+	storage config.Storage,
+	filtering config.Filter,
+	gc config.GC,
+	s storage.Driver,
+	locks *lock.Manager,
+) ([]types.BuildInfo, []Result, error) {
+	candidates, err := List(ctx, filtering, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	all, err := List(ctx, config.Filter{Types: []types.BuildType{
+		types.BuildTypeImage,
+		types.BuildTypeMount,
+		types.BuildTypeBoot,
+		types.BuildTypeVM,
+	}}, s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	children := map[types.BuildID][]types.BuildID{}
+	images := map[string][]types.BuildInfo{}
+	for _, build := range all {
+		if build.BasedOn != "" {
+			children[build.BasedOn] = append(children[build.BasedOn], build.BuildID)
+		}
+		if build.BuildID.Type() == types.BuildTypeImage {
+			images[build.Name] = append(images[build.Name], build)
+		}
+	}
+
+	retained := map[types.BuildID]bool{}
+	for _, builds := range images {
+		slices.SortFunc(builds, func(a, b types.BuildInfo) int {
+			return b.CreatedAt.Compare(a.CreatedAt)
+		})
+		for i := 0; i < gc.KeepLast && i < len(builds); i++ {
+			retained[builds[i].BuildID] = true
+		}
+	}
+	if gc.KeepNewer > 0 {
+		threshold := time.Now().Add(-gc.KeepNewer)
+		for _, build := range all {
+			if build.CreatedAt.After(threshold) {
+				retained[build.BuildID] = true
+			}
+		}
+	}
+
+	collectable := map[types.BuildID]bool{}
+	for _, build := range candidates {
+		if build.BuildID.Type() == types.BuildTypeImage && len(build.Tags) == 0 && !retained[build.BuildID] {
+			collectable[build.BuildID] = true
+		}
+	}
+
+	// Build may be dropped only if all its descendants are dropped too.
+	visited := map[types.BuildID]bool{}
+	var check func(buildID types.BuildID) bool
+	check = func(buildID types.BuildID) bool {
+		if visited[buildID] {
+			return collectable[buildID]
+		}
+		visited[buildID] = true
+		for _, child := range children[buildID] {
+			if !check(child) {
+				collectable[buildID] = false
+			}
+		}
+		return collectable[buildID]
+	}
+
+	plan := []types.BuildInfo{}
+	for _, build := range candidates {
+		if check(build.BuildID) {
+			plan = append(plan, build)
+		}
+	}
+
+	if gc.DryRun || len(plan) == 0 {
+		return plan, nil, nil
+	}
+
+	filtering = config.Filter{
+		Types:    []types.BuildType{types.BuildTypeImage},
+		BuildIDs: make([]types.BuildID, 0, len(plan)),
+	}
+	for _, build := range plan {
+		filtering.BuildIDs = append(filtering.BuildIDs, build.BuildID)
+	}
+	results, err := Drop(ctx, storage, filtering, config.Drop{}, s, locks)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plan, results, nil
+}
+
+// Export writes images and their build info to archive.
+func Export(
+	ctx context.Context,
+	filtering config.Filter,
+	export config.Export,
+	s storage.Driver,
+) ([]types.BuildInfo, error) {
+	if len(filtering.BuildIDs) == 0 && len(filtering.BuildKeys) == 0 && len(filtering.Labels) == 0 {
+		return nil, errors.New("no filters are provided")
+	}
+
+	builds, err := List(ctx, filtering, s)
+	if err != nil {
+		return nil, err
+	}
+	if len(builds) == 0 {
+		return nil, errors.New("no builds were selected to export")
+	}
+	if export.Format == config.ExportFormatOCI {
+		if len(builds) != 1 {
+			return nil, errors.New("exactly one build must be selected to export it as OCI image")
+		}
+		if err := exportOCI(ctx, builds[0], export.File, s); err != nil {
+			return nil, err
+		}
+		return builds, nil
+	}
+	if export.WithParents {
+		builds, err = withParents(ctx, builds, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	builds = sortByParents(builds)
+
+	streamFormat := streamFormatTar
+	if !export.Tar {
+		streamFormat = nativeStreamFormat(s)
+	}
+
+	manifest := archiveManifest{Builds: make([]archivedBuild, 0, len(builds))}
+	for _, build := range builds {
+		manifest.Builds = append(manifest.Builds, archivedBuild{
+			Info: types.BuildInfo{
+				BuildID:   build.BuildID,
+				BasedOn:   build.BasedOn,
+				CreatedAt: build.CreatedAt,
+				Name:      build.Name,
+				Tags:      build.Tags,
+				Params:    build.Params,
+				Boots:     build.Boots,
+				Env:       build.Env,
+				WorkDir:   build.WorkDir,
+				User:      build.User,
+				Args:      build.Args,
+				Labels:    build.Labels,
+
+				CacheKey:   build.CacheKey,
+				Provenance: build.Provenance,
+			},
+			Format: streamFormat,
+		})
+	}
+
+	f, err := os.OpenFile(export.File, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	aw := archive.NewWriter(f)
+	if err := aw.WriteJSON(archiveManifestFile, manifest); err != nil {
+		return nil, err
+	}
+	for _, build := range builds {
+		stream := aw.Stream(string(build.BuildID))
+		if err := sendBuild(ctx, build, streamFormat, stream, s); err != nil {
+			return nil, err
+		}
+		if err := stream.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return builds, nil
+}
+
+// Import creates images stored in archive. Images existing in storage are only tagged.
+func Import(ctx context.Context, imp config.Import, s storage.Driver) ([]types.BuildInfo, error) {
+	f, err := os.Open(imp.File)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	ar := archive.NewReader(f)
+	var manifest archiveManifest
+	if err := ar.ReadJSON(archiveManifestFile, &manifest); err != nil {
+		return nil, err
+	}
+
+	included := map[types.BuildID]bool{}
+	existing := map[types.BuildID]bool{}
+	for _, build := range manifest.Builds {
+		info := build.Info
+		if info.BuildID.Type() != types.BuildTypeImage || !types.IsNameValid(info.Name) {
+			return nil, errors.Errorf("archive contains invalid build %s", info.BuildID)
+		}
+		if build.Format != streamFormatTar && nativeStreamFormat(s) != build.Format {
+			return nil, errors.Errorf("build %s is stored in %s stream which is not supported by the storage driver",
+				info.BuildID, build.Format)
+		}
+
+		exists, err := buildExists(ctx, info.BuildID, s)
+		if err != nil {
+			return nil, err
+		}
+		existing[info.BuildID] = exists
+		included[info.BuildID] = true
+
+		if info.BasedOn == "" || included[info.BasedOn] {
+			continue
+		}
+		parentExists, err := buildExists(ctx, info.BasedOn, s)
+		if err != nil {
+			return nil, err
+		}
+		if !parentExists {
+			return nil, errors.Errorf("parent %s of build %s is neither included in the archive nor exists",
+				info.BasedOn, info.BuildID)
+		}
+	}
+
+	builds := make([]types.BuildInfo, 0, len(manifest.Builds))
+	for _, build := range manifest.Builds {
+		info := build.Info
+		stream := ar.Stream(string(info.BuildID))
+		if existing[info.BuildID] {
+			// Build has been imported before.
+			if _, err := io.Copy(io.Discard, stream); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			for _, tag := range info.Tags {
+				if err := s.Tag(ctx, info.BuildID, tag); err != nil {
+					return nil, err
+				}
+			}
+			info, err := s.Info(ctx, info.BuildID)
+			if err != nil {
+				return nil, err
+			}
+			builds = append(builds, info)
+			continue
+		}
+
+		info, err := receiveBuild(ctx, info, build.Format, stream, s)
+		if err != nil {
+			return nil, err
+		}
+		builds = append(builds, info)
+	}
+	return builds, nil
+}
+
+// Replicate copies images and all their parents to target storage. Build IDs and manifests are preserved.
+// Images existing in target storage are not copied again, so only the changes are transferred.
+func Replicate(
+	ctx context.Context,
+	storage config.Storage,
+	filtering config.Filter,
+	replicate config.Replicate,
+	s storage.Driver,
+	target storage.Driver,
+) ([]types.BuildInfo, error) {
+	if !replicate.All && len(filtering.BuildIDs) == 0 && len(filtering.BuildKeys) == 0 && len(filtering.Labels) == 0 {
+		return nil, errors.New("neither filters are provided nor --all is set")
+	}
+	if storage.SameAs(replicate.Target) {
+		return nil, errors.New("source and target storage are the same")
+	}
+
+	builds, err := List(ctx, filtering, s)
+	if err != nil {
+		return nil, err
+	}
+	if len(builds) == 0 {
+		return nil, errors.New("no builds were selected to replicate")
+	}
+	builds, err = withParents(ctx, builds, s)
+	if err != nil {
+		return nil, err
+	}
+	builds = sortByParents(builds)
+
+	streamFormat := nativeStreamFormat(s)
+	if streamFormat != nativeStreamFormat(target) {
+		streamFormat = streamFormatTar
+	}
+
+	replicated := make([]types.BuildInfo, 0, len(builds))
+	for _, build := range builds {
+		info, err := target.Info(ctx, build.BuildID)
+		switch {
+		case err == nil:
+			for _, tag := range build.Tags {
+				if err := target.Tag(ctx, build.BuildID, tag); err != nil {
+					return nil, err
+				}
+			}
+			info, err = target.Info(ctx, build.BuildID)
+		case errors.Is(err, types.ErrImageDoesNotExist):
+			info, err = replicateBuild(ctx, build, streamFormat, s, target)
+		}
+		if err != nil {
+			return nil, err
+		}
+		replicated = append(replicated, info)
+	}
+	return replicated, nil
+}
+
+// Revert reverts builds to the state they had when they were created.
+func Revert(
+	ctx context.Context,
+	storage config.Storage,
+	filtering config.Filter,
+	revert config.Revert,
+	s storage.Driver,
+) ([]types.BuildInfo, error) {
+	if !revert.All && len(filtering.BuildIDs) == 0 && len(filtering.BuildKeys) == 0 && len(filtering.Labels) == 0 {
+		return nil, errors.New("neither filters are provided nor --all is set")
+	}
+
+	builds, err := List(ctx, filtering, s)
+	if err != nil {
+		return nil, err
+	}
+	if len(builds) == 0 {
+		return nil, errors.New("no builds were selected to revert")
+	}
+
+	var vms bool
+	for _, build := range builds {
+		properties := build.BuildID.Type().Properties()
+		if !properties.Revertable {
+			return nil, errors.Errorf("build %s is not revertable", build.BuildID)
+		}
+		vms = vms || properties.VM
+	}
+
+	if vms {
+		l, err := libvirtConn(revert.LibvirtAddr)
+		if err != nil {
+			return nil, err
+		}
+		defer l.Disconnect() //nolint:errcheck // I don't care about the error here
+
+		running, err := runningVMs(l)
+		if err != nil {
+			return nil, err
+		}
+		if err := ensureNotRunning(builds, running); err != nil {
+			return nil, err
+		}
+	}
+
+	var genGRUB bool
+	for _, build := range builds {
+		if err := s.Revert(ctx, build.BuildID); err != nil {
+			return nil, err
+		}
+		if build.BuildID.Type() == types.BuildTypeBoot {
+			genGRUB = true
+			if err := revertKernel(ctx, storage, build, s); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if genGRUB {
+		if err := generateGRUB(ctx, storage, s); err != nil {
+			return nil, err
+		}
+	}
+
+	filtering = config.Filter{BuildIDs: make([]types.BuildID, 0, len(builds)), Types: filtering.Types}
+	for _, b := range builds {
+		filtering.BuildIDs = append(filtering.BuildIDs, b.BuildID)
+	}
+	return List(ctx, filtering, s)
+}
+
+// Commit creates new image from the current content of mount or VM build.
+// New image is based on the image the mount or VM was created from.
+func Commit(
+	ctx context.Context,
+	filtering config.Filter,
+	commit config.Commit,
+	s storage.Driver,
+) (retInfo []types.BuildInfo, retErr error) {
+	builds, err := List(ctx, filtering, s)
+	if err != nil {
+		return nil, err
+	}
+	if len(builds) != 1 {
+		return nil, errors.Errorf("exactly one build must be selected to commit, %d selected", len(builds))
+	}
+	build := builds[0]
+	if buildType := build.BuildID.Type(); buildType != types.BuildTypeMount && buildType != types.BuildTypeVM {
+		return nil, errors.Errorf("build %s is neither mount nor VM", build.BuildID)
+	}
+	if build.Mounted == "" {
+		return nil, errors.Errorf("build %s is not mounted", build.BuildID)
+	}
+
+	image, err := s.Info(ctx, build.BasedOn)
+	if err != nil {
+		return nil, err
+	}
+
+	pauseFn := func() (func() error, error) {
+		return func() error { return nil }, nil
+	}
+	if build.BuildID.Type().Properties().VM {
+		l, err := libvirtConn(commit.LibvirtAddr)
+		if err != nil {
+			return nil, err
+		}
+		defer l.Disconnect() //nolint:errcheck // I don't care about the error here
+
+		running, err := runningVMs(l)
+		if err != nil {
+			return nil, err
+		}
+		if domain, exists := running[build.BuildID]; exists {
+			if !commit.Pause {
+				return nil, errors.Errorf("build %s is used by running VM, stop it or pause it during commit",
+					build.BuildID)
+			}
+			pauseFn = func() (func() error, error) {
+				if err := l.DomainSuspend(domain); err != nil {
+					return nil, errors.WithStack(err)
+				}
+				return func() error {
+					return errors.WithStack(l.DomainResume(domain))
+				}, nil
+			}
+		}
+	}
+
+	name := commit.Name
+	if name == "" {
+		name = image.Name
+	}
+	buildID := types.NewBuildID(types.BuildTypeImage)
+	defer func() {
+		if retErr != nil {
+			_ = s.Drop(ctx, buildID)
+		}
+	}()
+
+	// VM is paused only while its content is captured by the storage driver.
+	if err := s.Commit(ctx, build.BuildID, name, buildID, pauseFn); err != nil {
+		return nil, err
+	}
+
+	manifest := types.ImageManifest{
+		BuildID: buildID,
+		BasedOn: image.BuildID,
+		Params:  image.Params,
+		Boots:   image.Boots,
+		Env:     image.Env,
+		WorkDir: image.WorkDir,
+		User:    image.User,
+		Labels:  image.Labels,
+	}
+	if commit.Params != nil {
+		manifest.Params = commit.Params
+	}
+	if commit.Boots != nil {
+		manifest.Boots = commit.Boots
+	}
+	if err := s.StoreManifest(ctx, manifest); err != nil {
+		return nil, err
+	}
+
+	tags := commit.Tags
+	if len(tags) == 0 {
+		tags = types.Tags{description.DefaultTag}
+	}
+	for _, tag := range tags {
+		if err := s.Tag(ctx, buildID, tag); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := s.Info(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	return []types.BuildInfo{info}, nil
+}
+
+// Diff returns paths changed between builds.
+func Diff(ctx context.Context, diff config.Diff, s storage.Driver) ([]types.Change, error) {
+	if len(diff.Builds) == 0 || len(diff.Builds) > 2 {
+		return nil, errors.Errorf("one or two builds must be selected to compare, %d selected", len(diff.Builds))
+	}
+	builds := make([]types.BuildInfo, 0, 2)
+	for _, filtering := range diff.Builds {
+		selected, err := List(ctx, filtering, s)
+		if err != nil {
+			return nil, err
+		}
+		if len(selected) != 1 {
+			return nil, errors.Errorf("exactly one build must be selected by each argument, %d selected",
+				len(selected))
+		}
+		builds = append(builds, selected[0])
+	}
+	if len(builds) == 1 {
+		if builds[0].BasedOn == "" {
+			return nil, errors.Errorf("build %s is not based on another build", builds[0].BuildID)
+		}
+		base, err := s.Info(ctx, builds[0].BasedOn)
+		if err != nil {
+			return nil, err
+		}
+		builds = []types.BuildInfo{base, builds[0]}
+	}
+
+	changes, err := diffBuilds(ctx, builds[1], builds[0], s)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]types.Change, 0, len(changes))
+	for _, change := range changes {
+		if matchPath(change.Path, diff.Paths) {
+			filtered = append(filtered, change)
+		}
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		if filtered[i].Path == filtered[j].Path {
+			return filtered[i].Kind == types.ChangeDeleted && filtered[j].Kind != types.ChangeDeleted
+		}
+		return filtered[i].Path < filtered[j].Path
+	})
+	return filtered, nil
+}
+
+// Migrate stores build info of all the builds using the current version of the schema.
+// Builds which were upgraded are returned.
+func Migrate(ctx context.Context, s storage.Driver) ([]types.BuildInfo, error) {
+	migrator, ok := s.(storage.Migrator)
+	if !ok {
+		// Driver doesn't store build info persistently, so there is nothing to migrate.
+		return nil, nil
+	}
+
+	buildIDs, err := s.Builds(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	migrated := []types.BuildInfo{}
+	for _, buildID := range buildIDs {
+		upgraded, err := migrator.Migrate(ctx, buildID)
+		if err != nil {
+			return nil, err
+		}
+		if !upgraded {
+			continue
+		}
+		info, err := s.Info(ctx, buildID)
+		if err != nil {
+			return nil, err
+		}
+		migrated = append(migrated, info)
+	}
+	return migrated, nil
+}
+
 // Tag removes and add tags to the build.
 func Tag(ctx context.Context, filtering config.Filter, tag config.Tag, s storage.Driver) ([]types.BuildInfo, error) {
-	if !tag.All && len(filtering.BuildIDs) == 0 && len(filtering.BuildKeys) == 0 {
+	if !tag.All && len(filtering.BuildIDs) == 0 && len(filtering.BuildKeys) == 0 && len(filtering.Labels) == 0 {
 		return nil, errors.New("neither filters are provided nor All is set")
 	}
 
@@ -378,6 +1046,40 @@ func Tag(ctx context.Context, filtering config.Filter, tag config.Tag, s storage
 			}
 		}
 	}
+	if err := setLabels(ctx, builds, tag.Labels, s); err != nil {
+		return nil, err
+	}
+
+	filtering = config.Filter{BuildIDs: make([]types.BuildID, 0, len(builds)), Types: filtering.Types}
+	for _, b := range builds {
+		filtering.BuildIDs = append(filtering.BuildIDs, b.BuildID)
+	}
+	return List(ctx, filtering, s)
+}
+
+// Label removes and sets labels of the builds.
+func Label(
+	ctx context.Context,
+	filtering config.Filter,
+	label config.Label,
+	s storage.Driver,
+) ([]types.BuildInfo, error) {
+	if !label.All && len(filtering.BuildIDs) == 0 && len(filtering.BuildKeys) == 0 && len(filtering.Labels) == 0 {
+		return nil, errors.New("neither filters are provided nor All is set")
+	}
+
+	builds, err := List(ctx, filtering, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(builds) == 0 {
+		return nil, errors.New("no builds were selected to label")
+	}
+
+	if err := setLabels(ctx, builds, label, s); err != nil {
+		return nil, err
+	}
 
 	filtering = config.Filter{BuildIDs: make([]types.BuildID, 0, len(builds)), Types: filtering.Types}
 	for _, b := range builds {
@@ -386,11 +1088,33 @@ func Tag(ctx context.Context, filtering config.Filter, tag config.Tag, s storage
 	return List(ctx, filtering, s)
 }
 
+// setLabels applies changes of labels to the builds.
+func setLabels(ctx context.Context, builds []types.BuildInfo, label config.Label, s storage.Driver) error {
+	if len(label.Remove) == 0 && len(label.Set) == 0 {
+		return nil
+	}
+	for _, build := range builds {
+		labels := maps.Clone(build.Labels)
+		if labels == nil {
+			labels = types.Labels{}
+		}
+		for _, key := range label.Remove {
+			delete(labels, key)
+		}
+		maps.Copy(labels, label.Set)
+		if err := s.SetLabels(ctx, build.BuildID, labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func listBuild(
 	info types.BuildInfo,
 	buildTypes map[types.BuildType]bool,
 	buildIDs map[types.BuildID]bool,
 	buildKeys map[types.BuildKey]bool,
+	labels types.Labels,
 	untagged bool,
 ) bool {
 	if !buildTypes[info.BuildID.Type()] {
@@ -399,6 +1123,9 @@ func listBuild(
 	if untagged && len(info.Tags) > 0 {
 		return false
 	}
+	if !info.Labels.Matches(labels) {
+		return false
+	}
 	if buildIDs != nil && buildIDs[info.BuildID] {
 		return true
 	}
@@ -415,6 +1142,53 @@ func listBuild(
 	return buildIDs == nil && buildKeys == nil
 }
 
+// diffBuilds compares builds natively if driver supports it, otherwise both builds are mounted
+// and their trees are compared.
+func diffBuilds(ctx context.Context, build, base types.BuildInfo, s storage.Driver) (_ []types.Change, retErr error) {
+	if differ, ok := s.(storage.Differ); ok {
+		changes, err := differ.Diff(ctx, build.BuildID, base.BuildID)
+		if !errors.Is(err, storage.ErrDiffNotSupported) {
+			return changes, err
+		}
+	}
+
+	paths := make([]string, 0, 2)
+	for _, info := range []types.BuildInfo{build, base} {
+		if info.Mounted != "" {
+			paths = append(paths, info.Mounted)
+			continue
+		}
+		path, dropFn, err := mountTemporarily(ctx, info, s)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := dropFn(); retErr == nil {
+				retErr = err
+			}
+		}()
+		paths = append(paths, path)
+	}
+	return archive.Changes(paths[0], paths[1])
+}
+
+// matchPath returns true if path is equal to one of the filters, is located inside it, or matches it
+// as a glob pattern. Any path matches if there are no filters.
+func matchPath(path string, filters []string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, filter := range filters {
+		if path == filter || strings.HasPrefix(path, strings.TrimSuffix(filter, "/")+"/") {
+			return true
+		}
+		if matched, _ := filepath.Match(filter, path); matched {
+			return true
+		}
+	}
+	return false
+}
+
 func cloneForMount(
 	ctx context.Context,
 	image types.BuildInfo,
@@ -437,6 +1211,10 @@ func cloneForMount(
 		BuildID: buildID,
 		BasedOn: image.BuildID,
 		Params:  image.Params,
+		Env:     image.Env,
+		WorkDir: image.WorkDir,
+		User:    image.User,
+		Labels:  image.Labels,
 	}
 	if mount.Type == types.BuildTypeBoot {
 		manifest.Boots = image.Boots
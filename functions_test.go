@@ -0,0 +1,996 @@
+package osman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+
+	"github.com/outofforest/logger"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/storage"
+	"github.com/outofforest/osman/infra/types"
+)
+
+func newContext() context.Context {
+	return logger.WithLogger(context.Background(), logger.New(logger.DefaultConfig))
+}
+
+func newStorage(t *testing.T) storage.Driver {
+	return storage.NewMemoryDriver(config.Storage{Root: t.TempDir()})
+}
+
+func newImage(
+	ctx context.Context,
+	t *testing.T,
+	s storage.Driver,
+	name string,
+	basedOn types.BuildID,
+	tags ...types.Tag,
+) types.BuildID {
+	return newBuild(ctx, t, s, types.BuildTypeImage, name, basedOn, tags...)
+}
+
+func newBuild(
+	ctx context.Context,
+	t *testing.T,
+	s storage.Driver,
+	buildType types.BuildType,
+	name string,
+	basedOn types.BuildID,
+	tags ...types.Tag,
+) types.BuildID {
+	buildID := types.NewBuildID(buildType)
+
+	var finalizeFn storage.FinalizeFn
+	var err error
+	if basedOn == "" {
+		finalizeFn, _, err = s.CreateEmpty(ctx, name, buildID)
+	} else {
+		finalizeFn, _, err = s.Clone(ctx, basedOn, name, buildID)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := finalizeFn(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range tags {
+		if err := s.Tag(ctx, buildID, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buildID
+}
+
+func imageFilter(buildIDs ...types.BuildID) config.Filter {
+	return config.Filter{
+		Types:    []types.BuildType{types.BuildTypeImage},
+		BuildIDs: buildIDs,
+	}
+}
+
+func assertBuilds(ctx context.Context, t *testing.T, s storage.Driver, expected ...types.BuildID) {
+	t.Helper()
+
+	builds, err := s.Builds(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := map[types.BuildID]bool{}
+	for _, buildID := range builds {
+		existing[buildID] = true
+	}
+	if len(existing) != len(expected) {
+		t.Fatalf("expected %d builds, got %d", len(expected), len(existing))
+	}
+	for _, buildID := range expected {
+		if !existing[buildID] {
+			t.Fatalf("build %s does not exist", buildID)
+		}
+	}
+}
+
+func TestDropRequiresFilterOrAll(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+	newImage(ctx, t, s, "image", "", "latest")
+
+	if _, err := Drop(ctx, config.Storage{}, imageFilter(), config.Drop{}, s, nil); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestDropRemovesChildrenBeforeParents(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	grandParent := newImage(ctx, t, s, "grandparent", "", "latest")
+	parent := newImage(ctx, t, s, "parent", grandParent)
+	child1 := newImage(ctx, t, s, "child", parent, "1")
+	child2 := newImage(ctx, t, s, "child", parent, "2")
+
+	results, err := Drop(ctx, config.Storage{}, imageFilter(), config.Drop{All: true}, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := map[types.BuildID]int{}
+	for i, r := range results {
+		if r.Result != nil {
+			t.Fatalf("dropping build %s failed: %s", r.BuildID, r.Result)
+		}
+		dropped[r.BuildID] = i
+	}
+	if len(dropped) != 4 {
+		t.Fatalf("expected 4 builds to be dropped, got %d", len(dropped))
+	}
+	if dropped[child1] > dropped[parent] || dropped[child2] > dropped[parent] {
+		t.Fatal("parent dropped before children")
+	}
+	if dropped[parent] > dropped[grandParent] {
+		t.Fatal("grandparent dropped before parent")
+	}
+	assertBuilds(ctx, t, s)
+}
+
+func TestDropKeepsUnselectedAncestors(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	base := newImage(ctx, t, s, "base", "", "latest")
+	parent := newImage(ctx, t, s, "parent", base)
+	child := newImage(ctx, t, s, "child", parent)
+
+	results, err := Drop(ctx, config.Storage{}, imageFilter(parent, child), config.Drop{}, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if results[0].BuildID != child || results[1].BuildID != parent {
+		t.Fatal("builds dropped in wrong order")
+	}
+	for _, r := range results {
+		if r.Result != nil {
+			t.Fatalf("dropping build %s failed: %s", r.BuildID, r.Result)
+		}
+	}
+	assertBuilds(ctx, t, s, base)
+}
+
+func TestDropRemovesDescendantsBeforeSelectedAncestors(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	grandParent := newImage(ctx, t, s, "grandparent", "")
+	parent := newImage(ctx, t, s, "parent", grandParent)
+	child := newImage(ctx, t, s, "child", parent)
+
+	for range 10 {
+		results, err := Drop(ctx, config.Storage{}, imageFilter(child, grandParent), config.Drop{}, s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 || results[0].BuildID != child || results[1].BuildID != grandParent {
+			t.Fatal("builds dropped in wrong order")
+		}
+		if results[0].Result != nil {
+			t.Fatalf("dropping build %s failed: %s", child, results[0].Result)
+		}
+		if !errors.Is(results[1].Result, storage.ErrImageHasChildren) {
+			t.Fatalf("unexpected result: %v", results[1].Result)
+		}
+		assertBuilds(ctx, t, s, grandParent, parent)
+
+		child = newImage(ctx, t, s, "child", parent)
+	}
+}
+
+func TestDropFailsIfBuildHasChildren(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	parent := newImage(ctx, t, s, "parent", "", "latest")
+	child := newImage(ctx, t, s, "child", parent)
+
+	results, err := Drop(ctx, config.Storage{}, imageFilter(parent), config.Drop{}, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if !errors.Is(results[0].Result, storage.ErrImageHasChildren) {
+		t.Fatalf("unexpected result: %v", results[0].Result)
+	}
+	assertBuilds(ctx, t, s, parent, child)
+}
+
+func TestTagMovesTagBetweenBuildsOfTheSameImage(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	build1 := newImage(ctx, t, s, "image", "", "latest", "stable")
+	build2 := newImage(ctx, t, s, "image", "", "next")
+	other := newImage(ctx, t, s, "other", "", "stable")
+
+	builds, err := Tag(ctx, imageFilter(build2), config.Tag{Add: types.Tags{"stable"}}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].BuildID != build2 {
+		t.Fatal("tagged build not returned")
+	}
+	if builds[0].Tags.String() != "next, stable" {
+		t.Fatalf("unexpected tags: %s", builds[0].Tags)
+	}
+
+	info, err := s.Info(ctx, build1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Tags.String() != "latest" {
+		t.Fatalf("tag has not been removed from previous build, tags: %s", info.Tags)
+	}
+
+	info, err = s.Info(ctx, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Tags.String() != "stable" {
+		t.Fatalf("tag of other image has been modified, tags: %s", info.Tags)
+	}
+}
+
+func TestTagRemovesTags(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	buildID := newImage(ctx, t, s, "image", "", "latest", "stable")
+
+	builds, err := Tag(ctx, imageFilter(buildID), config.Tag{
+		Remove: types.Tags{"stable"},
+		Add:    types.Tags{"next"},
+	}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].Tags.String() != "latest, next" {
+		t.Fatal("tags have not been modified")
+	}
+
+	if _, err := Tag(ctx, imageFilter(buildID), config.Tag{Remove: types.Tags{"stable"}}, s); err == nil {
+		t.Fatal("error expected when removing tag which is not set")
+	}
+}
+
+func TestTagFailsIfNothingSelected(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	if _, err := Tag(ctx, imageFilter(), config.Tag{Add: types.Tags{"stable"}}, s); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := Tag(ctx, imageFilter(), config.Tag{All: true, Add: types.Tags{"stable"}}, s); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestLabelSetsLabelsUsedByFilter(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	stableID := newImage(ctx, t, s, "stable", "", "latest")
+	testingID := newImage(ctx, t, s, "testing", "", "latest")
+
+	if _, err := Label(ctx, imageFilter(stableID), config.Label{
+		Set: types.Labels{"channel": "stable", "team": "core"},
+	}, s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Tag(ctx, imageFilter(testingID), config.Tag{
+		Labels: config.Label{Set: types.Labels{"channel": "testing"}},
+	}, s); err != nil {
+		t.Fatal(err)
+	}
+	builds, err := Label(ctx, imageFilter(stableID), config.Label{Remove: []string{"team"}}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].Labels.String() != "channel=stable" {
+		t.Fatalf("labels have not been modified: %v", builds)
+	}
+
+	filtering := imageFilter()
+	filtering.Labels = types.Labels{"channel": "testing"}
+	builds, err = List(ctx, filtering, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].BuildID != testingID {
+		t.Fatalf("unexpected builds: %v", builds)
+	}
+
+	if _, err := Drop(ctx, config.Storage{}, filtering, config.Drop{}, s, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertBuilds(ctx, t, s, stableID)
+}
+
+func TestSummarizeTotalsSpacePerNameAndType(t *testing.T) {
+	builds := []types.BuildInfo{
+		{BuildID: types.NewBuildID(types.BuildTypeImage), Name: "b", Used: 1, Referenced: 10, Written: 100},
+		{BuildID: types.NewBuildID(types.BuildTypeImage), Name: "a", Used: 2, Referenced: 20, Written: 200},
+		{BuildID: types.NewBuildID(types.BuildTypeVM), Name: "a", Used: 4, Referenced: 40, Written: 400},
+	}
+
+	expected := []SpaceSummary{
+		{GroupBy: "name", Group: "a", Builds: 2, Used: 6, Referenced: 60, Written: 600},
+		{GroupBy: "name", Group: "b", Builds: 1, Used: 1, Referenced: 10, Written: 100},
+		{GroupBy: "type", Group: "iid", Builds: 2, Used: 3, Referenced: 30, Written: 300},
+		{GroupBy: "type", Group: "vid", Builds: 1, Used: 4, Referenced: 40, Written: 400},
+	}
+	summaries := Summarize(builds)
+	if len(summaries) != len(expected) {
+		t.Fatalf("expected %d summaries, got %d", len(expected), len(summaries))
+	}
+	for i, summary := range expected {
+		if summaries[i] != summary {
+			t.Fatalf("expected summary %+v, got %+v", summary, summaries[i])
+		}
+	}
+}
+
+func TestGCDropsUnusedUntaggedImages(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	base := newImage(ctx, t, s, "base", "", "latest")
+	unused := newImage(ctx, t, s, "image", base)
+	unusedChild := newImage(ctx, t, s, "image", unused)
+	parentOfTagged := newImage(ctx, t, s, "image", base)
+	tagged := newImage(ctx, t, s, "other", parentOfTagged, "latest")
+	parentOfMount := newImage(ctx, t, s, "image", base)
+	mount := newBuild(ctx, t, s, types.BuildTypeMount, "image", parentOfMount)
+
+	plan, results, err := GC(ctx, config.Storage{}, imageFilter(), config.GC{DryRun: true}, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 2 || results != nil {
+		t.Fatalf("expected 2 builds in the plan, got %d", len(plan))
+	}
+	assertBuilds(ctx, t, s, base, unused, unusedChild, parentOfTagged, tagged, parentOfMount, mount)
+
+	_, results, err = GC(ctx, config.Storage{}, imageFilter(), config.GC{}, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].BuildID != unusedChild || results[1].BuildID != unused {
+		t.Fatal("builds dropped in wrong order")
+	}
+	for _, r := range results {
+		if r.Result != nil {
+			t.Fatalf("dropping build %s failed: %s", r.BuildID, r.Result)
+		}
+	}
+	assertBuilds(ctx, t, s, base, parentOfTagged, tagged, parentOfMount, mount)
+}
+
+func TestGCKeepsRetainedImages(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	base := newImage(ctx, t, s, "base", "", "latest")
+	oldest := newImage(ctx, t, s, "image", base)
+	older := newImage(ctx, t, s, "image", oldest)
+	newest := newImage(ctx, t, s, "image", base)
+
+	plan, _, err := GC(ctx, config.Storage{}, imageFilter(), config.GC{DryRun: true, KeepNewer: time.Hour}, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 0 {
+		t.Fatalf("expected no builds in the plan, got %d", len(plan))
+	}
+
+	// Oldest build is kept because its child is retained.
+	if _, _, err := GC(ctx, config.Storage{}, imageFilter(), config.GC{KeepLast: 2}, s, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertBuilds(ctx, t, s, base, oldest, older, newest)
+
+	if _, _, err := GC(ctx, config.Storage{}, imageFilter(), config.GC{KeepLast: 1}, s, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertBuilds(ctx, t, s, base, newest)
+}
+
+func TestExportImportPreservesBuilds(t *testing.T) {
+	ctx := newContext()
+	src := newStorage(t)
+	dst := newStorage(t)
+
+	base := newImage(ctx, t, src, "base", "", "latest")
+	child := types.NewBuildID(types.BuildTypeImage)
+	finalizeFn, path, err := src.Clone(ctx, base, "child", child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "file"), []byte("content"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := finalizeFn(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []types.Tag{"1", "2"} {
+		if err := src.Tag(ctx, child, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.StoreManifest(ctx, types.ImageManifest{
+		BuildID: child,
+		BasedOn: base,
+		Params:  types.Params{"param"},
+		Boots:   []types.Boot{{Title: "title"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "archive")
+	if _, err := Export(ctx, imageFilter(child), config.Export{File: file}, src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Import(ctx, config.Import{File: file}, dst); err == nil {
+		t.Fatal("error expected when parent is missing")
+	}
+	assertBuilds(ctx, t, dst)
+
+	file = filepath.Join(t.TempDir(), "archive")
+	if _, err := Export(ctx, imageFilter(child), config.Export{File: file, WithParents: true}, src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Import(ctx, config.Import{File: file}, dst); err != nil {
+		t.Fatal(err)
+	}
+	assertBuilds(ctx, t, dst, base, child)
+
+	info, err := dst.Info(ctx, child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.BasedOn != base || info.Name != "child" || info.Tags.String() != "1, 2" ||
+		info.Params.String() != "param" || len(info.Boots) != 1 {
+		t.Fatalf("unexpected build info: %+v", info)
+	}
+	srcInfo, err := src.Info(ctx, child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.CreatedAt.Equal(srcInfo.CreatedAt) {
+		t.Fatalf("creation time has not been preserved: %s != %s", info.CreatedAt, srcInfo.CreatedAt)
+	}
+	_, path, err = dst.Clone(ctx, child, "mount", types.NewBuildID(types.BuildTypeMount))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(path, "file")); err != nil || string(content) != "content" {
+		t.Fatalf("file has not been imported: %v", err)
+	}
+
+	// Builds imported before are not received again but their tags are applied.
+	if err := dst.Untag(ctx, child, "2"); err != nil {
+		t.Fatal(err)
+	}
+	builds, err := Import(ctx, config.Import{File: file}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 || builds[0].BuildID != base || builds[1].BuildID != child {
+		t.Fatal("unexpected builds imported")
+	}
+	if builds[1].Tags.String() != "1, 2" {
+		t.Fatalf("unexpected tags: %s", builds[1].Tags)
+	}
+}
+
+func TestReplicateCopiesImagesWithParents(t *testing.T) {
+	ctx := newContext()
+	src := newStorage(t)
+	dst := newStorage(t)
+	srcConfig := config.Storage{Root: "src", Driver: "memory"}
+	replicateConfig := config.Replicate{Target: config.Storage{Root: "dst", Driver: "memory"}}
+
+	base := newImage(ctx, t, src, "base", "", "latest")
+	child1 := newImage(ctx, t, src, "child", base, "1")
+
+	builds, err := Replicate(ctx, srcConfig, imageFilter(child1), replicateConfig, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 || builds[0].BuildID != base || builds[1].BuildID != child1 {
+		t.Fatal("unexpected builds replicated")
+	}
+	assertBuilds(ctx, t, dst, base, child1)
+
+	child2 := newImage(ctx, t, src, "child", base)
+	if err := src.Tag(ctx, child2, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Replicate(ctx, srcConfig, imageFilter(child2), replicateConfig, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	assertBuilds(ctx, t, dst, base, child1, child2)
+
+	buildID, err := dst.BuildID(ctx, types.NewBuildKey("child", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buildID != child2 {
+		t.Fatal("tag has not been moved to replicated build")
+	}
+
+	if _, err := Replicate(ctx, srcConfig, imageFilter(child2), config.Replicate{Target: srcConfig}, src,
+		src); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestExportOCICreatesLayerPerImage(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	base := newImage(ctx, t, s, "base", "", "latest")
+	child := newImage(ctx, t, s, "child", base, "1")
+
+	dir := filepath.Join(t.TempDir(), "oci")
+	if _, err := Export(ctx, imageFilter(child), config.Export{File: dir, Format: config.ExportFormatOCI},
+		s); err != nil {
+		t.Fatal(err)
+	}
+
+	var index struct {
+		Manifests []struct {
+			Digest      string
+			Annotations map[string]string
+		}
+	}
+	readJSON(t, filepath.Join(dir, "index.json"), &index)
+	if len(index.Manifests) != 1 || index.Manifests[0].Annotations["org.opencontainers.image.ref.name"] != "child:1" {
+		t.Fatalf("unexpected index: %+v", index)
+	}
+
+	var manifest struct {
+		Layers      []struct{ Digest string }
+		Annotations map[string]string
+	}
+	readJSON(t, filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(index.Manifests[0].Digest, "sha256:")),
+		&manifest)
+	if len(manifest.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(manifest.Layers))
+	}
+	if manifest.Annotations[annotationBuildID] != string(child) {
+		t.Fatalf("unexpected annotations: %v", manifest.Annotations)
+	}
+}
+
+func TestExportOCIHandlesUntaggedImages(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	image := newImage(ctx, t, s, "image", "")
+
+	dir := filepath.Join(t.TempDir(), "oci")
+	if _, err := Export(ctx, imageFilter(image), config.Export{File: dir, Format: config.ExportFormatOCI},
+		s); err != nil {
+		t.Fatal(err)
+	}
+
+	var index struct {
+		Manifests []struct {
+			Annotations map[string]string
+		}
+	}
+	readJSON(t, filepath.Join(dir, "index.json"), &index)
+	if len(index.Manifests) != 1 || len(index.Manifests[0].Annotations) != 0 {
+		t.Fatalf("unexpected index: %+v", index)
+	}
+
+	// Existing tarball is not overwritten.
+	outDir := t.TempDir()
+	file := filepath.Join(outDir, "oci.tar")
+	if _, err := Export(ctx, imageFilter(image), config.Export{File: file, Format: config.ExportFormatOCI},
+		s); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("existing"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Export(ctx, imageFilter(image), config.Export{File: file, Format: config.ExportFormatOCI},
+		s); err == nil {
+		t.Fatal("error expected")
+	}
+	if content, err := os.ReadFile(file); err != nil || string(content) != "existing" {
+		t.Fatalf("file has been modified: %v", err)
+	}
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func readJSON(t *testing.T, path string, v interface{}) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevertRestoresOriginalContent(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	buildID := types.NewBuildID(types.BuildTypeImage)
+	finalizeFn, path, err := s.CreateEmpty(ctx, "image", buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "file"), []byte("original"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := finalizeFn(); err != nil {
+		t.Fatal(err)
+	}
+	mountID := newBuild(ctx, t, s, types.BuildTypeMount, "image", buildID)
+
+	info, err := s.Info(ctx, mountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(info.Mounted, "file"), []byte("modified"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(info.Mounted, "new"), []byte("new"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	filtering := config.Filter{Types: []types.BuildType{types.BuildTypeMount}, BuildIDs: []types.BuildID{mountID}}
+	builds, err := Revert(ctx, config.Storage{}, filtering, config.Revert{}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].BuildID != mountID {
+		t.Fatal("unexpected builds reverted")
+	}
+
+	content, err := os.ReadFile(filepath.Join(info.Mounted, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "original" {
+		t.Fatalf("unexpected content: %s", content)
+	}
+	if _, err := os.Stat(filepath.Join(info.Mounted, "new")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("file created after mount still exists")
+	}
+
+	if _, err := Revert(ctx, config.Storage{}, config.Filter{Types: []types.BuildType{types.BuildTypeMount}},
+		config.Revert{}, s); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestRevertRefusesBuildsUsedByRunningVMs(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	imageID := newImage(ctx, t, s, "image", "")
+	vmID := newBuild(ctx, t, s, types.BuildTypeVM, "image", imageID)
+	vm, err := s.Info(ctx, vmID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(vm.Mounted, "file"), []byte("modified"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	builds := []types.BuildInfo{vm}
+	if err := ensureNotRunning(builds, map[types.BuildID]libvirt.Domain{vmID: {}}); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := ensureNotRunning(builds, map[types.BuildID]libvirt.Domain{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// VM build is not reverted if it can't be verified that it is not running.
+	filtering := config.Filter{Types: []types.BuildType{types.BuildTypeVM}, BuildIDs: []types.BuildID{vmID}}
+	revert := config.Revert{LibvirtAddr: "unix://" + filepath.Join(t.TempDir(), "libvirt-sock")}
+	if _, err := Revert(ctx, config.Storage{}, filtering, revert, s); err == nil {
+		t.Fatal("error expected")
+	}
+	if content, err := os.ReadFile(filepath.Join(vm.Mounted, "file")); err != nil || string(content) != "modified" {
+		t.Fatalf("build has been reverted: %v", err)
+	}
+}
+
+func TestCommitCreatesImageFromMount(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	imageID := types.NewBuildID(types.BuildTypeImage)
+	finalizeFn, path, err := s.CreateEmpty(ctx, "image", imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "file"), []byte("original"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := finalizeFn(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreManifest(ctx, types.ImageManifest{
+		BuildID: imageID,
+		Params:  types.Params{"param"},
+		Boots:   []types.Boot{{Title: "boot"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mountID := newBuild(ctx, t, s, types.BuildTypeMount, "image", imageID)
+
+	mount, err := s.Info(ctx, mountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mount.Mounted, "file"), []byte("modified content"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	builds, err := Commit(ctx, config.Filter{
+		Types:    []types.BuildType{types.BuildTypeMount},
+		BuildIDs: []types.BuildID{mountID},
+	}, config.Commit{
+		Name:   "committed",
+		Tags:   types.Tags{"tag"},
+		Params: types.Params{"overridden"},
+	}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 {
+		t.Fatal("exactly one build expected")
+	}
+	info := builds[0]
+	if info.BuildID.Type() != types.BuildTypeImage || info.BasedOn != imageID || info.Name != "committed" {
+		t.Fatalf("unexpected build: %#v", info)
+	}
+	if len(info.Tags) != 1 || info.Tags[0] != "tag" {
+		t.Fatalf("unexpected tags: %v", info.Tags)
+	}
+	if len(info.Params) != 1 || info.Params[0] != "overridden" {
+		t.Fatalf("unexpected params: %v", info.Params)
+	}
+	if len(info.Boots) != 1 || info.Boots[0].Title != "boot" {
+		t.Fatalf("unexpected boots: %v", info.Boots)
+	}
+
+	checkID := newBuild(ctx, t, s, types.BuildTypeMount, "committed", info.BuildID)
+	check, err := s.Info(ctx, checkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(check.Mounted, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "modified content" {
+		t.Fatalf("unexpected content: %s", content)
+	}
+}
+
+func TestDiffComparesMountWithItsImage(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	imageID := types.NewBuildID(types.BuildTypeImage)
+	finalizeFn, path, err := s.CreateEmpty(ctx, "image", imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"kept", "removed"} {
+		if err := os.WriteFile(filepath.Join(path, file), []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := finalizeFn(); err != nil {
+		t.Fatal(err)
+	}
+	mountID := newBuild(ctx, t, s, types.BuildTypeMount, "image", imageID)
+
+	info, err := s.Info(ctx, mountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(info.Mounted, "removed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(info.Mounted, "dir"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(info.Mounted, "dir", "added"), []byte("added"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := Diff(ctx, config.Diff{Builds: []config.Filter{{
+		Types:    []types.BuildType{types.BuildTypeMount},
+		BuildIDs: []types.BuildID{mountID},
+	}}}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []types.Change{
+		{Kind: types.ChangeAdded, Path: "/dir"},
+		{Kind: types.ChangeAdded, Path: "/dir/added", Size: 5, Delta: 5},
+		{Kind: types.ChangeDeleted, Path: "/removed", Delta: -7},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	for i, change := range changes {
+		if change != expected[i] {
+			t.Fatalf("unexpected change %d: %v, expected: %v", i, change, expected[i])
+		}
+	}
+
+	changes, err = Diff(ctx, config.Diff{
+		Builds: []config.Filter{
+			{Types: []types.BuildType{types.BuildTypeImage}, BuildIDs: []types.BuildID{imageID}},
+			{Types: []types.BuildType{types.BuildTypeMount}, BuildIDs: []types.BuildID{mountID}},
+		},
+		Paths: []string{"/r*"},
+	}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Path != "/removed" {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+}
+
+func TestInspectCollectsAncestorsAndDependents(t *testing.T) {
+	ctx := newContext()
+	s := newStorage(t)
+
+	rootID := newImage(ctx, t, s, "root", "")
+	imageID := newImage(ctx, t, s, "image", rootID)
+	childID := newImage(ctx, t, s, "child", imageID)
+	mountID := newBuild(ctx, t, s, types.BuildTypeMount, "image", imageID)
+	childMountID := newBuild(ctx, t, s, types.BuildTypeMount, "child", childID)
+	bootID := newBuild(ctx, t, s, types.BuildTypeBoot, "child", childID)
+
+	inspection, err := Inspect(ctx, imageFilter(imageID), config.Inspect{}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspection.Build.BuildID != imageID {
+		t.Fatalf("unexpected build: %s", inspection.Build.BuildID)
+	}
+	if len(inspection.Ancestors) != 1 || inspection.Ancestors[0].BuildID != rootID {
+		t.Fatalf("unexpected ancestors: %v", inspection.Ancestors)
+	}
+	if len(inspection.Children) != 2 {
+		t.Fatalf("unexpected children: %v", inspection.Children)
+	}
+	mounts := map[types.BuildID]bool{}
+	for _, mount := range inspection.Mounts {
+		mounts[mount.BuildID] = true
+	}
+	if len(mounts) != 2 || !mounts[mountID] || !mounts[childMountID] {
+		t.Fatalf("unexpected mounts: %v", inspection.Mounts)
+	}
+	if len(inspection.Boots) != 1 || inspection.Boots[0].BuildID != bootID {
+		t.Fatalf("unexpected boots: %v", inspection.Boots)
+	}
+	if len(inspection.VMs) != 0 || len(inspection.Domains) != 0 {
+		t.Fatal("no VMs expected")
+	}
+
+	if _, err := Inspect(ctx, config.Filter{Types: []types.BuildType{types.BuildTypeImage}}, config.Inspect{},
+		s); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestProvenanceStatementDescribesBuild(t *testing.T) {
+	buildID := types.NewBuildID(types.BuildTypeImage)
+	parentID := types.NewBuildID(types.BuildTypeImage)
+	build := types.BuildInfo{
+		BuildID: buildID,
+		Name:    "image",
+		Tags:    types.Tags{"1"},
+		Provenance: &types.Provenance{
+			SpecFile:  &types.SpecFile{Path: "/specs/image", Digest: "sha256:abcd"},
+			Includes:  []types.SpecFile{{Path: "/specs/include", Digest: "sha256:ef01"}},
+			Parents:   []types.BuildID{parentID},
+			BaseImage: "docker.io/library/fedora:40",
+			Version:   "v1.0.0",
+			Host:      "host",
+			Steps: []types.ProvenanceStep{
+				{Command: "FROM base@1", Duration: time.Second},
+				{Command: "RUN echo test", Duration: 2 * time.Second},
+			},
+		},
+	}
+
+	statement, err := NewProvenanceStatement(build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statementRaw, err := json.Marshal(statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Type          string `json:"_type"`
+		PredicateType string `json:"predicateType"`
+		Subject       []struct {
+			Name   string            `json:"name"`
+			Digest map[string]string `json:"digest"`
+		} `json:"subject"`
+		Predicate struct {
+			BuildDefinition struct {
+				ExternalParameters struct {
+					SpecFile string   `json:"specFile"`
+					Commands []string `json:"commands"`
+				} `json:"externalParameters"`
+				ResolvedDependencies []struct {
+					URI    string            `json:"uri"`
+					Digest map[string]string `json:"digest"`
+				} `json:"resolvedDependencies"`
+			} `json:"buildDefinition"`
+		} `json:"predicate"`
+	}
+	if err := json.Unmarshal(statementRaw, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.Type != "https://in-toto.io/Statement/v1" || doc.PredicateType != "https://slsa.dev/provenance/v1" {
+		t.Fatalf("unexpected statement type: %s, %s", doc.Type, doc.PredicateType)
+	}
+	if len(doc.Subject) != 1 || doc.Subject[0].Name != "image@1" ||
+		doc.Subject[0].Digest["osmanBuildID"] != string(buildID) {
+		t.Fatalf("unexpected subject: %v", doc.Subject)
+	}
+	definition := doc.Predicate.BuildDefinition
+	if definition.ExternalParameters.SpecFile != "/specs/image" ||
+		strings.Join(definition.ExternalParameters.Commands, "; ") != "FROM base@1; RUN echo test" {
+		t.Fatalf("unexpected parameters: %v", definition.ExternalParameters)
+	}
+	dependencies := definition.ResolvedDependencies
+	if len(dependencies) != 4 ||
+		dependencies[0].URI != "file:///specs/image" || dependencies[0].Digest["sha256"] != "abcd" ||
+		dependencies[1].URI != "file:///specs/include" ||
+		dependencies[2].Digest["osmanBuildID"] != string(parentID) ||
+		dependencies[3].URI != "docker.io/library/fedora:40" {
+		t.Fatalf("unexpected dependencies: %v", dependencies)
+	}
+
+	if _, err := NewProvenanceStatement(types.BuildInfo{BuildID: buildID}); err == nil {
+		t.Fatal("error expected")
+	}
+}
@@ -0,0 +1,195 @@
+package archive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// chunkSize is the maximum size of tar entry used to store a part of stream.
+// Size of tar entry must be known before it is written, so streams are buffered and written in chunks.
+const chunkSize = 16 * 1024 * 1024
+
+// NewWriter returns new archive writer.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{tw: tar.NewWriter(w)}
+}
+
+// Writer writes files and streams of unknown size into a tar archive.
+type Writer struct {
+	tw *tar.Writer
+}
+
+// WriteJSON stores value as json file.
+func (w *Writer) WriteJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return w.writeEntry(name, data)
+}
+
+// Stream returns writer storing data under the name. Writer must be closed before next file or stream is written.
+func (w *Writer) Stream(name string) io.WriteCloser {
+	return &streamWriter{
+		w:    w,
+		name: name,
+		buf:  make([]byte, 0, chunkSize),
+	}
+}
+
+// Close finishes the archive.
+func (w *Writer) Close() error {
+	return errors.WithStack(w.tw.Close())
+}
+
+func (w *Writer) writeEntry(name string, data []byte) error {
+	if err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0o600,
+		ModTime:  time.Now(),
+	}); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err := w.tw.Write(data)
+	return errors.WithStack(err)
+}
+
+type streamWriter struct {
+	w      *Writer
+	name   string
+	buf    []byte
+	chunks int
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), chunkSize-len(sw.buf))
+		sw.buf = append(sw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(sw.buf) == chunkSize {
+			if err := sw.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (sw *streamWriter) Close() error {
+	if len(sw.buf) == 0 && sw.chunks > 0 {
+		return nil
+	}
+	return sw.flush()
+}
+
+func (sw *streamWriter) flush() error {
+	if err := sw.w.writeEntry(chunkName(sw.name, sw.chunks), sw.buf); err != nil {
+		return err
+	}
+	sw.chunks++
+	sw.buf = sw.buf[:0]
+	return nil
+}
+
+// NewReader returns new archive reader.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{tr: tar.NewReader(r)}
+}
+
+// Reader reads files and streams from archive created by Writer.
+// They must be read in the same order they were written.
+type Reader struct {
+	tr   *tar.Reader
+	next *tar.Header
+}
+
+// ReadJSON reads json file.
+func (r *Reader) ReadJSON(name string, v interface{}) error {
+	header, err := r.peek()
+	if err != nil {
+		return err
+	}
+	if header == nil || header.Name != name {
+		return errors.Errorf("file %s expected in archive", name)
+	}
+	r.next = nil
+	return errors.WithStack(json.NewDecoder(r.tr).Decode(v))
+}
+
+// Stream returns reader of the stream stored under the name.
+func (r *Reader) Stream(name string) io.Reader {
+	return &streamReader{r: r, name: name}
+}
+
+func (r *Reader) peek() (*tar.Header, error) {
+	if r.next != nil {
+		return r.next, nil
+	}
+	header, err := r.tr.Next()
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil, nil
+	case err != nil:
+		return nil, errors.WithStack(err)
+	}
+	r.next = header
+	return header, nil
+}
+
+type streamReader struct {
+	r      *Reader
+	name   string
+	chunks int
+	open   bool
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if sr.open {
+			n, err := sr.r.tr.Read(p)
+			if errors.Is(err, io.EOF) {
+				sr.open = false
+				err = nil
+			}
+			if n > 0 || err != nil {
+				return n, errors.WithStack(err)
+			}
+			continue
+		}
+
+		header, err := sr.r.peek()
+		if err != nil {
+			return 0, err
+		}
+		if header == nil || !strings.HasPrefix(header.Name, sr.name+"/") {
+			if sr.chunks == 0 {
+				return 0, errors.Errorf("stream %s expected in archive", sr.name)
+			}
+			return 0, io.EOF
+		}
+		if header.Name != chunkName(sr.name, sr.chunks) {
+			return 0, errors.Errorf("chunk %s expected in archive, got %s", chunkName(sr.name, sr.chunks),
+				header.Name)
+		}
+		sr.r.next = nil
+		sr.chunks++
+		sr.open = true
+	}
+}
+
+func chunkName(name string, chunk int) string {
+	return fmt.Sprintf("%s/%06d", name, chunk)
+}
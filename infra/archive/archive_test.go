@@ -0,0 +1,235 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/outofforest/osman/infra/types"
+)
+
+func TestStreamsAreReadInOrder(t *testing.T) {
+	stream1 := bytes.Repeat([]byte{0x01}, chunkSize+10)
+	stream2 := []byte("stream2")
+	streams := []struct {
+		Name string
+		Data []byte
+	}{{Name: "stream1", Data: stream1}, {Name: "stream2", Data: stream2}, {Name: "empty"}}
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	if err := w.WriteJSON("manifest.json", []string{"stream1", "stream2"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		sw := w.Stream(s.Name)
+		if _, err := sw.Write(s.Data); err != nil {
+			t.Fatal(err)
+		}
+		if err := sw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(buf)
+	var manifest []string
+	if err := r.ReadJSON("manifest.json", &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 2 {
+		t.Fatalf("unexpected manifest: %v", manifest)
+	}
+	for _, s := range streams {
+		data, err := io.ReadAll(r.Stream(s.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, s.Data) {
+			t.Fatalf("content of stream %s differs", s.Name)
+		}
+	}
+	if _, err := io.ReadAll(r.Stream("missing")); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestUnpackReplacesContent(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "dir", "file"), "new")
+	writeFile(t, filepath.Join(src, "file"), "file")
+	if err := os.Link(filepath.Join(src, "file"), filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(src, "symlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	writeFile(t, filepath.Join(dst, "dir", "file"), "old")
+	writeFile(t, filepath.Join(dst, "removed", "file"), "removed")
+	writeFile(t, filepath.Join(dst, "symlink"), "not a symlink")
+
+	buf := &bytes.Buffer{}
+	if err := Pack(buf, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unpack(buf, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if content := readFile(t, filepath.Join(dst, "dir", "file")); content != "new" {
+		t.Fatalf("unexpected content: %s", content)
+	}
+	if content := readFile(t, filepath.Join(dst, "link")); content != "file" {
+		t.Fatalf("unexpected content: %s", content)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "symlink")); err != nil || target != "file" {
+		t.Fatalf("symlink has not been created: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "removed")); !os.IsNotExist(err) {
+		t.Fatal("file missing in archive has not been removed")
+	}
+}
+
+func TestUnpackRejectsEntriesOutsideDirectory(t *testing.T) {
+	src := t.TempDir()
+	if err := os.Symlink(t.TempDir(), filepath.Join(src, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := Pack(buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := Unpack(buf, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkParents(dst, filepath.Join("escape", "file")); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := cleanName("../file"); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestDiffContainsChangesOnly(t *testing.T) {
+	parent := t.TempDir()
+	writeFile(t, filepath.Join(parent, "unchanged", "file"), "unchanged")
+	writeFile(t, filepath.Join(parent, "dir", "modified"), "old")
+	writeFile(t, filepath.Join(parent, "dir", "removed"), "removed")
+	writeFile(t, filepath.Join(parent, "removed", "file"), "removed")
+
+	dir := t.TempDir()
+	for _, path := range []string{filepath.Join("unchanged", "file"), filepath.Join("dir", "removed")} {
+		writeFile(t, filepath.Join(dir, path), readFile(t, filepath.Join(parent, path)))
+		info, err := os.Stat(filepath.Join(parent, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(dir, path), info.ModTime(), info.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, "dir", "removed")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "dir", "modified"), "new")
+	writeFile(t, filepath.Join(dir, "dir", "added"), "added")
+
+	buf := &bytes.Buffer{}
+	if err := Diff(buf, dir, parent); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(buf)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+
+	expected := []string{"dir/.wh.removed", ".wh.removed", "dir/", "dir/added", "dir/modified"}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+}
+
+func TestChangesReportsSizeDeltas(t *testing.T) {
+	parent := t.TempDir()
+	writeFile(t, filepath.Join(parent, "unchanged"), "unchanged")
+	writeFile(t, filepath.Join(parent, "dir", "modified"), "old")
+	writeFile(t, filepath.Join(parent, "removed", "file"), "removed")
+	writeFile(t, filepath.Join(parent, "replaced"), "file")
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "unchanged"), "unchanged")
+	info, err := os.Stat(filepath.Join(parent, "unchanged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "unchanged"), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "dir", "modified"), "modified")
+	writeFile(t, filepath.Join(dir, "dir", "added"), "added")
+	writeFile(t, filepath.Join(dir, "replaced", "file"), "file")
+
+	changes, err := Changes(dir, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []types.Change{
+		{Kind: types.ChangeDeleted, Path: "/removed", Delta: 0},
+		{Kind: types.ChangeDeleted, Path: "/removed/file", Delta: -7},
+		{Kind: types.ChangeDeleted, Path: "/replaced", Delta: -4},
+		{Kind: types.ChangeAdded, Path: "/dir/added", Size: 5, Delta: 5},
+		{Kind: types.ChangeModified, Path: "/dir/modified", Size: 8, Delta: 5},
+		{Kind: types.ChangeAdded, Path: "/replaced", Delta: 0},
+		{Kind: types.ChangeAdded, Path: "/replaced/file", Size: 4, Delta: 4},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	for i, change := range changes {
+		if change != expected[i] {
+			t.Fatalf("unexpected change %d: %v, expected: %v", i, change, expected[i])
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/types"
+)
+
+// Changes returns paths changed in the directory since its parent directory was copied. Files are compared
+// by their metadata, like in Diff. Entry replaced by entry of different type is reported as deleted and added.
+// Modified directories are not reported, their changed children are. Deleted paths are returned first.
+func Changes(dir, parentDir string) ([]types.Change, error) {
+	var changes []types.Change
+
+	err := filepath.WalkDir(parentDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(parentDir, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+
+		info, err := os.Lstat(filepath.Join(dir, relPath))
+		switch {
+		case err == nil:
+			if info.Mode().Type() == entry.Type() {
+				return nil
+			}
+		case !isNotExist(err):
+			return err
+		}
+
+		parentInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size := fileSize(parentInfo)
+		changes = append(changes, types.Change{
+			Kind:  types.ChangeDeleted,
+			Path:  "/" + filepath.ToSlash(relPath),
+			Delta: -types.SizeDelta(size),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		change := types.Change{
+			Kind: types.ChangeAdded,
+			Path: "/" + filepath.ToSlash(relPath),
+			Size: fileSize(info),
+		}
+
+		parentPath := filepath.Join(parentDir, relPath)
+		parentInfo, err := os.Lstat(parentPath)
+		switch {
+		case isNotExist(err):
+		case err != nil:
+			return err
+		case parentInfo.Mode().Type() == info.Mode().Type():
+			if info.IsDir() {
+				return nil
+			}
+			changed, err := isChanged(path, info, parentPath)
+			if err != nil || !changed {
+				return err
+			}
+			change.Kind = types.ChangeModified
+			change.Delta = -types.SizeDelta(fileSize(parentInfo))
+		}
+
+		change.Delta += types.SizeDelta(change.Size)
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return changes, nil
+}
+
+// isNotExist returns true if error means that file does not exist, including the case when one of its parents
+// is not a directory.
+func isNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// fileSize returns size of regular file, zero is returned for other types of files.
+func fileSize(info fs.FileInfo) types.Size {
+	if !info.Mode().IsRegular() {
+		return 0
+	}
+	return types.Size(info.Size())
+}
@@ -0,0 +1,480 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// whiteoutPrefix is the prefix of file names marking files removed from parent layer of OCI image.
+const whiteoutPrefix = ".wh."
+
+// Pack writes content of the directory to the writer as a tar stream.
+// Ownership, permissions, modification times, hard links, device files and extended attributes are preserved.
+func Pack(w io.Writer, dir string) error {
+	return Diff(w, dir, "")
+}
+
+// Diff writes changes made in the directory since its parent directory was copied to the writer as a tar stream.
+// Removed files are represented by whiteout files used by OCI image layers. Files are compared by their metadata.
+// If parent directory is empty, the whole content is written.
+func Diff(w io.Writer, dir, parentDir string) error {
+	tw := tar.NewWriter(w)
+	if parentDir != "" {
+		if err := writeWhiteouts(tw, dir, parentDir); err != nil {
+			return err
+		}
+	}
+
+	links := map[uint64]string{}
+	written := map[string]bool{}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if parentDir != "" {
+			changed, err := isChanged(path, info, filepath.Join(parentDir, relPath))
+			if err != nil || !changed {
+				return err
+			}
+		}
+
+		// Parent directories are written even if they have not been changed, so tools may extract the stream.
+		var parents []string
+		for parent := filepath.Dir(relPath); parent != "." && !written[parent]; parent = filepath.Dir(parent) {
+			parents = append(parents, parent)
+		}
+		for i := len(parents) - 1; i >= 0; i-- {
+			parentInfo, err := os.Lstat(filepath.Join(dir, parents[i]))
+			if err != nil {
+				return err
+			}
+			if err := writeEntry(tw, filepath.Join(dir, parents[i]), parents[i], parentInfo, links); err != nil {
+				return err
+			}
+			written[parents[i]] = true
+		}
+
+		written[relPath] = true
+		return writeEntry(tw, path, relPath, info, links)
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(tw.Close())
+}
+
+func writeEntry(tw *tar.Writer, path, name string, info fs.FileInfo, links map[uint64]string) error {
+	header, err := fileHeader(path, name, info, links)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return errors.WithStack(err)
+	}
+	if header.Typeflag != tar.TypeReg || header.Size == 0 {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return errors.WithStack(err)
+}
+
+// writeWhiteouts writes whiteout files for entries removed from parent directory or replaced by entries
+// of different type.
+func writeWhiteouts(tw *tar.Writer, dir, parentDir string) error {
+	return errors.WithStack(filepath.WalkDir(parentDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(parentDir, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+
+		info, err := os.Lstat(filepath.Join(dir, relPath))
+		switch {
+		case err == nil:
+			if info.Mode().Type() == entry.Type() {
+				return nil
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return err
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.ToSlash(filepath.Join(filepath.Dir(relPath), whiteoutPrefix+entry.Name())),
+			Mode:     0o600,
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}))
+}
+
+// isChanged compares file with the corresponding one in parent directory.
+func isChanged(path string, info fs.FileInfo, parentPath string) (bool, error) {
+	parentInfo, err := os.Lstat(parentPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return true, nil
+	case err != nil:
+		return false, errors.WithStack(err)
+	}
+
+	if info.Mode() != parentInfo.Mode() {
+		return true, nil
+	}
+	stat, ok1 := info.Sys().(*syscall.Stat_t)
+	parentStat, ok2 := parentInfo.Sys().(*syscall.Stat_t)
+	if !ok1 || !ok2 {
+		return true, nil
+	}
+	if stat.Uid != parentStat.Uid || stat.Gid != parentStat.Gid || stat.Rdev != parentStat.Rdev {
+		return true, nil
+	}
+	// Modification time of directory changes whenever its content is modified, so it is not compared.
+	if info.IsDir() {
+		return false, nil
+	}
+	if info.Size() != parentInfo.Size() || !info.ModTime().Equal(parentInfo.ModTime()) {
+		return true, nil
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return false, nil
+	}
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	parentTarget, err := os.Readlink(parentPath)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return target != parentTarget, nil
+}
+
+// fileHeader returns tar header for the file. Links map is used to detect hard links. It maps inode to the name
+// of the first file using it.
+func fileHeader(path, name string, info fs.FileInfo, links map[uint64]string) (*tar.Header, error) {
+	var linkTarget string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		linkTarget, err = os.Readlink(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, linkTarget)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	header.Name = filepath.ToSlash(name)
+	header.Format = tar.FormatPAX
+	header.Uname = ""
+	header.Gname = ""
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && header.Typeflag == tar.TypeReg && stat.Nlink > 1 {
+		if target, exists := links[stat.Ino]; exists {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = target
+			header.Size = 0
+		} else {
+			links[stat.Ino] = header.Name
+		}
+	}
+
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range xattrs {
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+		header.PAXRecords[xattrPAXPrefix+name] = value
+	}
+	return header, nil
+}
+
+// Unpack replaces content of the directory with the content of tar stream. Files existing in the directory
+// but missing in the stream are removed.
+func Unpack(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	names := map[string]bool{}
+	var dirs []*tar.Header
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		name, err := cleanName(header.Name)
+		if err != nil {
+			return err
+		}
+		names[name] = true
+
+		if err := unpackEntry(tr, header, dir, name); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, header)
+		}
+	}
+
+	// Content of directories is modified while unpacking, so their times are set at the end.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setTimes(filepath.Join(dir, dirs[i].Name), dirs[i]); err != nil {
+			return err
+		}
+	}
+
+	return removeMissing(dir, names)
+}
+
+func unpackEntry(tr *tar.Reader, header *tar.Header, dir, name string) error {
+	if err := checkParents(dir, name); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, name)
+	existing, err := os.Lstat(path)
+	switch {
+	case err == nil:
+		if !existing.IsDir() || header.Typeflag != tar.TypeDir {
+			if err := os.RemoveAll(path); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return errors.WithStack(err)
+	}
+
+	mode := uint32(header.Mode) & 0o7777
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if existing == nil || !existing.IsDir() {
+			if err := os.Mkdir(path, 0o700); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = io.Copy(f, tr)
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	case tar.TypeLink:
+		target, err := cleanName(header.Linkname)
+		if err != nil {
+			return err
+		}
+		return errors.WithStack(os.Link(filepath.Join(dir, target), path))
+	case tar.TypeSymlink:
+		if err := os.Symlink(header.Linkname, path); err != nil {
+			return errors.WithStack(err)
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		fileType := map[byte]uint32{
+			tar.TypeChar:  unix.S_IFCHR,
+			tar.TypeBlock: unix.S_IFBLK,
+			tar.TypeFifo:  unix.S_IFIFO,
+		}[header.Typeflag]
+		dev := int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
+		if err := unix.Mknod(path, fileType|mode, dev); err != nil {
+			return errors.Wrapf(err, "creating device file %s failed", path)
+		}
+	default:
+		return errors.Errorf("unsupported type of tar entry %s: %c", header.Name, header.Typeflag)
+	}
+
+	if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+		return errors.WithStack(err)
+	}
+	if header.Typeflag != tar.TypeSymlink {
+		// Chmod must be called after chown because chown clears setuid and setgid bits.
+		if err := os.Chmod(path, fs.FileMode(mode&0o777)|specialBits(mode)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, xattrPAXPrefix) {
+			continue
+		}
+		if err := unix.Lsetxattr(path, strings.TrimPrefix(key, xattrPAXPrefix), []byte(value), 0); err != nil {
+			return errors.Wrapf(err, "setting extended attribute %s on %s failed", key, path)
+		}
+	}
+	if header.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return setTimes(path, header)
+}
+
+// cleanName verifies that name of tar entry stays inside the directory.
+func cleanName(name string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(cleaned) || cleaned == "." || cleaned == ".." ||
+		strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("invalid name of tar entry: %s", name)
+	}
+	return cleaned, nil
+}
+
+// checkParents verifies that none of the parent directories is a symlink, so the entry can't be written
+// outside the directory.
+func checkParents(dir, name string) error {
+	path := dir
+	parts := strings.Split(filepath.Dir(name), string(filepath.Separator))
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !info.IsDir() {
+			return errors.Errorf("parent %s of tar entry %s is not a directory", path, name)
+		}
+	}
+	return nil
+}
+
+func removeMissing(dir string, names map[string]bool) error {
+	return errors.WithStack(filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if name == "." || names[name] {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}))
+}
+
+func setTimes(path string, header *tar.Header) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(header.AccessTime.UnixNano()),
+		unix.NsecToTimespec(header.ModTime.UnixNano()),
+	}
+	if header.AccessTime.IsZero() {
+		ts[0] = ts[1]
+	}
+	return errors.WithStack(unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW))
+}
+
+func specialBits(mode uint32) fs.FileMode {
+	var res fs.FileMode
+	if mode&unix.S_ISUID != 0 {
+		res |= fs.ModeSetuid
+	}
+	if mode&unix.S_ISGID != 0 {
+		res |= fs.ModeSetgid
+	}
+	if mode&unix.S_ISVTX != 0 {
+		res |= fs.ModeSticky
+	}
+	return res
+}
+
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "listing extended attributes of %s failed", path)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing extended attributes of %s failed", path)
+	}
+
+	xattrs := map[string]string{}
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := unix.Lgetxattr(path, string(name), nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading extended attribute %s of %s failed", name, path)
+		}
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(path, string(name), value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading extended attribute %s of %s failed", name, path)
+		}
+		xattrs[string(name)] = string(value[:size])
+	}
+	return xattrs, nil
+}
@@ -2,8 +2,12 @@ package base
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 
@@ -20,9 +24,27 @@ func NewDockerInitializer() Initializer {
 type dockerInitializer struct {
 }
 
+// Source returns reference of the docker image installed for build key.
+// Digest is computed from the manifest stored in cache directory while image was fetched.
+func (f *dockerInitializer) Source(cacheDir string, buildKey types.BuildKey) (string, error) {
+	image := buildKey.Name
+	if !strings.Contains(image, "/") {
+		image = "library/" + image
+	}
+
+	manifestFile := fmt.Sprintf("%s:%s:manifest.json", strings.ReplaceAll(image, "/", ":"), buildKey.Tag)
+	manifest, err := os.ReadFile(filepath.Join(dockerCacheDir(cacheDir), manifestFile))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	digest := sha256.Sum256(manifest)
+
+	return "docker.io/" + image + ":" + string(buildKey.Tag) + "@sha256:" + hex.EncodeToString(digest[:]), nil
+}
+
 // Init fetches image from docker registry and integrates it inside directory.
 func (f *dockerInitializer) Init(ctx context.Context, cacheDir, dir string, buildKey types.BuildKey) (retErr error) {
-	cacheDir = filepath.Join(cacheDir, "docker-images")
+	cacheDir = dockerCacheDir(cacheDir)
 	if err := os.MkdirAll(cacheDir, 0o700); err != nil {
 		return errors.WithStack(err)
 	}
@@ -68,3 +90,7 @@ func (f *dockerInitializer) Init(ctx context.Context, cacheDir, dir string, buil
 		return errors.WithStack(ctx.Err())
 	})
 }
+
+func dockerCacheDir(cacheDir string) string {
+	return filepath.Join(cacheDir, "docker-images")
+}
@@ -10,4 +10,7 @@ import (
 type Initializer interface {
 	// Init installs base image inside directory.
 	Init(ctx context.Context, cacheDir, dir string, buildKey types.BuildKey) error
+
+	// Source returns reference, including digest, of the base image installed for build key.
+	Source(cacheDir string, buildKey types.BuildKey) (string, error)
 }
@@ -2,17 +2,19 @@ package infra
 
 import (
 	"context"
+	"maps"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/pkg/errors"
 
-	"github.com/outofforest/isolator"
 	"github.com/outofforest/isolator/wire"
 	"github.com/outofforest/osman/config"
 	"github.com/outofforest/osman/infra/base"
 	"github.com/outofforest/osman/infra/description"
 	"github.com/outofforest/osman/infra/parser"
+	"github.com/outofforest/osman/infra/runner"
 	"github.com/outofforest/osman/infra/storage"
 	"github.com/outofforest/osman/infra/types"
 )
@@ -24,26 +26,35 @@ func NewBuilder(
 	repo *Repository,
 	storage storage.Driver,
 	parser parser.Parser,
+	runner runner.Runner,
 ) *Builder {
 	return &Builder{
 		rebuild:     config.Rebuild,
+		noCache:     config.NoCache,
+		buildArgs:   config.BuildArgs,
+		keepStages:  config.KeepStages,
 		readyBuilds: map[types.BuildKey]bool{},
 		initializer: initializer,
 		repo:        repo,
 		storage:     storage,
 		parser:      parser,
+		runner:      runner,
 	}
 }
 
 // Builder builds images.
 type Builder struct {
 	rebuild     bool
+	noCache     bool
+	buildArgs   map[string]string
+	keepStages  bool
 	readyBuilds map[types.BuildKey]bool
 
 	initializer base.Initializer
 	repo        *Repository
 	storage     storage.Driver
 	parser      parser.Parser
+	runner      runner.Runner
 }
 
 // BuildFromFile builds image from spec file.
@@ -69,11 +80,16 @@ func (b *Builder) buildFromFile(
 	specFile, name string,
 	tags ...types.Tag,
 ) (types.BuildID, error) {
-	commands, err := b.parser.Parse(specFile)
+	commands, specFiles, err := b.parser.Parse(specFile, b.buildArgs)
 	if err != nil {
 		return "", err
 	}
-	return b.build(ctx, cacheDir, stack, description.Describe(name, tags, commands...))
+
+	stages := splitStages(commands)
+	if len(stages) == 1 {
+		return b.build(ctx, cacheDir, stack, description.Describe(name, tags, commands...).FromSpecFiles(specFiles...))
+	}
+	return b.buildStages(ctx, cacheDir, stack, stages, specFiles, name, tags...)
 }
 
 func (b *Builder) initialize(
@@ -95,6 +111,7 @@ func (b *Builder) build(
 	stack map[types.BuildKey]bool,
 	img *description.Descriptor,
 ) (retBuildID types.BuildID, retErr error) {
+	startedAt := time.Now()
 	if !types.IsNameValid(img.Name()) {
 		return "", errors.Errorf("name %s is invalid", img.Name())
 	}
@@ -116,6 +133,10 @@ func (b *Builder) build(
 	}
 
 	buildID := types.NewBuildID(types.BuildTypeImage)
+	provenance, err := newProvenance(img, startedAt)
+	if err != nil {
+		return "", err
+	}
 
 	var imgFinalize storage.FinalizeFn
 	var path string
@@ -150,13 +171,27 @@ func (b *Builder) build(
 			return "", errors.New("for base image exactly one tag is required")
 		}
 
-		var err error
 		imgFinalize, path, err = b.storage.CreateEmpty(ctx, img.Name(), buildID)
 		if err != nil {
 			return "", err
 		}
 
-		if err := b.initialize(ctx, cacheDir, types.NewBuildKey(img.Name(), tags[0]), path); err != nil {
+		buildKey := types.NewBuildKey(img.Name(), tags[0])
+		if err := b.initialize(ctx, cacheDir, buildKey, path); err != nil {
+			return "", err
+		}
+
+		if buildKey.Name != "scratch" {
+			provenance.BaseImage, err = b.initializer.Source(cacheDir, buildKey)
+			if err != nil {
+				return "", err
+			}
+		}
+		provenance.FinishedAt = time.Now()
+		if err := b.storage.StoreManifest(ctx, types.ImageManifest{
+			BuildID:    buildID,
+			Provenance: provenance,
+		}); err != nil {
 			return "", err
 		}
 	} else {
@@ -165,39 +200,59 @@ func (b *Builder) build(
 			return "", errors.New("first command must be FROM")
 		}
 
-		var err error
-		var buildInfo types.BuildInfo
-		imgFinalize, path, buildInfo, err = b.clone(
-			ctx,
-			fromCommand.BuildKey,
-			cacheDir,
-			stack,
-			img,
-			buildID,
-		)
+		parentInfo, err := b.parent(ctx, fromCommand.BuildKey, cacheDir, stack)
+		if err != nil {
+			return "", err
+		}
+		if err := b.inheritProvenance(ctx, provenance, parentInfo); err != nil {
+			return "", err
+		}
+		provenance.Steps = append(provenance.Steps, types.ProvenanceStep{
+			Command:  fromCommand.String(),
+			Duration: time.Since(startedAt),
+		})
+
+		stageCacheKeys, err := b.stageCacheKeys(ctx, commands)
+		if err != nil {
+			return "", err
+		}
+		cacheKey, err := computeCacheKey(parentInfo.BuildID, commands, stageCacheKeys)
+		if err != nil {
+			return "", err
+		}
+		if !b.noCache {
+			cachedBuildID, err := b.cachedBuild(ctx, img.Name(), cacheKey)
+			if err != nil {
+				return "", err
+			}
+			if cachedBuildID != "" {
+				if err := b.tag(ctx, cachedBuildID, keys); err != nil {
+					return "", err
+				}
+				return cachedBuildID, nil
+			}
+		}
+
+		imgFinalize, path, err = b.storage.Clone(ctx, parentInfo.BuildID, img.Name(), buildID)
+		if err != nil {
+			return "", err
+		}
+
+		stages, stageMounts, err := b.mountStages(ctx, commands)
 		if err != nil {
 			return "", err
 		}
+		defer func() {
+			for _, mountID := range stageMounts {
+				if err := b.storage.Drop(ctx, mountID); err != nil && retErr == nil {
+					retErr = err
+				}
+			}
+		}()
 
-		err = isolator.Run(ctx, isolator.Config{
-			Dir: path,
-			Types: []interface{}{
-				wire.Result{},
-				wire.Log{},
-			},
-			Executor: wire.Config{
-				ConfigureSystem: true,
-				UseHostNetwork:  true,
-				Mounts: []wire.Mount{
-					{
-						Host:      ".",
-						Namespace: "/.specdir",
-						Writable:  true,
-					},
-				},
-			},
-		}, func(ctx context.Context, incoming <-chan interface{}, outgoing chan<- interface{}) error {
-			build := newImageBuild(buildInfo, incoming, outgoing)
+		err = b.runner.Run(ctx, path, func(ctx context.Context, incoming <-chan interface{}, outgoing chan<- interface{}) error {
+			build := newImageBuild(parentInfo, path, incoming, outgoing)
+			build.stages = stages
 			for _, cmd := range commands[1:] {
 				select {
 				case <-ctx.Done():
@@ -205,12 +260,20 @@ func (b *Builder) build(
 				default:
 				}
 
+				stepStartedAt := time.Now()
 				if err := cmd.Execute(ctx, build); err != nil {
 					return err
 				}
+				provenance.Steps = append(provenance.Steps, types.ProvenanceStep{
+					Command:  cmd.String(),
+					Duration: time.Since(stepStartedAt),
+				})
 			}
 
+			provenance.FinishedAt = time.Now()
 			build.manifest.BuildID = buildID
+			build.manifest.CacheKey = cacheKey
+			build.manifest.Provenance = provenance
 			return b.storage.StoreManifest(ctx, build.manifest)
 		})
 		if err != nil {
@@ -218,33 +281,63 @@ func (b *Builder) build(
 		}
 	}
 
+	if err := b.tag(ctx, buildID, keys); err != nil {
+		return "", err
+	}
+	return buildID, nil
+}
+
+func (b *Builder) tag(ctx context.Context, buildID types.BuildID, keys []types.BuildKey) error {
 	for _, key := range keys {
 		if err := b.storage.Tag(ctx, buildID, key.Tag); err != nil {
-			return "", err
+			return err
 		}
 	}
 	for _, key := range keys {
 		b.readyBuilds[key] = true
 	}
-	return buildID, nil
+	return nil
 }
 
-func (b *Builder) clone(
+// cachedBuild returns the most recent image of the name built using the same cache key.
+// Empty build ID is returned if there is no such image.
+func (b *Builder) cachedBuild(ctx context.Context, name, cacheKey string) (types.BuildID, error) {
+	buildIDs, err := b.storage.Builds(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var cached types.BuildInfo
+	for _, buildID := range buildIDs {
+		if buildID.Type() != types.BuildTypeImage {
+			continue
+		}
+		info, err := b.storage.Info(ctx, buildID)
+		if err != nil {
+			return "", err
+		}
+		if info.Name == name && info.CacheKey == cacheKey && info.CreatedAt.After(cached.CreatedAt) {
+			cached = info
+		}
+	}
+	return cached.BuildID, nil
+}
+
+// parent returns info of the image identified by the build key. If image does not exist, it is built.
+func (b *Builder) parent(
 	ctx context.Context,
 	srcBuildKey types.BuildKey,
 	cacheDir string,
 	stack map[types.BuildKey]bool,
-	img *description.Descriptor,
-	buildID types.BuildID,
-) (storage.FinalizeFn, string, types.BuildInfo, error) {
+) (types.BuildInfo, error) {
 	if !types.IsNameValid(srcBuildKey.Name) {
-		return nil, "", types.BuildInfo{}, errors.Errorf("name %s is invalid", srcBuildKey.Name)
+		return types.BuildInfo{}, errors.Errorf("name %s is invalid", srcBuildKey.Name)
 	}
 	if !srcBuildKey.Tag.IsValid() {
-		return nil, "", types.BuildInfo{}, errors.Errorf("tag %s is invalid", srcBuildKey.Tag)
+		return types.BuildInfo{}, errors.Errorf("tag %s is invalid", srcBuildKey.Tag)
 	}
 
-	// Try to clone existing image.
+	// Try to use existing image.
 	err := types.ErrImageDoesNotExist
 	var srcBuildID types.BuildID
 	if !b.rebuild || b.readyBuilds[srcBuildKey] {
@@ -259,7 +352,7 @@ func (b *Builder) clone(
 			_, err = b.buildFromFile(ctx, cacheDir, stack, srcBuildKey.Name, srcBuildKey.Name, description.DefaultTag)
 		}
 	default:
-		return nil, "", types.BuildInfo{}, err
+		return types.BuildInfo{}, err
 	}
 
 	switch {
@@ -272,54 +365,56 @@ func (b *Builder) clone(
 			_, err = b.build(ctx, cacheDir, stack, description.Describe(srcBuildKey.Name, types.Tags{srcBuildKey.Tag}))
 		}
 	default:
-		return nil, "", types.BuildInfo{}, err
+		return types.BuildInfo{}, err
 	}
 
 	if err != nil {
-		return nil, "", types.BuildInfo{}, err
+		return types.BuildInfo{}, err
 	}
 
 	if !srcBuildID.IsValid() {
 		srcBuildID, err = b.storage.BuildID(ctx, srcBuildKey)
 		if err != nil {
-			return nil, "", types.BuildInfo{}, err
+			return types.BuildInfo{}, err
 		}
 	}
 	if !srcBuildID.Type().Properties().Cloneable {
-		return nil, "", types.BuildInfo{}, errors.Errorf("build %s is not cloneable", srcBuildKey)
-	}
-
-	imgFinalize, path, err := b.storage.Clone(ctx, srcBuildID, img.Name(), buildID)
-	if err != nil {
-		return nil, "", types.BuildInfo{}, err
+		return types.BuildInfo{}, errors.Errorf("build %s is not cloneable", srcBuildKey)
 	}
 
-	buildInfo, err := b.storage.Info(ctx, srcBuildID)
-	if err != nil {
-		return imgFinalize, "", types.BuildInfo{}, err
-	}
-
-	if err != nil {
-		return imgFinalize, "", types.BuildInfo{}, err
-	}
-
-	return imgFinalize, path, buildInfo, nil
+	return b.storage.Info(ctx, srcBuildID)
 }
 
 var _ description.ImageBuild = &imageBuild{}
 
-func newImageBuild(buildInfo types.BuildInfo, incoming <-chan interface{}, outgoing chan<- interface{}) *imageBuild {
+func newImageBuild(
+	buildInfo types.BuildInfo,
+	dir string,
+	incoming <-chan interface{},
+	outgoing chan<- interface{},
+) *imageBuild {
 	return &imageBuild{
+		dir:      dir,
 		incoming: incoming,
 		outgoing: outgoing,
 		manifest: types.ImageManifest{
 			BasedOn: buildInfo.BuildID,
 			Params:  buildInfo.Params,
+			Env:     maps.Clone(buildInfo.Env),
+			WorkDir: buildInfo.WorkDir,
+			User:    buildInfo.User,
+			Labels:  maps.Clone(buildInfo.Labels),
 		},
 	}
 }
 
 type imageBuild struct {
+	// dir is the root directory of the image being built.
+	dir string
+
+	// stages maps IDs of builds files are copied from to their root directories.
+	stages map[string]string
+
 	incoming <-chan interface{}
 	outgoing chan<- interface{}
 	manifest types.ImageManifest
@@ -332,10 +427,20 @@ func (b *imageBuild) Params(cmd *description.ParamsCommand) {
 
 // Run is a handler for RUN.
 func (b *imageBuild) Run(ctx context.Context, cmd *description.RunCommand) error {
+	credential, err := b.credential(b.manifest.User)
+	if err != nil {
+		return err
+	}
+
 	select {
 	case <-ctx.Done():
 		return errors.WithStack(ctx.Err())
-	case b.outgoing <- wire.Execute{Command: cmd.Command}:
+	case b.outgoing <- runner.Execute{
+		Command:    cmd.Command,
+		Env:        b.manifest.Env.Pairs(),
+		WorkDir:    b.manifest.WorkDir,
+		Credential: credential,
+	}:
 	}
 
 	for content := range b.incoming {
@@ -360,6 +465,65 @@ func (b *imageBuild) Run(ctx context.Context, cmd *description.RunCommand) error
 	return errors.WithStack(ctx.Err())
 }
 
+// Env sets environment variables applied to subsequent commands.
+func (b *imageBuild) Env(cmd *description.EnvCommand) error {
+	if b.manifest.Env == nil {
+		b.manifest.Env = types.Env{}
+	}
+	for name, value := range cmd.Vars {
+		if !description.IsEnvNameValid(name) {
+			return errors.Errorf("name of environment variable %s is invalid", name)
+		}
+		b.manifest.Env[name] = value
+	}
+	return nil
+}
+
+// Label sets labels of the image.
+func (b *imageBuild) Label(cmd *description.LabelCommand) error {
+	if b.manifest.Labels == nil {
+		b.manifest.Labels = types.Labels{}
+	}
+	for key, value := range cmd.Labels {
+		if !types.IsLabelKeyValid(key) {
+			return errors.Errorf("key of label %s is invalid", key)
+		}
+		b.manifest.Labels[key] = value
+	}
+	return nil
+}
+
+// Arg records the value of the argument image is built with.
+func (b *imageBuild) Arg(cmd *description.ArgCommand) {
+	if b.manifest.Args == nil {
+		b.manifest.Args = types.Args{}
+	}
+	b.manifest.Args[cmd.Name] = cmd.Value
+}
+
+// WorkDir sets working directory of subsequent commands, the directory is created if it does not exist.
+func (b *imageBuild) WorkDir(cmd *description.WorkDirCommand) error {
+	workDir := filepath.Join("/", b.manifest.WorkDir, cmd.Path)
+	if filepath.IsAbs(cmd.Path) {
+		workDir = filepath.Clean(cmd.Path)
+	}
+
+	path, err := imagePath(b.dir, workDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	b.manifest.WorkDir = workDir
+	return nil
+}
+
+// User sets the user subsequent commands are executed as.
+func (b *imageBuild) User(cmd *description.UserCommand) {
+	b.manifest.User = cmd.User
+}
+
 // Boot sets boot option for an image.
 func (b *imageBuild) Boot(cmd *description.BootCommand) {
 	b.manifest.Boots = append(b.manifest.Boots, types.Boot{Title: cmd.Title, Params: cmd.Params})
@@ -0,0 +1,954 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/logger"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/description"
+	"github.com/outofforest/osman/infra/fake"
+	"github.com/outofforest/osman/infra/storage"
+	"github.com/outofforest/osman/infra/types"
+)
+
+func newContext() context.Context {
+	return logger.WithLogger(context.Background(), logger.New(logger.DefaultConfig))
+}
+
+// specFiles is the parser returning commands for predefined spec files.
+type specFiles map[string][]description.Command
+
+func (s specFiles) Parse(filePath string, buildArgs map[string]string) ([]description.Command, []string, error) {
+	commands, exists := s[filePath]
+	if !exists {
+		return nil, nil, errors.WithStack(fmt.Errorf("spec file %s does not exist: %w", filePath,
+			types.ErrImageDoesNotExist))
+	}
+	return commands, nil, nil
+}
+
+type env struct {
+	storage     storage.Driver
+	initializer *fake.Initializer
+	runner      *fake.Runner
+	repo        *Repository
+	specFiles   specFiles
+}
+
+func newEnv(t *testing.T) *env {
+	return &env{
+		storage:     storage.NewMemoryDriver(config.Storage{Root: t.TempDir()}),
+		initializer: fake.NewInitializer(),
+		runner:      fake.NewRunner(),
+		repo:        NewRepository(),
+		specFiles:   specFiles{},
+	}
+}
+
+func (e *env) builder(rebuild bool) *Builder {
+	return e.builderWithConfig(config.Build{Rebuild: rebuild})
+}
+
+func (e *env) builderWithConfig(config config.Build) *Builder {
+	return NewBuilder(config, e.initializer, e.repo, e.storage, e.specFiles, e.runner)
+}
+
+func (e *env) info(ctx context.Context, t *testing.T, buildID types.BuildID) types.BuildInfo {
+	t.Helper()
+
+	info, err := e.storage.Info(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func (e *env) buildID(ctx context.Context, t *testing.T, buildKey types.BuildKey) types.BuildID {
+	t.Helper()
+
+	buildID, err := e.storage.BuildID(ctx, buildKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buildID
+}
+
+func (e *env) assertInitialized(t *testing.T, expected ...types.BuildKey) {
+	t.Helper()
+
+	initialized := e.initializer.Initialized()
+	if len(initialized) != len(expected) {
+		t.Fatalf("expected %d base images to be initialized, got %d", len(expected), len(initialized))
+	}
+	for i, buildKey := range expected {
+		if initialized[i] != buildKey {
+			t.Fatalf("expected base image %s to be initialized, got %s", buildKey, initialized[i])
+		}
+	}
+}
+
+func (e *env) assertExecuted(t *testing.T, expected ...string) {
+	t.Helper()
+
+	executions := e.runner.Executions()
+	if len(executions) != len(expected) {
+		t.Fatalf("expected %d commands to be executed, got %d", len(expected), len(executions))
+	}
+	for i, command := range expected {
+		if executions[i].Command != command {
+			t.Fatalf("expected command %q to be executed, got %q", command, executions[i].Command)
+		}
+	}
+}
+
+func child(parent types.BuildKey, commands ...description.Command) *description.Descriptor {
+	return description.Describe("child", types.Tags{"test"},
+		append([]description.Command{description.From(parent)}, commands...)...)
+}
+
+func TestBuildClonesExistingImage(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	baseKey := types.NewBuildKey("base", description.DefaultTag)
+	baseID, err := e.builder(false).Build(ctx, "", description.Describe(baseKey.Name, types.Tags{baseKey.Tag}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buildID, err := e.builder(false).Build(ctx, "", child(baseKey,
+		description.Run("echo test"),
+		description.Params("param1"),
+		description.Boot("title", []string{"param2"}),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := e.info(ctx, t, buildID)
+	if info.BasedOn != baseID {
+		t.Fatalf("build is based on %s instead of %s", info.BasedOn, baseID)
+	}
+	if info.Params.String() != "param1" {
+		t.Fatalf("unexpected params: %s", info.Params)
+	}
+	if len(info.Boots) != 1 || info.Boots[0].Title != "title" {
+		t.Fatalf("unexpected boots: %v", info.Boots)
+	}
+	if info.Tags.String() != "test" {
+		t.Fatalf("unexpected tags: %s", info.Tags)
+	}
+	e.assertInitialized(t, baseKey)
+	e.assertExecuted(t, "echo test")
+}
+
+func TestBuildBuildsMissingParentFromSpecFile(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	e.specFiles["parent"] = []description.Command{
+		description.From(types.NewBuildKey("base", "1")),
+		description.Run("echo parent"),
+		description.Params("param1"),
+	}
+
+	buildID, err := e.builder(false).Build(ctx, "", child(types.NewBuildKey("parent", description.DefaultTag),
+		description.Run("echo child"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parentID := e.buildID(ctx, t, types.NewBuildKey("parent", description.DefaultTag))
+	info := e.info(ctx, t, buildID)
+	if info.BasedOn != parentID {
+		t.Fatalf("build is based on %s instead of %s", info.BasedOn, parentID)
+	}
+	if info.Params.String() != "param1" {
+		t.Fatalf("params are not inherited from parent: %s", info.Params)
+	}
+	e.assertInitialized(t, types.NewBuildKey("base", "1"))
+	e.assertExecuted(t, "echo parent", "echo child")
+}
+
+func TestBuildBuildsMissingParentFromRepository(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	parentKey := types.NewBuildKey("parent", "1")
+	e.repo.Store(description.Describe(parentKey.Name, types.Tags{parentKey.Tag},
+		description.From(types.NewBuildKey("base", "1")),
+		description.Run("echo parent"),
+	))
+	// Spec file must not be used because tag is not the default one.
+	e.specFiles["parent"] = []description.Command{
+		description.From(types.NewBuildKey("base", "2")),
+		description.Run("echo wrong parent"),
+	}
+
+	if _, err := e.builder(false).Build(ctx, "", child(parentKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	e.buildID(ctx, t, parentKey)
+	e.assertInitialized(t, types.NewBuildKey("base", "1"))
+	e.assertExecuted(t, "echo parent")
+}
+
+func TestBuildInitializesMissingBaseImage(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	baseKey := types.NewBuildKey("base", "1")
+	if _, err := e.builder(false).Build(ctx, "", child(baseKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	baseID := e.buildID(ctx, t, baseKey)
+	if info := e.info(ctx, t, baseID); info.BasedOn != "" {
+		t.Fatalf("base image is based on %s", info.BasedOn)
+	}
+	e.assertInitialized(t, baseKey)
+	e.assertExecuted(t)
+}
+
+func TestBuildRebuildsParentsOnce(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	baseKey := types.NewBuildKey("base", "1")
+	if _, err := e.builder(false).Build(ctx, "", child(baseKey)); err != nil {
+		t.Fatal(err)
+	}
+	oldBaseID := e.buildID(ctx, t, baseKey)
+
+	builder := e.builder(true)
+	child1, err := builder.Build(ctx, "", child(baseKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child2, err := builder.Build(ctx, "", child(baseKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newBaseID := e.buildID(ctx, t, baseKey)
+	if newBaseID == oldBaseID {
+		t.Fatal("base image has not been rebuilt")
+	}
+	if e.info(ctx, t, child1).BasedOn != newBaseID || e.info(ctx, t, child2).BasedOn != newBaseID {
+		t.Fatal("children are not based on rebuilt image")
+	}
+	if info := e.info(ctx, t, oldBaseID); len(info.Tags) != 0 {
+		t.Fatalf("tags have not been moved to rebuilt image: %s", info.Tags)
+	}
+	e.assertInitialized(t, baseKey, baseKey)
+}
+
+func TestBuildReusesCachedImage(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	baseKey := types.NewBuildKey("base", "1")
+	buildID1, err := e.builder(false).Build(ctx, "", child(baseKey, description.Run("echo test")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildID2, err := e.builder(false).Build(ctx, "", description.Describe("child", types.Tags{"test2"},
+		description.From(baseKey), description.Run("echo test")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buildID2 != buildID1 {
+		t.Fatal("cached image has not been reused")
+	}
+	if tags := e.info(ctx, t, buildID1).Tags.String(); tags != "test, test2" {
+		t.Fatalf("unexpected tags: %s", tags)
+	}
+	e.assertExecuted(t, "echo test")
+
+	buildID3, err := e.builder(false).Build(ctx, "", child(baseKey, description.Run("echo changed")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildID4, err := e.builderWithConfig(config.Build{NoCache: true}).Build(ctx, "",
+		child(baseKey, description.Run("echo test")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buildID3 == buildID1 || buildID4 == buildID1 || buildID4 == buildID3 {
+		t.Fatal("image has not been built")
+	}
+	e.assertExecuted(t, "echo test", "echo changed", "echo test")
+}
+
+func TestCacheKeyDependsOnSpecDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	parent := types.NewBuildID(types.BuildTypeImage)
+	commands := []description.Command{
+		description.From(types.NewBuildKey("base", "1")),
+		description.Run("cp /.specdir/file /etc/file"),
+	}
+	key := func(commands []description.Command) string {
+		key, err := computeCacheKey(parent, commands, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	keyMissing := key(commands)
+	if err := os.WriteFile("file", []byte("1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key1 := key(commands)
+	if err := os.WriteFile("file", []byte("2"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key2 := key(commands)
+	if keyMissing == key1 || key1 == key2 {
+		t.Fatal("key does not depend on referenced file")
+	}
+
+	// Files might be referenced indirectly, e.g. by script stored in spec directory.
+	if err := os.WriteFile("indirect", []byte("1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if key(commands) == key2 {
+		t.Fatal("key does not depend on spec directory")
+	}
+
+	noSpecDir := []description.Command{
+		description.From(types.NewBuildKey("base", "1")),
+		description.Run("echo test"),
+	}
+	key3 := key(noSpecDir)
+	if err := os.WriteFile("indirect", []byte("2"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if key(noSpecDir) != key3 {
+		t.Fatal("key depends on spec directory not used by commands")
+	}
+
+	otherParent, err := computeCacheKey(types.NewBuildID(types.BuildTypeImage), commands, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherParent == key(commands) {
+		t.Fatal("key does not depend on parent")
+	}
+}
+
+func TestBuildDetectsDependencyLoop(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	e.specFiles["a"] = []description.Command{description.From(types.NewBuildKey("b", description.DefaultTag))}
+	e.specFiles["b"] = []description.Command{description.From(types.NewBuildKey("a", description.DefaultTag))}
+
+	if _, err := e.builder(false).BuildFromFile(ctx, "", "a", "a"); err == nil {
+		t.Fatal("error expected")
+	}
+	builds, err := e.storage.Builds(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 0 {
+		t.Fatalf("%d builds left after failure", len(builds))
+	}
+}
+
+func TestBuildDropsBuildIfCommandFails(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	e.runner.Fail("false", "exit status 1")
+
+	baseKey := types.NewBuildKey("base", "1")
+	if _, err := e.builder(false).Build(ctx, "", child(baseKey, description.Run("false"))); err == nil {
+		t.Fatal("error expected")
+	}
+
+	builds, err := e.storage.Builds(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0] != e.buildID(ctx, t, baseKey) {
+		t.Fatal("failed build has not been dropped")
+	}
+}
+
+func TestBuildRejectsInvalidNames(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	if _, err := e.builder(false).Build(ctx, "", description.Describe("iidname", types.Tags{"1"})); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := e.builder(false).Build(ctx, "", child(types.NewBuildKey("base", "in valid"))); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestBuildRecordsProvenance(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	specFile := filepath.Join(t.TempDir(), "child")
+	if err := os.WriteFile(specFile, []byte("FROM base:1\nRUN echo test\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	baseKey := types.NewBuildKey("base", "1")
+	buildID, err := e.builder(false).Build(ctx, "", child(baseKey, description.Run("echo test")).
+		FromSpecFiles(specFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseID := e.buildID(ctx, t, baseKey)
+
+	provenance := e.info(ctx, t, buildID).Provenance
+	if provenance == nil {
+		t.Fatal("provenance has not been recorded")
+	}
+	expectedDigest := "sha256:203899247bb07a18d09270f79b0c8d72908c5d7be50043b23c1694ec5543588e"
+	if provenance.SpecFile == nil || provenance.SpecFile.Path != specFile {
+		t.Fatalf("unexpected spec file: %v", provenance.SpecFile)
+	}
+	if provenance.SpecFile.Digest != expectedDigest {
+		t.Fatalf("unexpected digest of spec file: %s", provenance.SpecFile.Digest)
+	}
+	if len(provenance.Parents) != 1 || provenance.Parents[0] != baseID {
+		t.Fatalf("unexpected parents: %v", provenance.Parents)
+	}
+	if provenance.BaseImage != "fake://base:1" {
+		t.Fatalf("unexpected base image: %s", provenance.BaseImage)
+	}
+	if len(provenance.Steps) != 2 || provenance.Steps[0].Command != "FROM base@1" ||
+		provenance.Steps[1].Command != "RUN echo test" {
+		t.Fatalf("unexpected steps: %v", provenance.Steps)
+	}
+	if provenance.Host == "" || provenance.FinishedAt.Before(provenance.StartedAt) {
+		t.Fatalf("unexpected provenance: %v", provenance)
+	}
+}
+
+func TestBuildCopiesFiles(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsideDir := t.TempDir()
+	contextDir := t.TempDir()
+	if err := os.Chdir(contextDir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	for file, content := range map[string]string{
+		"single":        "single",
+		"dir/a.txt":     "a",
+		"dir/sub/b.txt": "b",
+		"x.txt":         "x",
+		"y.txt":         "y",
+	} {
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outsideDir, "outside"); err != nil {
+		t.Fatal(err)
+	}
+
+	baseKey := types.NewBuildKey("base", "1")
+	if _, err := e.builder(false).Build(ctx, "", child(baseKey,
+		description.Copy([]string{"single"}, "/etc/renamed", "", 0o640),
+		description.Copy([]string{"dir"}, "/opt", "1000:1001", 0),
+		description.Copy([]string{"*.txt"}, "txt/", "", 0),
+		description.Run("true"),
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	executions := e.runner.Executions()
+	if len(executions) != 1 {
+		t.Fatalf("unexpected executions: %v", executions)
+	}
+	dir := executions[0].Dir
+	for file, content := range map[string]string{
+		"etc/renamed":   "single",
+		"opt/a.txt":     "a",
+		"opt/sub/b.txt": "b",
+		"txt/x.txt":     "x",
+		"txt/y.txt":     "y",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Fatalf("unexpected content of %s: %s", file, data)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "etc/renamed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Fatalf("unexpected mode: %s", info.Mode())
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if stat.Uid != 0 || stat.Gid != 0 {
+		t.Fatalf("unexpected owner: %d:%d", stat.Uid, stat.Gid)
+	}
+	info, err = os.Stat(filepath.Join(dir, "opt/sub/b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 1000 || stat.Gid != 1001 {
+		t.Fatalf("unexpected owner: %d:%d", stat.Uid, stat.Gid)
+	}
+
+	for _, source := range []string{"../single", "/etc/passwd", "outside", "missing*"} {
+		if _, err := e.builder(false).Build(ctx, "", child(baseKey,
+			description.Copy([]string{source}, "/dst", "", 0))); err == nil {
+			t.Fatalf("error expected for %s", source)
+		}
+	}
+}
+
+func TestBuildCopiesDirsIntoLinkedDirs(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.MkdirAll("links", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("usr/bin", "links/bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll("rootfs/bin", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("rootfs/bin/tool", []byte("tool"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes("rootfs/bin", modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.builder(false).Build(ctx, "", child(types.NewBuildKey("base", "1"),
+		description.Copy([]string{"links/"}, "/", "", 0),
+		description.Copy([]string{"rootfs/"}, "/", "", 0),
+		description.Run("true"),
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	executions := e.runner.Executions()
+	if len(executions) != 1 {
+		t.Fatalf("unexpected executions: %v", executions)
+	}
+	dir := executions[0].Dir
+
+	if link, err := os.Readlink(filepath.Join(dir, "bin")); err != nil || link != "usr/bin" {
+		t.Fatalf("symlink has been replaced: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "usr/bin/tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "tool" {
+		t.Fatalf("unexpected content: %s", data)
+	}
+	info, err := os.Stat(filepath.Join(dir, "usr/bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Fatalf("unexpected modification time: %s", info.ModTime())
+	}
+}
+
+func TestImagePathDoesNotLeaveRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "usr/lib"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"lib":    "usr/lib",
+		"escape": "/../../..",
+		"up":     "../../../etc",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, expected := range map[string]string{
+		"/lib/file":        "usr/lib/file",
+		"/escape/etc":      "etc",
+		"/up/passwd":       "etc/passwd",
+		"/../../etc":       "etc",
+		"/usr/lib/../file": "usr/file",
+	} {
+		resolved, err := imagePath(root, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved != filepath.Join(root, expected) {
+			t.Fatalf("path %s resolved to %s instead of %s", path, resolved, expected)
+		}
+	}
+}
+
+func TestBuildAppliesEnvToCommandsAndChildren(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	e.specFiles["parent"] = []description.Command{
+		description.From(types.NewBuildKey("base", "1")),
+		description.Env(map[string]string{"LANG": "C.UTF-8", "QUOTED": "it's"}),
+		description.Run("echo parent"),
+	}
+
+	buildID, err := e.builder(false).Build(ctx, "", child(types.NewBuildKey("parent", description.DefaultTag),
+		description.Env(map[string]string{"LANG": "en_US.UTF-8"}),
+		description.Run("echo child"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.assertExecuted(t, "echo parent", "echo child")
+	executions := e.runner.Executions()
+	if env := strings.Join(executions[0].Env, ", "); env != "LANG=C.UTF-8, QUOTED=it's" {
+		t.Fatalf("unexpected env of parent command: %s", env)
+	}
+	if env := strings.Join(executions[1].Env, ", "); env != "LANG=en_US.UTF-8, QUOTED=it's" {
+		t.Fatalf("unexpected env of child command: %s", env)
+	}
+	if env := e.info(ctx, t, buildID).Env.String(); env != "LANG=en_US.UTF-8, QUOTED=it's" {
+		t.Fatalf("unexpected env: %s", env)
+	}
+	parentID := e.buildID(ctx, t, types.NewBuildKey("parent", description.DefaultTag))
+	if env := e.info(ctx, t, parentID).Env.String(); env != "LANG=C.UTF-8, QUOTED=it's" {
+		t.Fatalf("unexpected env of parent: %s", env)
+	}
+
+	if _, err := e.builder(false).Build(ctx, "", child(types.NewBuildKey("base", "1"),
+		description.Env(map[string]string{"IN-VALID": "value"}),
+	)); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestBuildAppliesWorkDirAndUser(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	e.specFiles["parent"] = []description.Command{
+		description.From(types.NewBuildKey("base", "1")),
+		description.WorkDir("/opt"),
+		description.WorkDir("app"),
+		description.User("1000:1001"),
+		description.Run("echo parent"),
+	}
+
+	buildID, err := e.builder(false).Build(ctx, "", child(types.NewBuildKey("parent", description.DefaultTag),
+		description.Run("echo child"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executions := e.runner.Executions()
+	if len(executions) != 2 {
+		t.Fatalf("unexpected executions: %v", executions)
+	}
+	for _, execution := range executions {
+		if execution.WorkDir != "/opt/app" || execution.Credential == nil || execution.Credential.UID != 1000 ||
+			execution.Credential.GID != 1001 {
+			t.Fatalf("unexpected execution: %v", execution)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(executions[0].Dir, "opt/app")); err != nil {
+		t.Fatalf("working directory has not been created: %s", err)
+	}
+	info := e.info(ctx, t, buildID)
+	if info.WorkDir != "/opt/app" || info.User != "1000:1001" {
+		t.Fatalf("working directory or user are not inherited: %s, %s", info.WorkDir, info.User)
+	}
+
+	// Fake runner does not execute commands, so passwd file is created here.
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "etc/passwd"),
+		[]byte("root:x:0:0::/root:/bin/sh\napp:x:1002:1003::/home/app:/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	build := newImageBuild(types.BuildInfo{}, dir, nil, nil)
+	for user, expected := range map[string][2]int{
+		"app":      {1002, 1003},
+		"app:1004": {1002, 1004},
+		"1005":     {1005, 1005},
+	} {
+		uid, gid, err := build.owner(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid != expected[0] || gid != expected[1] {
+			t.Fatalf("user %s resolved to %d:%d", user, uid, gid)
+		}
+	}
+	if _, _, err := build.owner("missing"); err == nil {
+		t.Fatal("error expected")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "etc/group"),
+		[]byte("root:x:0:\nwheel:x:10:root,app\ndocker:x:20:app\nusers:x:100:other\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for user, expected := range map[string][]uint32{
+		"app":  {10, 20},
+		"1002": {10, 20},
+		"1005": nil,
+	} {
+		credential, err := build.credential(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(credential.Groups, expected) {
+			t.Fatalf("user %s has supplementary groups %v", user, credential.Groups)
+		}
+	}
+	if credential, err := build.credential(""); err != nil || credential != nil {
+		t.Fatalf("credential should not be set: %v, %v", credential, err)
+	}
+}
+
+func TestBuildRecordsArgs(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	e.specFiles["parent"] = []description.Command{
+		description.From(types.NewBuildKey("base", "1")),
+		description.Arg("VERSION", "1.0"),
+		description.Run("echo parent"),
+	}
+
+	buildID, err := e.builder(false).Build(ctx, "", child(types.NewBuildKey("parent", description.DefaultTag),
+		description.Arg("CHANNEL", "stable"),
+		description.Run("echo child"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if args := e.info(ctx, t, buildID).Args.String(); args != "CHANNEL=stable" {
+		t.Fatalf("unexpected args: %s", args)
+	}
+	parentID := e.buildID(ctx, t, types.NewBuildKey("parent", description.DefaultTag))
+	if args := e.info(ctx, t, parentID).Args.String(); args != "VERSION=1.0" {
+		t.Fatalf("unexpected args of parent: %s", args)
+	}
+}
+
+func TestBuildInheritsLabels(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	e.specFiles["parent"] = []description.Command{
+		description.From(types.NewBuildKey("base", "1")),
+		description.Label(map[string]string{"channel": "stable", "team": "core"}),
+	}
+
+	buildID, err := e.builder(false).Build(ctx, "", child(types.NewBuildKey("parent", description.DefaultTag),
+		description.Label(map[string]string{"channel": "testing"}),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if labels := e.info(ctx, t, buildID).Labels.String(); labels != "channel=testing, team=core" {
+		t.Fatalf("unexpected labels: %s", labels)
+	}
+	parentID := e.buildID(ctx, t, types.NewBuildKey("parent", description.DefaultTag))
+	if labels := e.info(ctx, t, parentID).Labels.String(); labels != "channel=stable, team=core" {
+		t.Fatalf("unexpected labels of parent: %s", labels)
+	}
+
+	if _, err := e.builder(false).Build(ctx, "", child(types.NewBuildKey("base", "1"),
+		description.Label(map[string]string{"-invalid": "value"}),
+	)); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestBuildBuildsStagesAndCopiesFilesBetweenThem(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := os.WriteFile("tool", []byte("tool"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	baseKey := types.NewBuildKey("base", "1")
+	e.specFiles["app"] = []description.Command{
+		description.FromStage(baseKey, "builder"),
+		description.Copy([]string{"tool"}, "/build/tool", "", 0o755),
+		description.FromStage(types.NewBuildKey("builder", ""), "tester"),
+		description.From(baseKey),
+		description.CopyFrom("builder", []string{"/build/tool"}, "/usr/bin/", "", 0),
+		description.Run("true"),
+	}
+
+	buildID, err := e.builder(false).BuildFromFile(ctx, "", "app", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executions := e.runner.Executions()
+	if len(executions) != 1 {
+		t.Fatalf("unexpected executions: %v", executions)
+	}
+	data, err := os.ReadFile(filepath.Join(executions[0].Dir, "usr/bin/tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "tool" {
+		t.Fatalf("unexpected content of copied file: %s", data)
+	}
+
+	builds, err := e.storage.Builds(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 {
+		t.Fatalf("stages have not been dropped: %v", builds)
+	}
+	if e.info(ctx, t, buildID).BasedOn != e.buildID(ctx, t, baseKey) {
+		t.Fatal("image is not based on base image")
+	}
+
+	// Stages are built again but the image is taken from cache.
+	buildID2, err := e.builderWithConfig(config.Build{KeepStages: true}).BuildFromFile(ctx, "", "app", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buildID2 != buildID || len(e.runner.Executions()) != 1 {
+		t.Fatal("image has not been taken from cache")
+	}
+	builderID := e.buildID(ctx, t, types.NewBuildKey("app-stage-builder", description.DefaultTag))
+	testerID := e.buildID(ctx, t, types.NewBuildKey("app-stage-tester", description.DefaultTag))
+	if e.info(ctx, t, testerID).BasedOn != builderID {
+		t.Fatal("stage is not based on the previous one")
+	}
+}
+
+func TestBuildCopiesFilesFromStageReferencedByIndex(t *testing.T) {
+	ctx := newContext()
+	e := newEnv(t)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := os.WriteFile("tool", []byte("tool"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	baseKey := types.NewBuildKey("base", "1")
+	e.specFiles["app"] = []description.Command{
+		description.FromStage(baseKey, "builder"),
+		description.Copy([]string{"tool"}, "/build/tool", "", 0o755),
+		description.From(baseKey),
+		description.CopyFrom("0", []string{"/build/tool"}, "/usr/bin/", "", 0),
+		description.Run("true"),
+	}
+
+	if _, err := e.builder(false).BuildFromFile(ctx, "", "app", "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	executions := e.runner.Executions()
+	if len(executions) != 1 {
+		t.Fatalf("unexpected executions: %v", executions)
+	}
+	data, err := os.ReadFile(filepath.Join(executions[0].Dir, "usr/bin/tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "tool" {
+		t.Fatalf("unexpected content of copied file: %s", data)
+	}
+}
@@ -0,0 +1,123 @@
+package infra
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/description"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// specDir is the path spec directory is mounted at inside the build.
+const specDir = "/.specdir"
+
+// computeCacheKey computes the key identifying image built from parent using commands.
+// Files copied into the image are taken into account too. Paths used by RUN commands can't be determined
+// reliably, so whole spec directory is hashed if any of them refers to it.
+// Images files are copied from by COPY commands are identified by their cache keys, if they are known.
+func computeCacheKey(
+	parent types.BuildID,
+	commands []description.Command,
+	stageCacheKeys map[string]string,
+) (string, error) {
+	hasher := sha256.New()
+	if _, err := fmt.Fprintf(hasher, "parent %s\n", parent); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	var files []string
+	for _, cmd := range commands {
+		if copyCommand, ok := cmd.(*description.CopyCommand); ok && copyCommand.From != "" {
+			if cacheKey, exists := stageCacheKeys[copyCommand.From]; exists {
+				copyCommand := *copyCommand
+				copyCommand.From = "cache:" + cacheKey
+				cmd = &copyCommand
+			}
+		}
+
+		cmdRaw, err := json.Marshal(cmd)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if _, err := fmt.Fprintf(hasher, "command %T %s\n", cmd, cmdRaw); err != nil {
+			return "", errors.WithStack(err)
+		}
+		switch cmd := cmd.(type) {
+		case *description.RunCommand:
+			if strings.Contains(cmd.Command, specDir) {
+				files = append(files, ".")
+			}
+		case *description.CopyCommand:
+			// Files copied from other build are identified by the build being part of the command.
+			if cmd.From != "" {
+				continue
+			}
+			copied, err := contextFiles(cmd.Sources)
+			if err != nil {
+				return "", err
+			}
+			files = append(files, copied...)
+		}
+	}
+
+	slices.Sort(files)
+	for _, file := range slices.Compact(files) {
+		if err := hashFiles(hasher, file); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashFiles writes names, modes and content of files stored under path to the hasher.
+func hashFiles(hasher hash.Hash, path string) error {
+	if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+		_, err := fmt.Fprintf(hasher, "missing %s\n", path)
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(hasher, "file %s %s %d\n", path, info.Mode(), info.Size()); err != nil {
+			return err
+		}
+
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(hasher, "target %s\n", target)
+			return err
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(hasher, f)
+			return err
+		default:
+			return nil
+		}
+	}))
+}
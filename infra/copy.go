@@ -0,0 +1,447 @@
+package infra
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/description"
+	"github.com/outofforest/osman/infra/runner"
+)
+
+// maxSymlinks is the maximum number of symlinks followed while resolving path inside the image.
+const maxSymlinks = 255
+
+// Copy is a handler for COPY.
+func (b *imageBuild) Copy(ctx context.Context, cmd *description.CopyCommand) error {
+	sources, err := b.sources(cmd)
+	if err != nil {
+		return err
+	}
+	uid, gid, err := b.owner(cmd.Chown)
+	if err != nil {
+		return err
+	}
+
+	destination := filepath.Join("/", b.manifest.WorkDir, cmd.Destination)
+	if filepath.IsAbs(cmd.Destination) {
+		destination = filepath.Clean(cmd.Destination)
+	}
+	toDir := strings.HasSuffix(cmd.Destination, "/") || len(sources) > 1
+	if !toDir {
+		destinationPath, err := imagePath(b.dir, destination)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(destinationPath)
+		toDir = err == nil && info.IsDir()
+	}
+
+	for _, source := range sources {
+		info, err := os.Stat(source)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		target := destination
+		if toDir && !info.IsDir() {
+			target = filepath.Join(destination, filepath.Base(source))
+		}
+
+		var dirs []copiedDir
+		err = filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			relPath, err := filepath.Rel(source, path)
+			if err != nil {
+				return err
+			}
+			dir, err := b.copyEntry(path, filepath.Join(target, relPath), uid, gid, cmd.Chmod)
+			if err != nil || dir.path == "" {
+				return err
+			}
+			dirs = append(dirs, dir)
+			return nil
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// Times of directories are set once their content is copied, otherwise it would be updated by the copy.
+		for _, dir := range dirs {
+			if err := os.Chtimes(dir.path, dir.modTime, dir.modTime); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+// copiedDir is the directory created by COPY.
+type copiedDir struct {
+	path    string
+	modTime time.Time
+}
+
+// sources returns paths of files copied by the command. They are taken from the build context or from
+// the build produced by the stage if command copies files from it.
+func (b *imageBuild) sources(cmd *description.CopyCommand) ([]string, error) {
+	if cmd.From == "" {
+		return contextFiles(cmd.Sources)
+	}
+
+	root, exists := b.stages[cmd.From]
+	if !exists {
+		return nil, errors.Errorf("stage %s is not mounted", cmd.From)
+	}
+	sources := make([]string, 0, len(cmd.Sources))
+	for _, source := range cmd.Sources {
+		path, err := imagePath(root, source)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Lstat(path); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		sources = append(sources, path)
+	}
+	return sources, nil
+}
+
+// copyEntry copies single file or directory from the build context to the path inside the image. Existing
+// directories are preserved, also when they are referenced by symlinks (e.g. /bin -> usr/bin), other files
+// are replaced. Directory created by the function is returned, so its times might be set after its content
+// is copied.
+func (b *imageBuild) copyEntry(src, dst string, uid, gid int, chmod uint32) (copiedDir, error) {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return copiedDir{}, err
+	}
+
+	var target string
+	if info.IsDir() {
+		target, err = imagePath(b.dir, dst)
+	} else {
+		target, err = imagePath(b.dir, filepath.Dir(dst))
+		target = filepath.Join(target, filepath.Base(dst))
+	}
+	if err != nil {
+		return copiedDir{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return copiedDir{}, err
+	}
+
+	targetInfo, err := os.Lstat(target)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return copiedDir{}, err
+	case info.IsDir() && targetInfo.IsDir():
+		return copiedDir{}, nil
+	case targetInfo.IsDir():
+		return copiedDir{}, errors.Errorf("directory %s can't be replaced by a file", dst)
+	default:
+		if err := os.Remove(target); err != nil {
+			return copiedDir{}, err
+		}
+	}
+
+	var dir copiedDir
+	switch {
+	case info.IsDir():
+		if err := os.Mkdir(target, 0o700); err != nil {
+			return copiedDir{}, err
+		}
+		dir = copiedDir{path: target, modTime: info.ModTime()}
+	case info.Mode().IsRegular():
+		if err := copyFile(src, target); err != nil {
+			return copiedDir{}, err
+		}
+	case info.Mode()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return copiedDir{}, err
+		}
+		if err := os.Symlink(link, target); err != nil {
+			return copiedDir{}, err
+		}
+		return copiedDir{}, os.Lchown(target, uid, gid)
+	default:
+		return copiedDir{}, errors.Errorf("file %s has unsupported type", src)
+	}
+
+	if err := os.Lchown(target, uid, gid); err != nil {
+		return copiedDir{}, err
+	}
+	mode := chmod
+	if mode == 0 {
+		mode = info.Sys().(*syscall.Stat_t).Mode & 0o7777
+	}
+	// Chmod is called after chown, because chown clears setuid and setgid bits.
+	if err := syscall.Chmod(target, mode); err != nil {
+		return copiedDir{}, err
+	}
+	if dir.path != "" {
+		return dir, nil
+	}
+	return copiedDir{}, os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+	return dstFile.Close()
+}
+
+// owner returns IDs of the user and group specified in the form of user[:group]. Names are resolved using
+// /etc/passwd and /etc/group of the image. If group is not specified, primary group of the user is used.
+func (b *imageBuild) owner(chown string) (int, int, error) {
+	if chown == "" {
+		return 0, 0, nil
+	}
+
+	user, group, groupSet := strings.Cut(chown, ":")
+	uid, err := strconv.Atoi(user)
+	gid := uid
+	if err != nil {
+		entry, err := b.lookup("/etc/passwd", user)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(entry[2]); err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid ID of user %s", user)
+		}
+		if gid, err = strconv.Atoi(entry[3]); err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid primary group of user %s", user)
+		}
+	}
+	if !groupSet {
+		return uid, gid, nil
+	}
+
+	if gid, err = strconv.Atoi(group); err != nil {
+		entry, err := b.lookup("/etc/group", group)
+		if err != nil {
+			return 0, 0, err
+		}
+		if gid, err = strconv.Atoi(entry[2]); err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid ID of group %s", group)
+		}
+	}
+	return uid, gid, nil
+}
+
+// credential returns credential of the user specified in the form of user[:group], nil is returned if user is not
+// specified. Supplementary groups are the groups listing the user as their member in /etc/group of the image.
+func (b *imageBuild) credential(chown string) (*runner.Credential, error) {
+	if chown == "" {
+		return nil, nil
+	}
+
+	uid, gid, err := b.owner(chown)
+	if err != nil {
+		return nil, err
+	}
+	credential := &runner.Credential{UID: uint32(uid), GID: uint32(gid)}
+
+	user, _, _ := strings.Cut(chown, ":")
+	if _, err := strconv.Atoi(user); err == nil {
+		// User specified by ID might not exist in the image, it has no supplementary groups then.
+		passwd, err := b.entries("/etc/passwd")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		user = ""
+		for _, entry := range passwd {
+			if entry[2] == strconv.Itoa(uid) {
+				user = entry[0]
+				break
+			}
+		}
+		if user == "" {
+			return credential, nil
+		}
+	}
+
+	groups, err := b.entries("/etc/group")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return credential, nil
+		}
+		return nil, err
+	}
+	for _, entry := range groups {
+		for _, member := range strings.Split(entry[3], ",") {
+			if member != user {
+				continue
+			}
+			groupID, err := strconv.Atoi(entry[2])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid ID of group %s", entry[0])
+			}
+			credential.Groups = append(credential.Groups, uint32(groupID))
+			break
+		}
+	}
+	return credential, nil
+}
+
+// lookup returns fields of the entry of the file in the image, file must use the format of /etc/passwd.
+func (b *imageBuild) lookup(file, name string) ([]string, error) {
+	entries, err := b.entries(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, fields := range entries {
+		if fields[0] == name {
+			return fields, nil
+		}
+	}
+	return nil, errors.Errorf("%s does not exist in %s", name, file)
+}
+
+// entries returns fields of all the entries of the file in the image, file must use the format of /etc/passwd.
+func (b *imageBuild) entries(file string) ([][]string, error) {
+	path, err := imagePath(b.dir, file)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Split(scanner.Text(), ":"); len(fields) >= 4 {
+			entries = append(entries, fields)
+		}
+	}
+	return entries, errors.WithStack(scanner.Err())
+}
+
+// contextFiles returns paths of files matching patterns, relative to the build context being the directory of spec
+// file. Symlinks are resolved and files outside the build context are rejected.
+func contextFiles(patterns []string) ([]string, error) {
+	contextDir, err := filepath.Abs(".")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	contextDir, err = filepath.EvalSymlinks(contextDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var files []string
+	for _, pattern := range patterns {
+		cleaned := filepath.Clean(pattern)
+		if filepath.IsAbs(cleaned) || isOutside(cleaned) {
+			return nil, errors.Errorf("path %s is outside of the build context", pattern)
+		}
+		matches, err := filepath.Glob(cleaned)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %s", pattern)
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("no files match %s", pattern)
+		}
+		for _, match := range matches {
+			realPath, err := filepath.EvalSymlinks(match)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			realPath, err = filepath.Abs(realPath)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			relPath, err := filepath.Rel(contextDir, realPath)
+			if err != nil || isOutside(relPath) {
+				return nil, errors.Errorf("path %s is outside of the build context", match)
+			}
+			files = append(files, relPath)
+		}
+	}
+	return files, nil
+}
+
+func isOutside(relPath string) bool {
+	return relPath == ".." || strings.HasPrefix(relPath, "../")
+}
+
+// imagePath returns path on the host of the path inside the image rooted at root. Symlinks are resolved as if
+// root was the root of the filesystem, so returned path never points outside the image. Components which
+// don't exist are kept as they are.
+func imagePath(root, path string) (string, error) {
+	resolved := "/"
+	remaining := path
+	var links int
+	for remaining != "" {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			resolved = next
+			continue
+		case err != nil:
+			return "", errors.WithStack(err)
+		case info.Mode()&fs.ModeSymlink == 0:
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", errors.Errorf("too many levels of symbolic links in %s", path)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		remaining = link + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
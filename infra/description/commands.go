@@ -2,6 +2,10 @@ package description
 
 import (
 	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 
@@ -13,8 +17,17 @@ var (
 	_ Command = &ParamsCommand{}
 	_ Command = &RunCommand{}
 	_ Command = &BootCommand{}
+	_ Command = &CopyCommand{}
+	_ Command = &EnvCommand{}
+	_ Command = &WorkDirCommand{}
+	_ Command = &UserCommand{}
+	_ Command = &ArgCommand{}
+	_ Command = &LabelCommand{}
 )
 
+// envNameRegExp matches valid names of environment variables.
+var envNameRegExp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
 // From returns handler for FROM command.
 func From(buildKey types.BuildKey) Command {
 	if buildKey.Tag == "" {
@@ -25,6 +38,13 @@ func From(buildKey types.BuildKey) Command {
 	}
 }
 
+// FromStage returns handler for FROM command starting named stage of multi-stage build.
+func FromStage(buildKey types.BuildKey, stage string) Command {
+	cmd := From(buildKey).(*FromCommand)
+	cmd.Stage = stage
+	return cmd
+}
+
 // Params returns handler for PARAMS command.
 func Params(params ...string) Command {
 	return &ParamsCommand{
@@ -47,9 +67,65 @@ func Boot(title string, params []string) Command {
 	}
 }
 
+// Copy returns handler for COPY command.
+func Copy(sources []string, destination, chown string, chmod uint32) Command {
+	return &CopyCommand{
+		Sources:     sources,
+		Destination: destination,
+		Chown:       chown,
+		Chmod:       chmod,
+	}
+}
+
+// CopyFrom returns handler for COPY command copying files from the image built by the stage.
+func CopyFrom(stage string, sources []string, destination, chown string, chmod uint32) Command {
+	cmd := Copy(sources, destination, chown, chmod).(*CopyCommand)
+	cmd.From = stage
+	return cmd
+}
+
+// Env returns handler for ENV command.
+func Env(vars map[string]string) Command {
+	return &EnvCommand{
+		Vars: vars,
+	}
+}
+
+// WorkDir returns handler for WORKDIR command.
+func WorkDir(path string) Command {
+	return &WorkDirCommand{
+		Path: path,
+	}
+}
+
+// User returns handler for USER command.
+func User(user string) Command {
+	return &UserCommand{
+		User: user,
+	}
+}
+
+// Arg returns handler for ARG command.
+func Arg(name, value string) Command {
+	return &ArgCommand{
+		Name:  name,
+		Value: value,
+	}
+}
+
+// Label returns handler for LABEL command.
+func Label(labels map[string]string) Command {
+	return &LabelCommand{
+		Labels: labels,
+	}
+}
+
 // FromCommand executes FROM command.
 type FromCommand struct {
 	BuildKey types.BuildKey
+
+	// Stage is the name of the stage started by the command in multi-stage build.
+	Stage string `json:",omitempty"`
 }
 
 // Execute executes build command.
@@ -57,6 +133,13 @@ func (cmd *FromCommand) Execute(ctx context.Context, build ImageBuild) error {
 	return errors.New("this should not be called")
 }
 
+func (cmd *FromCommand) String() string {
+	if cmd.Stage != "" {
+		return "FROM " + cmd.BuildKey.String() + " AS " + cmd.Stage
+	}
+	return "FROM " + cmd.BuildKey.String()
+}
+
 // ParamsCommand executes PARAMS command.
 type ParamsCommand struct {
 	Params []string
@@ -68,6 +151,10 @@ func (cmd *ParamsCommand) Execute(ctx context.Context, build ImageBuild) error {
 	return nil
 }
 
+func (cmd *ParamsCommand) String() string {
+	return "PARAMS " + strings.Join(cmd.Params, " ")
+}
+
 // RunCommand executes RUN command.
 type RunCommand struct {
 	Command string
@@ -78,6 +165,10 @@ func (cmd *RunCommand) Execute(ctx context.Context, build ImageBuild) error {
 	return build.Run(ctx, cmd)
 }
 
+func (cmd *RunCommand) String() string {
+	return "RUN " + cmd.Command
+}
+
 // BootCommand executes BOOT command.
 type BootCommand struct {
 	Title  string
@@ -89,3 +180,147 @@ func (cmd *BootCommand) Execute(ctx context.Context, build ImageBuild) error {
 	build.Boot(cmd)
 	return nil
 }
+
+func (cmd *BootCommand) String() string {
+	return strings.TrimSpace("BOOT " + cmd.Title + " " + strings.Join(cmd.Params, " "))
+}
+
+// CopyCommand executes COPY command.
+type CopyCommand struct {
+	// Sources are the glob patterns of files to copy, relative to the directory of spec file.
+	Sources []string
+
+	// Destination is the path inside the image files are copied to. If it ends with slash, or more
+	// files are copied, it is a directory. Relative path is resolved against the working directory.
+	Destination string
+
+	// Chown is the owner of copied files in the form of user[:group], root is used if it is empty.
+	Chown string
+
+	// Chmod is the mode set on copied files, modes of source files are preserved if it is zero.
+	Chmod uint32
+
+	// From is the stage files are copied from, spec file parser sets it to the name of the stage and
+	// builder replaces it with the ID of the build produced by the stage. If it is set, sources are the paths
+	// inside that build.
+	From string `json:",omitempty"`
+}
+
+// Execute executes build command.
+func (cmd *CopyCommand) Execute(ctx context.Context, build ImageBuild) error {
+	return build.Copy(ctx, cmd)
+}
+
+func (cmd *CopyCommand) String() string {
+	args := []string{"COPY"}
+	if cmd.From != "" {
+		args = append(args, "--from="+cmd.From)
+	}
+	if cmd.Chown != "" {
+		args = append(args, "--chown="+cmd.Chown)
+	}
+	if cmd.Chmod != 0 {
+		args = append(args, fmt.Sprintf("--chmod=%04o", cmd.Chmod))
+	}
+	return strings.Join(append(append(args, cmd.Sources...), cmd.Destination), " ")
+}
+
+// EnvCommand executes ENV command.
+type EnvCommand struct {
+	Vars map[string]string
+}
+
+// Execute executes build command.
+func (cmd *EnvCommand) Execute(ctx context.Context, build ImageBuild) error {
+	return build.Env(cmd)
+}
+
+func (cmd *EnvCommand) String() string {
+	pairs := make([]string, 0, len(cmd.Vars))
+	for name, value := range cmd.Vars {
+		pairs = append(pairs, name+"="+quote(value))
+	}
+	sort.Strings(pairs)
+	return "ENV " + strings.Join(pairs, " ")
+}
+
+// WorkDirCommand executes WORKDIR command.
+type WorkDirCommand struct {
+	// Path is the working directory, relative path is resolved against the current working directory.
+	Path string
+}
+
+// Execute executes build command.
+func (cmd *WorkDirCommand) Execute(ctx context.Context, build ImageBuild) error {
+	return build.WorkDir(cmd)
+}
+
+func (cmd *WorkDirCommand) String() string {
+	return "WORKDIR " + cmd.Path
+}
+
+// UserCommand executes USER command.
+type UserCommand struct {
+	// User is the user in the form of user[:group], names are resolved using files of the image.
+	User string
+}
+
+// Execute executes build command.
+func (cmd *UserCommand) Execute(ctx context.Context, build ImageBuild) error {
+	build.User(cmd)
+	return nil
+}
+
+func (cmd *UserCommand) String() string {
+	return "USER " + cmd.User
+}
+
+// ArgCommand executes ARG command.
+type ArgCommand struct {
+	Name string
+
+	// Value is the resolved value of the argument, taken from build args or the default one.
+	Value string
+}
+
+// Execute executes build command.
+func (cmd *ArgCommand) Execute(ctx context.Context, build ImageBuild) error {
+	build.Arg(cmd)
+	return nil
+}
+
+func (cmd *ArgCommand) String() string {
+	return "ARG " + cmd.Name + "=" + quote(cmd.Value)
+}
+
+// LabelCommand executes LABEL command.
+type LabelCommand struct {
+	Labels map[string]string
+}
+
+// Execute executes build command.
+func (cmd *LabelCommand) Execute(ctx context.Context, build ImageBuild) error {
+	return build.Label(cmd)
+}
+
+func (cmd *LabelCommand) String() string {
+	pairs := make([]string, 0, len(cmd.Labels))
+	for key, value := range cmd.Labels {
+		pairs = append(pairs, key+"="+quote(value))
+	}
+	sort.Strings(pairs)
+	return "LABEL " + strings.Join(pairs, " ")
+}
+
+// IsEnvNameValid returns true if name of environment variable is valid.
+func IsEnvNameValid(name string) bool {
+	return envNameRegExp.MatchString(name)
+}
+
+// quote quotes the value using double quotes if it contains characters interpreted by the parser.
+func quote(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\n\"'\\") {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -15,9 +15,17 @@ func Describe(name string, tags types.Tags, commands ...Command) *Descriptor {
 
 // Descriptor describes future image.
 type Descriptor struct {
-	name     string
-	tags     types.Tags
-	commands []Command
+	name      string
+	tags      types.Tags
+	commands  []Command
+	specFiles []string
+}
+
+// FromSpecFiles records spec files image is described by. The first one is the main spec file,
+// the others are the files included by it.
+func (d *Descriptor) FromSpecFiles(specFiles ...string) *Descriptor {
+	d.specFiles = specFiles
+	return d
 }
 
 // Name returns name of the image.
@@ -34,3 +42,8 @@ func (d *Descriptor) Tags() types.Tags {
 func (d *Descriptor) Commands() []Command {
 	return d.commands
 }
+
+// SpecFiles returns spec files image is described by.
+func (d *Descriptor) SpecFiles() []string {
+	return d.specFiles
+}
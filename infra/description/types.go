@@ -13,6 +13,9 @@ const DefaultTag types.Tag = "latest"
 type Command interface {
 	// Execute executes build command.
 	Execute(ctx context.Context, build ImageBuild) error
+
+	// String returns the command in the form used in spec file.
+	String() string
 }
 
 // ImageBuild represents build in progress.
@@ -25,4 +28,22 @@ type ImageBuild interface {
 
 	// Boot executes BOOT command.
 	Boot(cmd *BootCommand)
+
+	// Env executes ENV command.
+	Env(cmd *EnvCommand) error
+
+	// WorkDir executes WORKDIR command.
+	WorkDir(cmd *WorkDirCommand) error
+
+	// User executes USER command.
+	User(cmd *UserCommand)
+
+	// Arg executes ARG command.
+	Arg(cmd *ArgCommand)
+
+	// Label executes LABEL command.
+	Label(cmd *LabelCommand) error
+
+	// Copy executes COPY command.
+	Copy(ctx context.Context, cmd *CopyCommand) error
 }
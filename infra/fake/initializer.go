@@ -0,0 +1,44 @@
+package fake
+
+import (
+	"context"
+	"sync"
+
+	"github.com/outofforest/osman/infra/base"
+	"github.com/outofforest/osman/infra/types"
+)
+
+var _ base.Initializer = &Initializer{}
+
+// NewInitializer returns fake initializer recording requested base images instead of fetching them.
+func NewInitializer() *Initializer {
+	return &Initializer{}
+}
+
+// Initializer is the fake initializer of base images.
+type Initializer struct {
+	mu        sync.Mutex
+	buildKeys []types.BuildKey
+}
+
+// Init records build key of requested base image.
+func (i *Initializer) Init(ctx context.Context, cacheDir, dir string, buildKey types.BuildKey) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.buildKeys = append(i.buildKeys, buildKey)
+	return nil
+}
+
+// Source returns fake reference of the base image.
+func (i *Initializer) Source(cacheDir string, buildKey types.BuildKey) (string, error) {
+	return "fake://" + buildKey.Name + ":" + string(buildKey.Tag), nil
+}
+
+// Initialized returns build keys of base images requested so far.
+func (i *Initializer) Initialized() []types.BuildKey {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return append([]types.BuildKey{}, i.buildKeys...)
+}
@@ -0,0 +1,112 @@
+package fake
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/isolator"
+	"github.com/outofforest/isolator/wire"
+	"github.com/outofforest/osman/infra/runner"
+	"github.com/outofforest/parallel"
+)
+
+var _ runner.Runner = &Runner{}
+
+// NewRunner returns fake runner recording commands instead of executing them.
+func NewRunner() *Runner {
+	return &Runner{
+		failures: map[string]string{},
+	}
+}
+
+// Execution is the command received by the fake runner.
+type Execution struct {
+	// Dir is the directory command was executed in.
+	Dir string
+
+	// Command is the executed command.
+	Command string
+
+	// Env, WorkDir and Credential are the environment, working directory and credentials of the command.
+	Env        []string
+	WorkDir    string
+	Credential *runner.Credential
+}
+
+// Runner is the fake runner of build commands.
+type Runner struct {
+	mu         sync.Mutex
+	executions []Execution
+	failures   map[string]string
+}
+
+// Fail configures runner to report error whenever command is executed.
+func (r *Runner) Fail(command, errMsg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failures[command] = errMsg
+}
+
+// Executions returns commands executed so far.
+func (r *Runner) Executions() []Execution {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Execution{}, r.executions...)
+}
+
+// Run runs client function and responds to its messages the same way executor does.
+func (r *Runner) Run(ctx context.Context, dir string, clientFunc isolator.ClientFunc) error {
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		incoming := make(chan interface{})
+		outgoing := make(chan interface{})
+
+		spawn("client", parallel.Exit, func(ctx context.Context) error {
+			return clientFunc(ctx, incoming, outgoing)
+		})
+		spawn("executor", parallel.Fail, func(ctx context.Context) error {
+			for {
+				var msg interface{}
+				select {
+				case <-ctx.Done():
+					return errors.WithStack(ctx.Err())
+				case msg = <-outgoing:
+				}
+
+				result, err := r.handle(dir, msg)
+				if err != nil {
+					return err
+				}
+
+				select {
+				case <-ctx.Done():
+					return errors.WithStack(ctx.Err())
+				case incoming <- result:
+				}
+			}
+		})
+		return nil
+	})
+}
+
+func (r *Runner) handle(dir string, msg interface{}) (wire.Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := msg.(runner.Execute)
+	if !ok {
+		return wire.Result{}, errors.Errorf("unexpected message %T", msg)
+	}
+
+	r.executions = append(r.executions, Execution{
+		Dir:        dir,
+		Command:    m.Command,
+		Env:        m.Env,
+		WorkDir:    m.WorkDir,
+		Credential: m.Credential,
+	})
+	return wire.Result{Error: r.failures[m.Command]}, nil
+}
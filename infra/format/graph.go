@@ -0,0 +1,102 @@
+package format
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GraphNode is implemented by elements which might be formatted as nodes of a graph.
+type GraphNode interface {
+	// NodeID returns ID of the node.
+	NodeID() string
+
+	// ParentID returns ID of the parent node, empty if node has no parent.
+	ParentID() string
+
+	// NodeLabel returns label of the node.
+	NodeLabel() string
+}
+
+// NewDotFormatter returns formatter converting slice of graph nodes into graph described in DOT language.
+func NewDotFormatter() Formatter {
+	return &dotFormatter{}
+}
+
+type dotFormatter struct {
+}
+
+// Format formats slice of graph nodes into DOT graph. Edges point from parents to children. Fields are ignored,
+// nodes are described by their labels.
+func (f *dotFormatter) Format(slice interface{}, fieldsToPrint ...string) string {
+	nodes, exists := graphNodes(slice)
+
+	res := "digraph {\n"
+	for _, node := range nodes {
+		res += fmt.Sprintf("  %q [label=%q];\n", node.NodeID(), node.NodeLabel())
+	}
+	for _, node := range nodes {
+		if parentID := node.ParentID(); exists[parentID] {
+			res += fmt.Sprintf("  %q -> %q;\n", parentID, node.NodeID())
+		}
+	}
+	return res + "}"
+}
+
+// Tree formats slice of graph nodes as a forest. Nodes whose parents are not in the slice are roots.
+// Order of nodes in the slice is preserved.
+func Tree(slice interface{}) string {
+	nodes, exists := graphNodes(slice)
+
+	var roots []GraphNode
+	children := map[string][]GraphNode{}
+	for _, node := range nodes {
+		if parentID := node.ParentID(); exists[parentID] {
+			children[parentID] = append(children[parentID], node)
+			continue
+		}
+		roots = append(roots, node)
+	}
+
+	sb := &strings.Builder{}
+	var printNodes func(nodes []GraphNode, prefix string)
+	printNodes = func(nodes []GraphNode, prefix string) {
+		for i, node := range nodes {
+			branch, indent := "├── ", "│   "
+			if i == len(nodes)-1 {
+				branch, indent = "└── ", "    "
+			}
+			sb.WriteString(prefix + branch + node.NodeLabel() + "\n")
+			printNodes(children[node.NodeID()], prefix+indent)
+		}
+	}
+	for _, root := range roots {
+		sb.WriteString(root.NodeLabel() + "\n")
+		printNodes(children[root.NodeID()], "")
+	}
+
+	// Remove last new line.
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// graphNodes returns elements of the slice as graph nodes and the set of their IDs.
+func graphNodes(slice interface{}) ([]GraphNode, map[string]bool) {
+	sliceValue := reflect.ValueOf(slice)
+	if sliceValue.Kind() != reflect.Slice {
+		panic(errors.Errorf("%s is not a slice of graph nodes", sliceValue.Type()))
+	}
+
+	nodes := make([]GraphNode, 0, sliceValue.Len())
+	exists := map[string]bool{}
+	for i := range sliceValue.Len() {
+		node, ok := sliceValue.Index(i).Interface().(GraphNode)
+		if !ok {
+			panic(errors.Errorf("%s is not a graph node", sliceValue.Type().Elem()))
+		}
+		nodes = append(nodes, node)
+		exists[node.NodeID()] = true
+	}
+	return nodes, exists
+}
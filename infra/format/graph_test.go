@@ -0,0 +1,55 @@
+package format
+
+import "testing"
+
+type node struct {
+	ID     string
+	Parent string
+}
+
+func (n node) NodeID() string {
+	return n.ID
+}
+
+func (n node) ParentID() string {
+	return n.Parent
+}
+
+func (n node) NodeLabel() string {
+	return "node " + n.ID
+}
+
+var graph = []node{
+	{ID: "a"},
+	{ID: "b", Parent: "a"},
+	{ID: "c", Parent: "b"},
+	{ID: "d", Parent: "a"},
+	{ID: "e", Parent: "missing"},
+}
+
+func TestTree(t *testing.T) {
+	expected := "node a\n" +
+		"├── node b\n" +
+		"│   └── node c\n" +
+		"└── node d\n" +
+		"node e"
+	if tree := Tree(graph); tree != expected {
+		t.Fatalf("unexpected tree:\n%s", tree)
+	}
+}
+
+func TestDotFormatter(t *testing.T) {
+	expected := "digraph {\n" +
+		"  \"a\" [label=\"node a\"];\n" +
+		"  \"b\" [label=\"node b\"];\n" +
+		"  \"c\" [label=\"node c\"];\n" +
+		"  \"d\" [label=\"node d\"];\n" +
+		"  \"e\" [label=\"node e\"];\n" +
+		"  \"a\" -> \"b\";\n" +
+		"  \"b\" -> \"c\";\n" +
+		"  \"a\" -> \"d\";\n" +
+		"}"
+	if dot := NewDotFormatter().Format(graph); dot != expected {
+		t.Fatalf("unexpected graph:\n%s", dot)
+	}
+}
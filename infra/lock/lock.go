@@ -0,0 +1,204 @@
+package lock
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/outofforest/logger"
+	"github.com/outofforest/osman/config"
+)
+
+// pollInterval is the interval between attempts to acquire the lock held by another process.
+const pollInterval = 100 * time.Millisecond
+
+// Mode is the mode of the lock.
+type Mode int
+
+const (
+	// Shared lock may be held by many processes at the same time. It is used by operations reading the state.
+	Shared Mode = iota
+
+	// Exclusive lock is held by one process only. It is used by operations modifying the state.
+	Exclusive
+)
+
+// UnlockFn releases the lock.
+type UnlockFn func() error
+
+// NewManager returns new lock manager.
+func NewManager(config config.Lock) *Manager {
+	return &Manager{config: config}
+}
+
+// Manager acquires locks protecting state shared by osman processes.
+type Manager struct {
+	config config.Lock
+}
+
+// StorageLock specifies storage root to lock and the mode of the lock.
+type StorageLock struct {
+	Storage config.Storage
+	Mode    Mode
+}
+
+// Storage locks storage root.
+func (m *Manager) Storage(ctx context.Context, storage config.Storage, mode Mode) (UnlockFn, error) {
+	return m.lock(ctx, storageLockName(storage), mode)
+}
+
+// Storages locks many storage roots. Locks are acquired in the order of their names, so processes locking
+// the same storages never wait for each other in a cycle. Storage requested more than once is locked once,
+// using the strongest mode.
+func (m *Manager) Storages(ctx context.Context, storages ...StorageLock) (retUnlock UnlockFn, retErr error) {
+	modes := map[string]Mode{}
+	for _, s := range storages {
+		name := storageLockName(s.Storage)
+		if mode, exists := modes[name]; !exists || mode < s.Mode {
+			modes[name] = s.Mode
+		}
+	}
+
+	unlocks := make([]UnlockFn, 0, len(modes))
+	unlockAll := func() error {
+		var err error
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			if err2 := unlocks[i](); err == nil {
+				err = err2
+			}
+		}
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = unlockAll()
+		}
+	}()
+
+	for _, name := range slices.Sorted(maps.Keys(modes)) {
+		unlock, err := m.lock(ctx, name, modes[name])
+		if err != nil {
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
+
+// Builds locks images being built in storage root. Processes building images hold it in shared mode while
+// storage itself is locked only when it is modified, so gc holding it in exclusive mode doesn't drop images
+// which are not tagged yet.
+func (m *Manager) Builds(ctx context.Context, storage config.Storage, mode Mode) (UnlockFn, error) {
+	return m.lock(ctx, "builds-"+storageID(storage), mode)
+}
+
+// Network locks state of the network used by VMs.
+func (m *Manager) Network(ctx context.Context) (UnlockFn, error) {
+	return m.lock(ctx, "network", Exclusive)
+}
+
+func (m *Manager) lock(ctx context.Context, name string, mode Mode) (UnlockFn, error) {
+	if err := os.MkdirAll(m.config.Dir, 0o755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	f, err := os.OpenFile(filepath.Join(m.config.Dir, name+".lock"), os.O_RDONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	how := unix.LOCK_SH
+	if mode == Exclusive {
+		how = unix.LOCK_EX
+	}
+
+	var timeout <-chan time.Time
+	if m.config.Timeout > 0 {
+		timer := time.NewTimer(m.config.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for waiting := false; ; waiting = true {
+		err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			return func() error {
+				defer f.Close()
+				return errors.WithStack(unix.Flock(int(f.Fd()), unix.LOCK_UN))
+			}, nil
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			_ = f.Close()
+			return nil, errors.Wrapf(err, "acquiring lock %s failed", name)
+		}
+
+		if !waiting {
+			logger.Get(ctx).Info(fmt.Sprintf("Waiting for lock %s held by PID %s", name, holders(f)))
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			return nil, errors.WithStack(ctx.Err())
+		case <-timeout:
+			err := errors.Errorf("timeout waiting for lock %s held by PID %s", name, holders(f))
+			_ = f.Close()
+			return nil, err
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+func storageLockName(storage config.Storage) string {
+	return "storage-" + storageID(storage)
+}
+
+func storageID(storage config.Storage) string {
+	return storage.Driver + "-" + strings.ReplaceAll(storage.Root, "/", "_")
+}
+
+// holders returns PIDs of processes holding the lock on file. They are taken from /proc/locks.
+func holders(f *os.File) string {
+	const unknown = "unknown"
+
+	info, err := f.Stat()
+	if err != nil {
+		return unknown
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return unknown
+	}
+	id := fmt.Sprintf("%02x:%02x:%d", unix.Major(stat.Dev), unix.Minor(stat.Dev), stat.Ino)
+
+	locks, err := os.Open("/proc/locks")
+	if err != nil {
+		return unknown
+	}
+	defer locks.Close()
+
+	var pids []string
+	scanner := bufio.NewScanner(locks)
+	for scanner.Scan() {
+		// Format of the line: "1: FLOCK  ADVISORY  WRITE 1234 00:2c:5678 0 EOF".
+		// Lines of processes waiting for the lock contain "->" after the index.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[1] != "FLOCK" || fields[5] != id {
+			continue
+		}
+		pids = append(pids, fields[4])
+	}
+	if len(pids) == 0 {
+		return unknown
+	}
+	return strings.Join(pids, ", ")
+}
@@ -0,0 +1,136 @@
+package lock
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/outofforest/logger"
+	"github.com/outofforest/osman/config"
+)
+
+func TestLocks(t *testing.T) {
+	ctx := logger.WithLogger(context.Background(), logger.New(logger.DefaultConfig))
+	m := NewManager(config.Lock{Dir: t.TempDir(), Timeout: 200 * time.Millisecond})
+	storage := config.Storage{Root: "tank/builds", Driver: "zfs"}
+
+	unlock1, err := m.Storage(ctx, storage, Shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock2, err := m.Storage(ctx, storage, Shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Storage(ctx, storage, Exclusive)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if !strings.Contains(err.Error(), "held by PID "+strconv.Itoa(os.Getpid())) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := unlock1(); err != nil {
+		t.Fatal(err)
+	}
+	if err := unlock2(); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := m.Storage(ctx, storage, Exclusive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockNetwork, err := m.Network(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unlockNetwork(); err != nil {
+		t.Fatal(err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageLocks(t *testing.T) {
+	ctx := logger.WithLogger(context.Background(), logger.New(logger.DefaultConfig))
+	m := NewManager(config.Lock{Dir: t.TempDir(), Timeout: 200 * time.Millisecond})
+	source := config.Storage{Root: "tank/source", Driver: "zfs"}
+	target := config.Storage{Root: "tank/target", Driver: "zfs"}
+
+	unlock, err := m.Storages(ctx, StorageLock{Storage: source, Mode: Shared},
+		StorageLock{Storage: target, Mode: Exclusive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockSource, err := m.Storage(ctx, source, Shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unlockSource(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Storage(ctx, target, Shared); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := m.Storages(ctx, StorageLock{Storage: source, Mode: Shared},
+		StorageLock{Storage: target, Mode: Shared}); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Storage requested twice is locked once.
+	unlock, err = m.Storages(ctx, StorageLock{Storage: source, Mode: Shared},
+		StorageLock{Storage: source, Mode: Exclusive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Storage(ctx, source, Shared); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildsLock(t *testing.T) {
+	ctx := logger.WithLogger(context.Background(), logger.New(logger.DefaultConfig))
+	m := NewManager(config.Lock{Dir: t.TempDir(), Timeout: 200 * time.Millisecond})
+	storage := config.Storage{Root: "tank/builds", Driver: "zfs"}
+
+	unlockBuilds, err := m.Builds(ctx, storage, Shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Storage is locked independently of builds.
+	unlock, err := m.Storage(ctx, storage, Exclusive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Builds(ctx, storage, Exclusive); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := unlockBuilds(); err != nil {
+		t.Fatal(err)
+	}
+
+	unlockBuilds, err = m.Builds(ctx, storage, Exclusive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unlockBuilds(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,253 @@
+package oci
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	mediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// AnnotationRefName is the annotation storing reference of the image in the index.
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+
+	// AnnotationTitle is the annotation storing human-readable title of the image.
+	AnnotationTitle = "org.opencontainers.image.title"
+
+	// AnnotationCreated is the annotation storing creation time of the image.
+	AnnotationCreated = "org.opencontainers.image.created"
+)
+
+// Image contains metadata of the image stored in layout.
+type Image struct {
+	// Created is the creation time of the image.
+	Created time.Time
+
+	// Labels are stored in the image config.
+	Labels map[string]string
+
+	// Env is the list of environment variables in the form of name=value stored in the image config.
+	Env []string
+
+	// WorkDir and User are the working directory and the user of processes stored in the image config.
+	WorkDir string
+	User    string
+
+	// Annotations are stored in the image manifest.
+	Annotations map[string]string
+
+	// RefNames are the references the image is available under in the layout.
+	RefNames []string
+}
+
+// NewLayout creates OCI image layout in the directory.
+func NewLayout(dir string) (*Layout, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0o755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`),
+		0o644); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Layout{dir: dir}, nil
+}
+
+// Layout writes image into OCI image layout.
+type Layout struct {
+	dir     string
+	layers  []descriptor
+	diffIDs []string
+	history []history
+}
+
+// AddLayer adds layer to the image. Function receives writer to which the uncompressed tar stream is written.
+func (l *Layout) AddLayer(createdBy string, created time.Time, fn func(w io.Writer) error) error {
+	diffIDHasher := sha256.New()
+	desc, err := l.writeBlob(mediaTypeLayer, func(w io.Writer) error {
+		gw := gzip.NewWriter(w)
+		if err := fn(io.MultiWriter(gw, diffIDHasher)); err != nil {
+			return err
+		}
+		return errors.WithStack(gw.Close())
+	})
+	if err != nil {
+		return err
+	}
+
+	l.layers = append(l.layers, desc)
+	l.diffIDs = append(l.diffIDs, digest(diffIDHasher))
+	l.history = append(l.history, history{Created: created, CreatedBy: createdBy})
+	return nil
+}
+
+// Finish stores image config, manifest and index.
+func (l *Layout) Finish(image Image) error {
+	cfg := imageConfig{
+		Created:      image.Created,
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		Config: containerConfig{
+			Env:        image.Env,
+			WorkingDir: image.WorkDir,
+			User:       image.User,
+			Labels:     image.Labels,
+		},
+		RootFS:  rootFS{Type: "layers", DiffIDs: l.diffIDs},
+		History: l.history,
+	}
+	configDesc, err := l.writeJSONBlob(mediaTypeConfig, cfg)
+	if err != nil {
+		return err
+	}
+
+	manifestDesc, err := l.writeJSONBlob(mediaTypeManifest, manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeManifest,
+		Config:        configDesc,
+		Layers:        l.layers,
+		Annotations:   image.Annotations,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Manifest is always referenced, so image without ref names might be loaded too. Descriptor is repeated
+	// for each additional ref name, because each descriptor carries one.
+	idx := index{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeIndex,
+		Manifests:     []descriptor{manifestDesc},
+	}
+	for i, refName := range image.RefNames {
+		desc := manifestDesc
+		desc.Annotations = map[string]string{AnnotationRefName: refName}
+		if i == 0 {
+			idx.Manifests[0] = desc
+			continue
+		}
+		idx.Manifests = append(idx.Manifests, desc)
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(filepath.Join(l.dir, "index.json"), data, 0o644))
+}
+
+func (l *Layout) writeJSONBlob(mediaType string, v interface{}) (descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return descriptor{}, errors.WithStack(err)
+	}
+	return l.writeBlob(mediaType, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return errors.WithStack(err)
+	})
+}
+
+// writeBlob stores blob under its digest. Digest is not known upfront, so blob is written to temporary file first.
+func (l *Layout) writeBlob(mediaType string, fn func(w io.Writer) error) (retDesc descriptor, retErr error) {
+	blobDir := filepath.Join(l.dir, "blobs", "sha256")
+	f, err := os.CreateTemp(blobDir, ".tmp-")
+	if err != nil {
+		return descriptor{}, errors.WithStack(err)
+	}
+	defer func() {
+		_ = f.Close()
+		if retErr != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	hasher := sha256.New()
+	counter := &countingWriter{}
+	if err := fn(io.MultiWriter(f, hasher, counter)); err != nil {
+		return descriptor{}, err
+	}
+	if err := f.Close(); err != nil {
+		return descriptor{}, errors.WithStack(err)
+	}
+
+	desc := descriptor{
+		MediaType: mediaType,
+		Digest:    digest(hasher),
+		Size:      counter.size,
+	}
+	if err := os.Rename(f.Name(), filepath.Join(blobDir, desc.Digest[len("sha256:"):])); err != nil {
+		return descriptor{}, errors.WithStack(err)
+	}
+	return desc, nil
+}
+
+func digest(hasher hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+}
+
+type countingWriter struct {
+	size int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+type manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        descriptor        `json:"config"`
+	Layers        []descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type imageConfig struct {
+	Created      time.Time       `json:"created"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       containerConfig `json:"config"`
+	RootFS       rootFS          `json:"rootfs"`
+	History      []history       `json:"history"`
+}
+
+type containerConfig struct {
+	Env        []string          `json:"Env,omitempty"`
+	WorkingDir string            `json:"WorkingDir,omitempty"`
+	User       string            `json:"User,omitempty"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+}
+
+type rootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type history struct {
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+}
@@ -24,7 +24,11 @@ type resolvingParser struct {
 }
 
 // Parse parses file using resolver matching the extension of a file.
-func (p *resolvingParser) Parse(filePath string) ([]description.Command, error) {
+func (p *resolvingParser) Parse(filePath string, buildArgs map[string]string) (
+	[]description.Command,
+	[]string,
+	error,
+) {
 	var ext string
 	if i := strings.LastIndex(filePath, "."); i >= 0 {
 		ext = filePath[i+1:]
@@ -36,7 +40,7 @@ func (p *resolvingParser) Parse(filePath string) ([]description.Command, error)
 			info, err := os.Stat(f)
 			switch {
 			case err != nil && !os.IsNotExist(err):
-				return nil, errors.WithStack(err)
+				return nil, nil, errors.WithStack(err)
 			case err == nil && !info.IsDir():
 				filePath = f
 				ext = e
@@ -46,10 +50,10 @@ func (p *resolvingParser) Parse(filePath string) ([]description.Command, error)
 	}
 
 	if !p.c.NameExists(ext, (*Parser)(nil)) {
-		return nil, errors.WithStack(fmt.Errorf("parser not found for file %s: %w", filePath, types.ErrImageDoesNotExist))
+		return nil, nil, errors.WithStack(fmt.Errorf("parser not found for file %s: %w", filePath, types.ErrImageDoesNotExist))
 	}
 
 	var parser Parser
 	p.c.ResolveNamed(ext, &parser)
-	return parser.Parse(filePath)
+	return parser.Parse(filePath, buildArgs)
 }
@@ -3,6 +3,9 @@ package parser
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -12,6 +15,9 @@ import (
 	"github.com/outofforest/osman/specfile/parser"
 )
 
+// varRegExp matches references to variables.
+var varRegExp = regexp.MustCompile(`\$\{[a-zA-Z_][a-zA-Z0-9_]*\}`)
+
 // NewSpecFileParser creates new specfile parser.
 func NewSpecFileParser() Parser {
 	return &specFileParser{}
@@ -22,26 +28,109 @@ type specFileParser struct {
 }
 
 // Parse parses commands from specfile.
-func (p *specFileParser) Parse(filePath string) ([]description.Command, error) {
+func (p *specFileParser) Parse(filePath string, buildArgs map[string]string) (
+	[]description.Command,
+	[]string,
+	error,
+) {
+	commands, files, err := p.parse(filePath, &variables{
+		buildArgs: buildArgs,
+		global:    map[string]string{},
+		values:    map[string]string{},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// FROM must be the first command, so ARG commands declared before it are moved after it.
+	for i, cmd := range commands {
+		if _, ok := cmd.(*description.ArgCommand); ok {
+			continue
+		}
+		if _, ok := cmd.(*description.FromCommand); ok && i > 0 {
+			commands = append(append([]description.Command{cmd}, commands[:i]...), commands[i+1:]...)
+		}
+		break
+	}
+
+	if err := verifyStages(commands); err != nil {
+		return nil, nil, err
+	}
+	return commands, files, nil
+}
+
+// verifyStages verifies that names of stages are unique and files are copied from the stages defined earlier.
+// Stages may be referenced by their names or indexes.
+func verifyStages(commands []description.Command) error {
+	stages := map[string]bool{}
+	var current []string
+	index := 0
+	for _, cmd := range commands {
+		switch cmd := cmd.(type) {
+		case *description.FromCommand:
+			for _, stage := range current {
+				stages[stage] = true
+			}
+			current = []string{strconv.Itoa(index)}
+			if cmd.Stage != "" {
+				current = append(current, cmd.Stage)
+			}
+			index++
+			for _, stage := range current {
+				if stages[stage] {
+					return errors.Errorf("stage %s is defined more than once", stage)
+				}
+			}
+		case *description.CopyCommand:
+			if cmd.From == "" {
+				continue
+			}
+			if slices.Contains(current, cmd.From) {
+				return errors.Errorf("files can't be copied from stage %s to itself", cmd.From)
+			}
+			if !stages[cmd.From] {
+				return errors.Errorf("stage %s is not defined, stages are referenced by their names or indexes",
+					cmd.From)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *specFileParser) parse(filePath string, vars *variables) ([]description.Command, []string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, nil, errors.WithStack(err)
 	}
 	defer file.Close()
 
 	parsed, err := parser.Parse(file)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, nil, errors.WithStack(err)
 	}
 
+	files := []string{filePath}
+
 	commands := make([]description.Command, 0, len(parsed.AST.Children))
 	for _, child := range parsed.AST.Children {
+		values := vars.values
+		if strings.EqualFold(child.Value, "from") {
+			// FROM command sees only the arguments declared before the first stage.
+			values = vars.global
+			vars.startStage()
+		}
+
 		args := []string{}
 		for arg := child.Next; arg != nil; arg = arg.Next {
-			args = append(args, arg.Value)
+			args = append(args, expand(arg.Value, values))
+		}
+		flags := make([]string, 0, len(child.Flags))
+		for _, flag := range child.Flags {
+			flags = append(flags, expand(flag, values))
 		}
 
 		var cmds []description.Command
+		var includes []string
 		var err error
 		switch strings.ToLower(child.Value) {
 		case "from":
@@ -51,25 +140,39 @@ func (p *specFileParser) Parse(filePath string) ([]description.Command, error) {
 		case "run":
 			cmds, err = p.cmdRun(args)
 		case "include":
-			cmds, err = p.cmdInclude(args)
+			cmds, includes, err = p.cmdInclude(args, vars)
 		case "boot":
 			cmds, err = p.cmdBoot(args)
+		case "copy":
+			cmds, err = p.cmdCopy(flags, args)
+		case "env":
+			cmds, err = p.cmdEnv(args)
+		case "workdir":
+			cmds, err = p.cmdWorkDir(args)
+		case "user":
+			cmds, err = p.cmdUser(args)
+		case "arg":
+			cmds, err = p.cmdArg(args, vars)
+		case "label":
+			cmds, err = p.cmdLabel(args)
 		default:
-			return nil, errors.Errorf("unknown command '%s' in line %d", child.Value, child.StartLine)
+			return nil, nil, errors.Errorf("unknown command '%s' in line %d", child.Value, child.StartLine)
 		}
 
 		if err != nil {
-			return nil, errors.WithStack(fmt.Errorf("error in line %d of %s command: %w", child.StartLine, child.Value, err))
+			return nil, nil, errors.WithStack(fmt.Errorf("error in line %d of %s command: %w", child.StartLine,
+				child.Value, err))
 		}
 
 		commands = append(commands, cmds...)
+		files = append(files, includes...)
 	}
-	return commands, nil
+	return commands, files, nil
 }
 
 func (p *specFileParser) cmdFrom(args []string) ([]description.Command, error) {
-	if len(args) != 1 {
-		return nil, errors.Errorf("incorrect number of arguments, expected: 1, got: %d", len(args))
+	if len(args) != 1 && (len(args) != 3 || !strings.EqualFold(args[1], "as")) {
+		return nil, errors.New("expected: image [AS stage]")
 	}
 	if args[0] == "" {
 		return nil, errors.New("first argument is empty")
@@ -80,6 +183,12 @@ func (p *specFileParser) cmdFrom(args []string) ([]description.Command, error) {
 		return nil, err
 	}
 
+	if len(args) == 3 {
+		if !types.Tag(args[2]).IsValid() {
+			return nil, errors.Errorf("name of stage %s is invalid", args[2])
+		}
+		return []description.Command{description.FromStage(buildKey, args[2])}, nil
+	}
 	return []description.Command{description.From(buildKey)}, nil
 }
 
@@ -100,24 +209,26 @@ func (p *specFileParser) cmdRun(args []string) ([]description.Command, error) {
 	return []description.Command{description.Run(args[0])}, nil
 }
 
-func (p *specFileParser) cmdInclude(args []string) ([]description.Command, error) {
+func (p *specFileParser) cmdInclude(args []string, vars *variables) ([]description.Command, []string, error) {
 	if len(args) == 0 {
-		return nil, errors.New("no arguments passed")
+		return nil, nil, errors.New("no arguments passed")
 	}
 
 	res := []description.Command{}
+	files := []string{}
 	for _, arg := range args {
 		if arg == "" {
-			return nil, errors.New("empty argument passed")
+			return nil, nil, errors.New("empty argument passed")
 		}
 
-		cmds, err := p.Parse(arg)
+		cmds, includes, err := p.parse(arg, vars)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		res = append(res, cmds...)
+		files = append(files, includes...)
 	}
-	return res, nil
+	return res, files, nil
 }
 
 func (p *specFileParser) cmdBoot(args []string) ([]description.Command, error) {
@@ -142,3 +253,153 @@ func (p *specFileParser) cmdBoot(args []string) ([]description.Command, error) {
 	}
 	return []description.Command{description.Boot(args[0], params)}, nil
 }
+
+func (p *specFileParser) cmdCopy(flags []string, args []string) ([]description.Command, error) {
+	if len(args) < 2 {
+		return nil, errors.Errorf("incorrect number of arguments, expected: at least 2, got: %d", len(args))
+	}
+	for _, arg := range args {
+		if arg == "" {
+			return nil, errors.New("empty argument passed")
+		}
+	}
+
+	var from, chown string
+	var chmod uint32
+	for _, flag := range flags {
+		name, value, _ := strings.Cut(flag, "=")
+		switch name {
+		case "--from":
+			if value == "" {
+				return nil, errors.New("stage is empty")
+			}
+			from = value
+		case "--chown":
+			if value == "" {
+				return nil, errors.New("owner is empty")
+			}
+			chown = value
+		case "--chmod":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode == 0 || mode > 0o7777 {
+				return nil, errors.Errorf("invalid mode '%s'", value)
+			}
+			chmod = uint32(mode)
+		default:
+			return nil, errors.Errorf("unknown flag '%s'", flag)
+		}
+	}
+	return []description.Command{description.CopyFrom(from, args[:len(args)-1], args[len(args)-1], chown, chmod)}, nil
+}
+
+func (p *specFileParser) cmdEnv(args []string) ([]description.Command, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, errors.New("name=value pairs expected")
+	}
+
+	vars := map[string]string{}
+	for i := 0; i < len(args); i += 2 {
+		if !description.IsEnvNameValid(args[i]) {
+			return nil, errors.Errorf("name of environment variable %s is invalid", args[i])
+		}
+		vars[args[i]] = args[i+1]
+	}
+	return []description.Command{description.Env(vars)}, nil
+}
+
+func (p *specFileParser) cmdLabel(args []string) ([]description.Command, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, errors.New("key=value pairs expected")
+	}
+
+	labels := map[string]string{}
+	for i := 0; i < len(args); i += 2 {
+		if !types.IsLabelKeyValid(args[i]) {
+			return nil, errors.Errorf("key of label %s is invalid", args[i])
+		}
+		labels[args[i]] = args[i+1]
+	}
+	return []description.Command{description.Label(labels)}, nil
+}
+
+func (p *specFileParser) cmdWorkDir(args []string) ([]description.Command, error) {
+	if len(args) != 1 {
+		return nil, errors.Errorf("incorrect number of arguments, expected: 1, got: %d", len(args))
+	}
+	if args[0] == "" {
+		return nil, errors.New("first argument is empty")
+	}
+	return []description.Command{description.WorkDir(args[0])}, nil
+}
+
+func (p *specFileParser) cmdUser(args []string) ([]description.Command, error) {
+	if len(args) != 1 {
+		return nil, errors.Errorf("incorrect number of arguments, expected: 1, got: %d", len(args))
+	}
+	if args[0] == "" {
+		return nil, errors.New("first argument is empty")
+	}
+	return []description.Command{description.User(args[0])}, nil
+}
+
+func (p *specFileParser) cmdArg(args []string, vars *variables) ([]description.Command, error) {
+	if len(args) == 0 {
+		return nil, errors.New("no arguments passed")
+	}
+
+	res := make([]description.Command, 0, len(args))
+	for _, arg := range args {
+		name, value, valueSet := strings.Cut(arg, "=")
+		if !description.IsEnvNameValid(name) {
+			return nil, errors.Errorf("name of argument %s is invalid", name)
+		}
+		if globalValue, exists := vars.global[name]; exists && !valueSet {
+			value = globalValue
+		}
+		if buildArg, exists := vars.buildArgs[name]; exists {
+			value = buildArg
+		}
+		if vars.stages == 0 {
+			vars.global[name] = value
+		}
+		vars.values[name] = value
+		res = append(res, description.Arg(name, value))
+	}
+	return res, nil
+}
+
+// variables stores values of arguments declared in spec file. Arguments declared before the first FROM command
+// are global, they are visible in FROM commands and in the first stage. Other stages see arguments declared
+// in them only, global argument is imported to the stage by declaring it again without value.
+type variables struct {
+	// buildArgs are the values of arguments passed to the build, overriding the default ones.
+	buildArgs map[string]string
+
+	// global are the values of arguments declared before the first FROM command.
+	global map[string]string
+
+	// values are the values of arguments visible in the current stage.
+	values map[string]string
+
+	// stages is the number of stages started so far.
+	stages int
+}
+
+// startStage starts new stage, arguments declared in the previous one are not visible anymore.
+func (v *variables) startStage() {
+	if v.stages > 0 {
+		v.values = map[string]string{}
+	}
+	v.stages++
+}
+
+// expand replaces references to arguments in the form of ${NAME} with their values. Other references
+// are kept untouched, so they might be resolved by shell.
+func expand(value string, values map[string]string) string {
+	return varRegExp.ReplaceAllStringFunc(value, func(ref string) string {
+		if value, exists := values[ref[2:len(ref)-1]]; exists {
+			return value
+		}
+		return ref
+	})
+}
@@ -4,6 +4,8 @@ import "github.com/outofforest/osman/infra/description"
 
 // Parser parses image description from file.
 type Parser interface {
-	// Parse parses file and converts it to commands.
-	Parse(filePath string) ([]description.Command, error)
+	// Parse parses file and converts it to commands. Paths of parsed files are returned too, the first one
+	// is the parsed file, the others are the files included by it. Build args override default values
+	// of arguments declared in the file.
+	Parse(filePath string, buildArgs map[string]string) ([]description.Command, []string, error)
 }
@@ -0,0 +1,99 @@
+package infra
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/description"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// newProvenance returns provenance of the image being built from the descriptor.
+func newProvenance(img *description.Descriptor, startedAt time.Time) (*types.Provenance, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	provenance := &types.Provenance{
+		Version:   version(),
+		Host:      host,
+		StartedAt: startedAt,
+	}
+	for i, path := range img.SpecFiles() {
+		specFile, err := newSpecFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			provenance.SpecFile = &specFile
+			continue
+		}
+		provenance.Includes = append(provenance.Includes, specFile)
+	}
+	return provenance, nil
+}
+
+// inheritProvenance fills provenance with the information inherited from parent image.
+func (b *Builder) inheritProvenance(ctx context.Context, provenance *types.Provenance, parent types.BuildInfo) error {
+	if parent.Provenance != nil {
+		provenance.BaseImage = parent.Provenance.BaseImage
+	}
+	for info := parent; ; {
+		provenance.Parents = append(provenance.Parents, info.BuildID)
+		if info.BasedOn == "" {
+			return nil
+		}
+
+		var err error
+		info, err = b.storage.Info(ctx, info.BasedOn)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// newSpecFile returns absolute path and digest of spec file.
+func newSpecFile(path string) (types.SpecFile, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return types.SpecFile{}, errors.WithStack(err)
+	}
+
+	f, err := os.Open(absPath)
+	if err != nil {
+		return types.SpecFile{}, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return types.SpecFile{}, errors.WithStack(err)
+	}
+	return types.SpecFile{
+		Path:   absPath,
+		Digest: "sha256:" + hex.EncodeToString(hasher.Sum(nil)),
+	}, nil
+}
+
+// version returns version of osman binary taken from its build info.
+func version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return info.Main.Version + " (" + setting.Value + ")"
+		}
+	}
+	return info.Main.Version
+}
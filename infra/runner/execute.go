@@ -0,0 +1,135 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/isolator/wire"
+	"github.com/outofforest/libexec"
+	"github.com/outofforest/logger"
+)
+
+// Execute requests execution of the shell command using the environment, working directory and credentials
+// configured in the image.
+type Execute struct {
+	// Command is the command to execute.
+	Command string
+
+	// Env is the list of environment variables in the form of name=value added to the environment of executor.
+	Env []string
+
+	// WorkDir is the working directory of the command, root directory is used if it is empty.
+	WorkDir string
+
+	// Credential is the user command is executed as, credentials of executor are kept if it is nil.
+	Credential *Credential
+}
+
+// Credential specifies the user and groups command is executed as.
+type Credential struct {
+	// UID and GID are the IDs of the user and its primary group.
+	UID uint32
+	GID uint32
+
+	// Groups are the IDs of supplementary groups.
+	Groups []uint32
+}
+
+// ExecuteHandler is the handler of Execute command run by executor.
+func ExecuteHandler(ctx context.Context, content interface{}, encode wire.EncoderFunc) error {
+	m, ok := content.(Execute)
+	if !ok {
+		return errors.Errorf("unexpected type %T", content)
+	}
+
+	workDir := m.WorkDir
+	if workDir == "" {
+		workDir = "/"
+	}
+
+	stdOut := &logWriter{encode: encode}
+	stdErr := &logWriter{encode: encode}
+
+	cmd := exec.Command("/bin/sh", "-c", m.Command)
+	cmd.Env = append(os.Environ(), m.Env...)
+	cmd.Dir = workDir
+	cmd.Stdout = stdOut
+	cmd.Stderr = stdErr
+	if m.Credential != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{
+				Uid:    m.Credential.UID,
+				Gid:    m.Credential.GID,
+				Groups: m.Credential.Groups,
+			},
+		}
+	}
+
+	log := logger.Get(ctx)
+	log.Info("Starting command")
+
+	err := libexec.Exec(ctx, cmd)
+	if err := stdOut.Flush(); err != nil {
+		return err
+	}
+	if err := stdErr.Flush(); err != nil {
+		return err
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("Command exited with error: %s", err))
+		return err
+	}
+
+	log.Info("Command exited")
+	return nil
+}
+
+// logWriter sends lines written to it as log messages.
+type logWriter struct {
+	encode wire.EncoderFunc
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *logWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, data...)
+	for {
+		pos := bytes.IndexByte(w.buf, '\n')
+		if pos < 0 {
+			return len(data), nil
+		}
+		if err := w.send(w.buf[:pos]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[pos+1:]
+	}
+}
+
+// Flush sends the last line if it is not terminated by new line character.
+func (w *logWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.send(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *logWriter) send(line []byte) error {
+	if len(line) == 0 {
+		return nil
+	}
+	return w.encode(wire.Log{Time: time.Now().UTC(), Content: append([]byte{}, line...)})
+}
@@ -0,0 +1,38 @@
+package runner
+
+import (
+	"context"
+
+	"github.com/outofforest/isolator"
+	"github.com/outofforest/isolator/wire"
+)
+
+// NewIsolatorRunner creates new runner executing commands using isolator.
+func NewIsolatorRunner() Runner {
+	return &isolatorRunner{}
+}
+
+type isolatorRunner struct {
+}
+
+// Run starts executor inside directory and runs client function communicating with it.
+func (r *isolatorRunner) Run(ctx context.Context, dir string, clientFunc isolator.ClientFunc) error {
+	return isolator.Run(ctx, isolator.Config{
+		Dir: dir,
+		Types: []interface{}{
+			wire.Result{},
+			wire.Log{},
+		},
+		Executor: wire.Config{
+			ConfigureSystem: true,
+			UseHostNetwork:  true,
+			Mounts: []wire.Mount{
+				{
+					Host:      ".",
+					Namespace: "/.specdir",
+					Writable:  true,
+				},
+			},
+		},
+	}, clientFunc)
+}
@@ -0,0 +1,13 @@
+package runner
+
+import (
+	"context"
+
+	"github.com/outofforest/isolator"
+)
+
+// Runner runs commands inside filesystem of the build.
+type Runner interface {
+	// Run starts executor inside directory and runs client function communicating with it.
+	Run(ctx context.Context, dir string, clientFunc isolator.ClientFunc) error
+}
@@ -0,0 +1,213 @@
+package infra
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/description"
+	"github.com/outofforest/osman/infra/storage"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// buildStages builds image from multi-stage spec file. All the stages but the last one are built as temporary
+// images named <name of the image>-stage-<name of the stage>. They are dropped once the last stage is built,
+// unless builder is configured to keep them.
+func (b *Builder) buildStages(
+	ctx context.Context,
+	cacheDir string,
+	stack map[types.BuildKey]bool,
+	stages [][]description.Command,
+	specFiles []string,
+	name string,
+	tags ...types.Tag,
+) (retBuildID types.BuildID, retErr error) {
+	built := map[string]types.BuildID{}
+	builtByIndex := map[string]types.BuildID{}
+	stageKeys := make([]types.BuildKey, 0, len(stages)-1)
+	defer func() {
+		if b.keepStages {
+			return
+		}
+		if err := b.dropStages(ctx, stageKeys); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	for i, commands := range stages[:len(stages)-1] {
+		stage := strconv.Itoa(i)
+		if fromCommand, ok := commands[0].(*description.FromCommand); ok && fromCommand.Stage != "" {
+			stage = fromCommand.Stage
+		}
+		stageKey := types.NewBuildKey(stageName(name, stage), description.DefaultTag)
+
+		buildID, err := b.build(ctx, cacheDir, stack, description.Describe(stageKey.Name, types.Tags{stageKey.Tag},
+			resolveStages(name, commands, built, builtByIndex)...).FromSpecFiles(specFiles...))
+		if err != nil {
+			return "", err
+		}
+		built[stage] = buildID
+		builtByIndex[strconv.Itoa(i)] = buildID
+		stageKeys = append(stageKeys, stageKey)
+	}
+	return b.build(ctx, cacheDir, stack, description.Describe(name, tags,
+		resolveStages(name, stages[len(stages)-1], built, builtByIndex)...).FromSpecFiles(specFiles...))
+}
+
+// dropStages drops images built by intermediate stages. Images other builds are based on, or tagged
+// with other tags, are kept but the tag of the stage is removed from them.
+func (b *Builder) dropStages(ctx context.Context, stageKeys []types.BuildKey) error {
+	for i := len(stageKeys) - 1; i >= 0; i-- {
+		stageKey := stageKeys[i]
+		delete(b.readyBuilds, stageKey)
+
+		buildID, err := b.storage.BuildID(ctx, stageKey)
+		if err != nil {
+			return err
+		}
+		info, err := b.storage.Info(ctx, buildID)
+		if err != nil {
+			return err
+		}
+		if len(info.Tags) == 1 {
+			err = b.storage.Drop(ctx, buildID)
+			if !errors.Is(err, storage.ErrImageHasChildren) {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := b.storage.Untag(ctx, buildID, stageKey.Tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stageCacheKeys returns cache keys of images files are copied from by COPY commands. Image built by the stage
+// gets new ID whenever it is built again, so its cache key identifies the content copied from it instead.
+func (b *Builder) stageCacheKeys(ctx context.Context, commands []description.Command) (map[string]string, error) {
+	cacheKeys := map[string]string{}
+	for _, cmd := range commands {
+		copyCommand, ok := cmd.(*description.CopyCommand)
+		if !ok || copyCommand.From == "" {
+			continue
+		}
+		if _, exists := cacheKeys[copyCommand.From]; exists {
+			continue
+		}
+
+		srcBuildID, err := types.ParseBuildID(copyCommand.From)
+		if err != nil {
+			return nil, errors.Errorf("stage %s has not been built", copyCommand.From)
+		}
+		info, err := b.storage.Info(ctx, srcBuildID)
+		if err != nil {
+			return nil, err
+		}
+		if info.CacheKey != "" {
+			cacheKeys[copyCommand.From] = info.CacheKey
+		}
+	}
+	return cacheKeys, nil
+}
+
+// mountStages mounts images files are copied from by COPY commands. It returns root directories of the mounted
+// images and IDs of temporary builds which must be dropped once files are copied.
+func (b *Builder) mountStages(
+	ctx context.Context,
+	commands []description.Command,
+) (_ map[string]string, _ []types.BuildID, retErr error) {
+	stages := map[string]string{}
+	mounts := []types.BuildID{}
+	defer func() {
+		if retErr != nil {
+			for _, buildID := range mounts {
+				_ = b.storage.Drop(ctx, buildID)
+			}
+		}
+	}()
+
+	for _, cmd := range commands {
+		copyCommand, ok := cmd.(*description.CopyCommand)
+		if !ok || copyCommand.From == "" {
+			continue
+		}
+		if _, exists := stages[copyCommand.From]; exists {
+			continue
+		}
+
+		srcBuildID, err := types.ParseBuildID(copyCommand.From)
+		if err != nil {
+			return nil, nil, errors.Errorf("stage %s has not been built", copyCommand.From)
+		}
+		info, err := b.storage.Info(ctx, srcBuildID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		buildID := types.NewBuildID(types.BuildTypeMount)
+		finalizeFn, path, err := b.storage.Clone(ctx, srcBuildID, info.Name, buildID)
+		if err != nil {
+			return nil, nil, err
+		}
+		mounts = append(mounts, buildID)
+		if err := finalizeFn(); err != nil {
+			return nil, nil, err
+		}
+		stages[copyCommand.From] = path
+	}
+	return stages, mounts, nil
+}
+
+// splitStages splits commands into stages, each one starting with FROM command.
+func splitStages(commands []description.Command) [][]description.Command {
+	stages := [][]description.Command{}
+	start := 0
+	for i, cmd := range commands {
+		if _, ok := cmd.(*description.FromCommand); ok && i > 0 {
+			stages = append(stages, commands[start:i])
+			start = i
+		}
+	}
+	return append(stages, commands[start:])
+}
+
+// resolveStages replaces references to stages already built with the images they produced. Files may be copied
+// from stages referenced by their names or indexes.
+func resolveStages(
+	name string,
+	commands []description.Command,
+	built map[string]types.BuildID,
+	builtByIndex map[string]types.BuildID,
+) []description.Command {
+	resolved := make([]description.Command, 0, len(commands))
+	for _, cmd := range commands {
+		switch c := cmd.(type) {
+		case *description.FromCommand:
+			if _, exists := built[c.BuildKey.Name]; exists && c.BuildKey.Tag == description.DefaultTag {
+				cmd = description.FromStage(types.NewBuildKey(stageName(name, c.BuildKey.Name), description.DefaultTag),
+					c.Stage)
+			}
+		case *description.CopyCommand:
+			buildID, exists := built[c.From]
+			if !exists {
+				buildID, exists = builtByIndex[c.From]
+			}
+			if exists {
+				copyCommand := *c
+				copyCommand.From = string(buildID)
+				cmd = &copyCommand
+			}
+		}
+		resolved = append(resolved, cmd)
+	}
+	return resolved
+}
+
+// stageName returns name of the image built by the stage.
+func stageName(name, stage string) string {
+	return name + "-stage-" + stage
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/outofforest/osman/config"
+)
+
+// NewBTRFSDriver returns new storage driver based on btrfs subvolumes.
+func NewBTRFSDriver(config config.Storage) Driver {
+	return &fsDriver{
+		config:  config,
+		volumes: btrfsVolumes{},
+	}
+}
+
+// btrfsVolumes stores builds in subvolumes and uses read-only snapshots as images.
+type btrfsVolumes struct{}
+
+// Create creates empty writable volume.
+func (v btrfsVolumes) Create(ctx context.Context, path string) error {
+	return execCommand(ctx, "btrfs", "subvolume", "create", path)
+}
+
+// Snapshot creates a copy of the volume.
+func (v btrfsVolumes) Snapshot(ctx context.Context, srcPath, dstPath string, readOnly bool) error {
+	args := []string{"subvolume", "snapshot"}
+	if readOnly {
+		args = append(args, "-r")
+	}
+	return execCommand(ctx, "btrfs", append(args, srcPath, dstPath)...)
+}
+
+// Freeze makes volume read-only.
+func (v btrfsVolumes) Freeze(ctx context.Context, path string) error {
+	return execCommand(ctx, "btrfs", "property", "set", "-ts", path, "ro", "true")
+}
+
+// Delete deletes volume.
+func (v btrfsVolumes) Delete(ctx context.Context, path string) error {
+	return execCommand(ctx, "btrfs", "subvolume", "delete", path)
+}
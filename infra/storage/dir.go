@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/config"
+)
+
+// NewDirDriver returns new storage driver based on plain directories.
+func NewDirDriver(config config.Storage) Driver {
+	return &fsDriver{
+		config:  config,
+		volumes: dirVolumes{},
+	}
+}
+
+// dirVolumes stores builds in plain directories. Copies are made using reflinks if filesystem supports them,
+// otherwise files are copied.
+type dirVolumes struct{}
+
+// Create creates empty writable volume.
+func (v dirVolumes) Create(ctx context.Context, path string) error {
+	return errors.WithStack(os.Mkdir(path, 0o755))
+}
+
+// Snapshot creates a copy of the volume.
+func (v dirVolumes) Snapshot(ctx context.Context, srcPath, dstPath string, readOnly bool) error {
+	return execCommand(ctx, "cp", "-a", "--reflink=auto", srcPath, dstPath)
+}
+
+// Freeze makes volume read-only.
+func (v dirVolumes) Freeze(ctx context.Context, path string) error {
+	// Plain directories can't be made read-only without affecting permissions of the content.
+	return nil
+}
+
+// Delete deletes volume.
+func (v dirVolumes) Delete(ctx context.Context, path string) error {
+	return errors.WithStack(os.RemoveAll(path))
+}
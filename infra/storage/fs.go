@@ -0,0 +1,539 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/types"
+)
+
+const (
+	fsInfoFile     = "info.json"
+	fsMountedDir   = "root"
+	fsUnmountedDir = "fs"
+	fsImageDir     = "image"
+)
+
+// volumeManager manages volumes used by fsDriver to store builds.
+type volumeManager interface {
+	// Create creates empty writable volume.
+	Create(ctx context.Context, path string) error
+
+	// Snapshot creates a copy of the volume.
+	Snapshot(ctx context.Context, srcPath, dstPath string, readOnly bool) error
+
+	// Freeze makes volume read-only.
+	Freeze(ctx context.Context, path string) error
+
+	// Delete deletes volume.
+	Delete(ctx context.Context, path string) error
+}
+
+// fsDriver keeps each build in a directory under the storage root. The directory contains:
+// - info.json - build info,
+// - root - writable volume of mounted build,
+// - fs - writable volume of build which is not mounted,
+// - image - read-only volume used to clone and revert the build.
+type fsDriver struct {
+	config  config.Storage
+	volumes volumeManager
+}
+
+// Builds returns available builds.
+func (d *fsDriver) Builds(ctx context.Context) ([]types.BuildID, error) {
+	entries, err := os.ReadDir(d.rootDir())
+	switch {
+	case err == nil:
+	case errors.Is(err, os.ErrNotExist):
+		return []types.BuildID{}, nil
+	default:
+		return nil, errors.WithStack(err)
+	}
+
+	builds := []types.BuildID{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		buildID, err := types.ParseBuildID(e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		// Directory without info is left by build which has not been created completely.
+		exists, err := pathExists(filepath.Join(d.buildDir(buildID), fsInfoFile))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			builds = append(builds, buildID)
+		}
+	}
+	return builds, nil
+}
+
+// Info returns information about build.
+func (d *fsDriver) Info(ctx context.Context, buildID types.BuildID) (types.BuildInfo, error) {
+	buildInfo, _, err := d.readInfo(buildID)
+	if err != nil {
+		return types.BuildInfo{}, err
+	}
+
+	buildDir := d.buildDir(buildID)
+	mounted := ""
+	if buildID.Type().Properties().Mountable {
+		mountPoint := filepath.Join(buildDir, fsMountedDir)
+		exists, err := pathExists(mountPoint)
+		if err != nil {
+			return types.BuildInfo{}, err
+		}
+		if exists {
+			mounted = mountPoint
+		}
+	}
+	buildInfo.Mounted = mounted
+
+	return buildInfo, nil
+}
+
+// BuildID returns build ID for build given by name and tag.
+func (d *fsDriver) BuildID(ctx context.Context, buildKey types.BuildKey) (types.BuildID, error) {
+	builds, err := d.Builds(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, buildID := range builds {
+		info, err := d.Info(ctx, buildID)
+		if err != nil {
+			return "", err
+		}
+		if info.Name == buildKey.Name && inTags(info.Tags, buildKey.Tag) {
+			return buildID, nil
+		}
+	}
+	return "", errors.WithStack(fmt.Errorf("image %s does not exist: %w", buildKey, types.ErrImageDoesNotExist))
+}
+
+// CreateEmpty creates blank build.
+func (d *fsDriver) CreateEmpty(
+	ctx context.Context,
+	imageName string,
+	buildID types.BuildID,
+) (_ FinalizeFn, _ string, retErr error) {
+	buildDir, err := d.createBuildDir(buildID)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = d.deleteBuildDir(ctx, buildDir)
+		}
+	}()
+
+	mountPoint := filepath.Join(buildDir, fsMountedDir)
+	if err := d.volumes.Create(ctx, mountPoint); err != nil {
+		return nil, "", err
+	}
+	if err := d.setInfo(types.BuildInfo{
+		BuildID:   buildID,
+		Name:      imageName,
+		CreatedAt: time.Now(),
+	}); err != nil {
+		return nil, "", err
+	}
+
+	return func() error {
+		return d.freeze(ctx, buildDir)
+	}, mountPoint, nil
+}
+
+// Clone clones source build to destination build.
+func (d *fsDriver) Clone(
+	ctx context.Context,
+	srcBuildID types.BuildID,
+	dstImageName string,
+	dstBuildID types.BuildID,
+) (_ FinalizeFn, _ string, retErr error) {
+	snapshot := filepath.Join(d.buildDir(srcBuildID), fsImageDir)
+	exists, err := pathExists(snapshot)
+	if err != nil {
+		return nil, "", err
+	}
+	if !exists {
+		return nil, "", errors.WithStack(fmt.Errorf("build %s does not exist: %w", srcBuildID,
+			types.ErrImageDoesNotExist))
+	}
+
+	properties := dstBuildID.Type().Properties()
+	buildDir, err := d.createBuildDir(dstBuildID)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = d.deleteBuildDir(ctx, buildDir)
+		}
+	}()
+
+	mountPoint := filepath.Join(buildDir, fsMountedDir)
+	if err := d.volumes.Snapshot(ctx, snapshot, mountPoint, false); err != nil {
+		return nil, "", err
+	}
+	if err := d.setInfo(types.BuildInfo{
+		BuildID:   dstBuildID,
+		BasedOn:   srcBuildID,
+		Name:      dstImageName,
+		CreatedAt: time.Now(),
+	}); err != nil {
+		return nil, "", err
+	}
+
+	return func() error {
+		if !properties.Mountable {
+			return d.freeze(ctx, buildDir)
+		}
+		// Revertable builds are restored from the image of their parent, so no copy is made for them here.
+		if properties.Cloneable {
+			if err := d.volumes.Snapshot(ctx, mountPoint, filepath.Join(buildDir, fsImageDir), true); err != nil {
+				return err
+			}
+		}
+		if !properties.AutoMount {
+			return errors.WithStack(os.Rename(mountPoint, filepath.Join(buildDir, fsUnmountedDir)))
+		}
+		return nil
+	}, mountPoint, nil
+}
+
+// Commit creates image from the current content of the mounted build.
+func (d *fsDriver) Commit(
+	ctx context.Context,
+	srcBuildID types.BuildID,
+	dstImageName string,
+	dstBuildID types.BuildID,
+	quiesce QuiesceFn,
+) (retErr error) {
+	srcInfo, err := d.Info(ctx, srcBuildID)
+	if err != nil {
+		return err
+	}
+	if srcInfo.Mounted == "" {
+		return errors.Errorf("build %s is not mounted", srcBuildID)
+	}
+
+	buildDir, err := d.createBuildDir(dstBuildID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = d.deleteBuildDir(ctx, buildDir)
+		}
+	}()
+
+	resumeFn, err := quiesce()
+	if err != nil {
+		return err
+	}
+	err = d.volumes.Snapshot(ctx, srcInfo.Mounted, filepath.Join(buildDir, fsImageDir), true)
+	if err2 := resumeFn(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+
+	return d.setInfo(types.BuildInfo{
+		BuildID:   dstBuildID,
+		BasedOn:   srcInfo.BasedOn,
+		Name:      dstImageName,
+		CreatedAt: time.Now(),
+	})
+}
+
+// StoreManifest stores manifest of build.
+func (d *fsDriver) StoreManifest(ctx context.Context, manifest types.ImageManifest) error {
+	info, err := d.Info(ctx, manifest.BuildID)
+	if err != nil {
+		return err
+	}
+	if !manifest.CreatedAt.IsZero() {
+		info.CreatedAt = manifest.CreatedAt
+	}
+	info.Params = manifest.Params
+	info.Boots = manifest.Boots
+	info.Env = manifest.Env
+	info.WorkDir = manifest.WorkDir
+	info.User = manifest.User
+	info.Args = manifest.Args
+	info.Labels = manifest.Labels
+	info.CacheKey = manifest.CacheKey
+	info.Provenance = manifest.Provenance
+	return d.setInfo(info)
+}
+
+// Tag tags build with tag.
+func (d *fsDriver) Tag(ctx context.Context, buildID types.BuildID, tag types.Tag) error {
+	info, err := d.Info(ctx, buildID)
+	if err != nil {
+		return err
+	}
+
+	existingBuildID, err := d.BuildID(ctx, types.NewBuildKey(info.Name, tag))
+	switch {
+	case err == nil:
+		existingInfo, err := d.Info(ctx, existingBuildID)
+		if err != nil {
+			return err
+		}
+		if existingInfo.BuildID == info.BuildID {
+			return nil
+		}
+		tags := make(types.Tags, 0, len(existingInfo.Tags)-1)
+		for _, t := range existingInfo.Tags {
+			if t != tag {
+				tags = append(tags, t)
+			}
+		}
+		existingInfo.Tags = tags
+		if err := d.setInfo(existingInfo); err != nil {
+			return err
+		}
+	case errors.Is(err, types.ErrImageDoesNotExist):
+	default:
+		return err
+	}
+
+	info.Tags = append(info.Tags, tag)
+	return d.setInfo(info)
+}
+
+// Untag removes tag from the build.
+func (d *fsDriver) Untag(ctx context.Context, buildID types.BuildID, tag types.Tag) error {
+	info, err := d.Info(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	tags := info.Tags
+	info.Tags = make(types.Tags, 0, len(tags))
+	for _, t := range tags {
+		if t != tag {
+			info.Tags = append(info.Tags, t)
+		}
+	}
+	if len(info.Tags) == len(tags) {
+		return errors.Errorf("build %s is not tagged with %s", buildID, tag)
+	}
+	return d.setInfo(info)
+}
+
+// SetLabels replaces labels of the build.
+func (d *fsDriver) SetLabels(ctx context.Context, buildID types.BuildID, labels types.Labels) error {
+	info, err := d.Info(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	info.Labels = labels
+	return d.setInfo(info)
+}
+
+// Drop drops image.
+func (d *fsDriver) Drop(ctx context.Context, buildID types.BuildID) error {
+	buildDir := d.buildDir(buildID)
+	exists, err := pathExists(buildDir)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.WithStack(fmt.Errorf("build %s does not exist: %w", buildID, types.ErrImageDoesNotExist))
+	}
+
+	// Volumes are independent of their origin, so relation between builds is taken from build info.
+	builds, err := d.Builds(ctx)
+	if err != nil {
+		return err
+	}
+	for _, b := range builds {
+		info, err := d.Info(ctx, b)
+		if err != nil {
+			return err
+		}
+		if info.BasedOn == buildID {
+			return errors.WithStack(fmt.Errorf("build %s have children: %w", buildID, ErrImageHasChildren))
+		}
+	}
+
+	return d.deleteBuildDir(ctx, buildDir)
+}
+
+// Revert reverts revertable build to the state it had when it was created.
+func (d *fsDriver) Revert(ctx context.Context, buildID types.BuildID) error {
+	properties := buildID.Type().Properties()
+	if !properties.Revertable {
+		return errors.Errorf("build %s is not revertable", buildID)
+	}
+
+	info, err := d.Info(ctx, buildID)
+	if err != nil {
+		return err
+	}
+
+	// Build which is not mountable is stored in read-only volume, so it can't be modified.
+	if !properties.Mountable {
+		return nil
+	}
+
+	// Mountable build is created as a copy of its parent image, so it is restored from it.
+	snapshot := filepath.Join(d.buildDir(info.BasedOn), fsImageDir)
+	exists, err := pathExists(snapshot)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.WithStack(fmt.Errorf("snapshot of build %s does not exist: %w", buildID,
+			types.ErrImageDoesNotExist))
+	}
+
+	for _, volume := range []string{fsMountedDir, fsUnmountedDir} {
+		path := filepath.Join(d.buildDir(buildID), volume)
+		exists, err := pathExists(path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err := d.volumes.Delete(ctx, path); err != nil {
+			return err
+		}
+		return d.volumes.Snapshot(ctx, snapshot, path, false)
+	}
+	return errors.Errorf("writable volume of build %s does not exist", buildID)
+}
+
+func (d *fsDriver) rootDir() string {
+	return filepath.Join("/", d.config.Root)
+}
+
+func (d *fsDriver) buildDir(buildID types.BuildID) string {
+	return filepath.Join(d.rootDir(), string(buildID))
+}
+
+// Migrate stores build info using the current version of the schema.
+func (d *fsDriver) Migrate(ctx context.Context, buildID types.BuildID) (bool, error) {
+	info, version, err := d.readInfo(buildID)
+	if err != nil {
+		return false, err
+	}
+	if version == manifestVersion {
+		return false, nil
+	}
+	return true, d.setInfo(info)
+}
+
+func (d *fsDriver) readInfo(buildID types.BuildID) (types.BuildInfo, int, error) {
+	infoRaw, err := os.ReadFile(filepath.Join(d.buildDir(buildID), fsInfoFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return types.BuildInfo{}, 0, errors.WithStack(fmt.Errorf("build %s does not exist: %w", buildID,
+				types.ErrImageDoesNotExist))
+		}
+		return types.BuildInfo{}, 0, errors.WithStack(err)
+	}
+
+	info, version, err := unmarshalInfo(infoRaw)
+	if err != nil {
+		return types.BuildInfo{}, 0, errors.WithMessagef(err, "reading info of build %s failed", buildID)
+	}
+	return info, version, nil
+}
+
+func (d *fsDriver) setInfo(info types.BuildInfo) error {
+	info.Mounted = ""
+	infoRaw, err := marshalInfo(info)
+	if err != nil {
+		return err
+	}
+	infoFile := filepath.Join(d.buildDir(info.BuildID), fsInfoFile)
+	tmpFile := infoFile + ".tmp"
+	if err := os.WriteFile(tmpFile, infoRaw, 0o600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmpFile, infoFile))
+}
+
+// createBuildDir creates directory of the new build.
+func (d *fsDriver) createBuildDir(buildID types.BuildID) (string, error) {
+	if err := os.MkdirAll(d.rootDir(), 0o700); err != nil {
+		return "", errors.WithStack(err)
+	}
+	buildDir := d.buildDir(buildID)
+	if err := os.Mkdir(buildDir, 0o700); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return "", errors.Errorf("build %s already exists", buildID)
+		}
+		return "", errors.WithStack(err)
+	}
+	return buildDir, nil
+}
+
+// deleteBuildDir deletes volumes of the build and its directory.
+func (d *fsDriver) deleteBuildDir(ctx context.Context, buildDir string) error {
+	for _, volume := range []string{fsMountedDir, fsUnmountedDir, fsImageDir} {
+		path := filepath.Join(buildDir, volume)
+		exists, err := pathExists(path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err := d.volumes.Delete(ctx, path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(buildDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// freeze turns the mounted volume of non-mountable build into its read-only image.
+func (d *fsDriver) freeze(ctx context.Context, buildDir string) error {
+	imagePath := filepath.Join(buildDir, fsImageDir)
+	if err := os.Rename(filepath.Join(buildDir, fsMountedDir), imagePath); err != nil {
+		return errors.WithStack(err)
+	}
+	return d.volumes.Freeze(ctx, imagePath)
+}
+
+func execCommand(ctx context.Context, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "command '%s %s' failed: %s", name, strings.Join(args, " "),
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func pathExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, os.ErrNotExist):
+		return false, nil
+	default:
+		return false, errors.WithStack(err)
+	}
+}
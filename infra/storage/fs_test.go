@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/types"
+)
+
+func TestDirDriverCreatesAndClonesBuilds(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	d := NewDirDriver(config.Storage{Root: root})
+
+	imageID := createDirImage(t, d, "image", "")
+
+	mountID := types.NewBuildID(types.BuildTypeMount)
+	finalizeFn, path, err := d.Clone(ctx, imageID, "image", mountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := finalizeFn(); err != nil {
+		t.Fatal(err)
+	}
+	if content := readDirFile(t, filepath.Join(path, "file")); content != "content" {
+		t.Fatalf("unexpected content: %s", content)
+	}
+
+	info, err := d.Info(ctx, mountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.BasedOn != imageID || info.Mounted != path {
+		t.Fatalf("unexpected info: %#v", info)
+	}
+
+	builds, err := d.Builds(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 || !slices.Contains(builds, imageID) || !slices.Contains(builds, mountID) {
+		t.Fatalf("unexpected builds: %v", builds)
+	}
+}
+
+func TestDirDriverSkipsIncompleteBuilds(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	d := NewDirDriver(config.Storage{Root: root})
+
+	imageID := createDirImage(t, d, "image", "")
+	if err := os.Mkdir(filepath.Join(root, string(types.NewBuildID(types.BuildTypeImage))), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	builds, err := d.Builds(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0] != imageID {
+		t.Fatalf("unexpected builds: %v", builds)
+	}
+
+	// Clone fails because destination build exists, it must not be removed.
+	if _, _, err := d.Clone(ctx, imageID, "image", imageID); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := d.Info(ctx, imageID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirDriverMovesTags(t *testing.T) {
+	ctx := context.Background()
+	d := NewDirDriver(config.Storage{Root: t.TempDir()})
+
+	imageID1 := createDirImage(t, d, "image", "")
+	imageID2 := createDirImage(t, d, "image", "")
+
+	if err := d.Tag(ctx, imageID1, "tag"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Tag(ctx, imageID2, "tag"); err != nil {
+		t.Fatal(err)
+	}
+
+	buildID, err := d.BuildID(ctx, types.NewBuildKey("image", "tag"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buildID != imageID2 {
+		t.Fatalf("tag should be moved to %s", imageID2)
+	}
+	info, err := d.Info(ctx, imageID1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Tags) != 0 {
+		t.Fatalf("unexpected tags: %v", info.Tags)
+	}
+
+	if err := d.Untag(ctx, imageID2, "tag"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.BuildID(ctx, types.NewBuildKey("image", "tag")); !errors.Is(err, types.ErrImageDoesNotExist) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDirDriverDropsBuildsWithoutChildren(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	d := NewDirDriver(config.Storage{Root: root})
+
+	parentID := createDirImage(t, d, "parent", "")
+	childID := createDirImage(t, d, "child", parentID)
+
+	if err := d.Drop(ctx, parentID); !errors.Is(err, ErrImageHasChildren) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := d.Drop(ctx, childID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Drop(ctx, parentID); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	if err := d.Drop(ctx, parentID); !errors.Is(err, types.ErrImageDoesNotExist) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDirDriverRevertsBuild(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	d := NewDirDriver(config.Storage{Root: root})
+
+	imageID := createDirImage(t, d, "image", "")
+
+	bootID := types.NewBuildID(types.BuildTypeBoot)
+	finalizeFn, _, err := d.Clone(ctx, imageID, "image", bootID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := finalizeFn(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(root, string(bootID), fsUnmountedDir, "file")
+	writeDirFile(t, file, "modified")
+
+	if err := d.Revert(ctx, bootID); err != nil {
+		t.Fatal(err)
+	}
+	if content := readDirFile(t, file); content != "content" {
+		t.Fatalf("unexpected content: %s", content)
+	}
+
+	if err := d.Revert(ctx, types.NewBuildID(types.BuildTypeBoot)); !errors.Is(err, types.ErrImageDoesNotExist) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func createDirImage(t *testing.T, d Driver, name string, basedOn types.BuildID) types.BuildID {
+	ctx := context.Background()
+	buildID := types.NewBuildID(types.BuildTypeImage)
+
+	var finalizeFn FinalizeFn
+	var path string
+	var err error
+	if basedOn == "" {
+		finalizeFn, path, err = d.CreateEmpty(ctx, name, buildID)
+	} else {
+		finalizeFn, path, err = d.Clone(ctx, basedOn, name, buildID)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeDirFile(t, filepath.Join(path, "file"), "content")
+	if err := finalizeFn(); err != nil {
+		t.Fatal(err)
+	}
+	return buildID
+}
+
+func writeDirFile(t *testing.T, path, content string) {
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readDirFile(t *testing.T, path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
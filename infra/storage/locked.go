@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/lock"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// NewLockedDriver returns driver locking the storage only for the time of each operation, exclusively if
+// the operation modifies it. It is used by long-running operations, so other processes are not blocked
+// between the modifications. Optional interfaces of the driver are not exposed.
+func NewLockedDriver(driver Driver, storage config.Storage, locks *lock.Manager) Driver {
+	return &lockedDriver{
+		driver:  driver,
+		storage: storage,
+		locks:   locks,
+	}
+}
+
+type lockedDriver struct {
+	driver  Driver
+	storage config.Storage
+	locks   *lock.Manager
+}
+
+// Builds returns available builds.
+func (d *lockedDriver) Builds(ctx context.Context) (retBuilds []types.BuildID, retErr error) {
+	retErr = d.do(ctx, lock.Shared, func() error {
+		var err error
+		retBuilds, err = d.driver.Builds(ctx)
+		return err
+	})
+	return
+}
+
+// Info returns information about build.
+func (d *lockedDriver) Info(ctx context.Context, buildID types.BuildID) (retInfo types.BuildInfo, retErr error) {
+	retErr = d.do(ctx, lock.Shared, func() error {
+		var err error
+		retInfo, err = d.driver.Info(ctx, buildID)
+		return err
+	})
+	return
+}
+
+// BuildID returns build ID for build given by name and tag.
+func (d *lockedDriver) BuildID(ctx context.Context, buildKey types.BuildKey) (retID types.BuildID, retErr error) {
+	retErr = d.do(ctx, lock.Shared, func() error {
+		var err error
+		retID, err = d.driver.BuildID(ctx, buildKey)
+		return err
+	})
+	return
+}
+
+// CreateEmpty creates blank build.
+func (d *lockedDriver) CreateEmpty(
+	ctx context.Context,
+	imageName string,
+	buildID types.BuildID,
+) (retFinalize FinalizeFn, retPath string, retErr error) {
+	retErr = d.do(ctx, lock.Exclusive, func() error {
+		var err error
+		retFinalize, retPath, err = d.driver.CreateEmpty(ctx, imageName, buildID)
+		return err
+	})
+	return d.finalizeFn(ctx, retFinalize), retPath, retErr
+}
+
+// Clone clones build to destination build.
+func (d *lockedDriver) Clone(
+	ctx context.Context,
+	srcBuildID types.BuildID,
+	dstImageName string,
+	dstBuildID types.BuildID,
+) (retFinalize FinalizeFn, retPath string, retErr error) {
+	retErr = d.do(ctx, lock.Exclusive, func() error {
+		var err error
+		retFinalize, retPath, err = d.driver.Clone(ctx, srcBuildID, dstImageName, dstBuildID)
+		return err
+	})
+	return d.finalizeFn(ctx, retFinalize), retPath, retErr
+}
+
+// Commit creates image from the current content of the mounted build.
+func (d *lockedDriver) Commit(
+	ctx context.Context,
+	srcBuildID types.BuildID,
+	dstImageName string,
+	dstBuildID types.BuildID,
+	quiesce QuiesceFn,
+) error {
+	return d.do(ctx, lock.Exclusive, func() error {
+		return d.driver.Commit(ctx, srcBuildID, dstImageName, dstBuildID, quiesce)
+	})
+}
+
+// StoreManifest stores manifest of build.
+func (d *lockedDriver) StoreManifest(ctx context.Context, manifest types.ImageManifest) error {
+	return d.do(ctx, lock.Exclusive, func() error {
+		return d.driver.StoreManifest(ctx, manifest)
+	})
+}
+
+// Tag tags build with tag.
+func (d *lockedDriver) Tag(ctx context.Context, buildID types.BuildID, tag types.Tag) error {
+	return d.do(ctx, lock.Exclusive, func() error {
+		return d.driver.Tag(ctx, buildID, tag)
+	})
+}
+
+// Untag removes tag from the build.
+func (d *lockedDriver) Untag(ctx context.Context, buildID types.BuildID, tag types.Tag) error {
+	return d.do(ctx, lock.Exclusive, func() error {
+		return d.driver.Untag(ctx, buildID, tag)
+	})
+}
+
+// SetLabels replaces labels of the build.
+func (d *lockedDriver) SetLabels(ctx context.Context, buildID types.BuildID, labels types.Labels) error {
+	return d.do(ctx, lock.Exclusive, func() error {
+		return d.driver.SetLabels(ctx, buildID, labels)
+	})
+}
+
+// Drop drops build.
+func (d *lockedDriver) Drop(ctx context.Context, buildID types.BuildID) error {
+	return d.do(ctx, lock.Exclusive, func() error {
+		return d.driver.Drop(ctx, buildID)
+	})
+}
+
+// Revert reverts revertable build to the state it had when it was created.
+func (d *lockedDriver) Revert(ctx context.Context, buildID types.BuildID) error {
+	return d.do(ctx, lock.Exclusive, func() error {
+		return d.driver.Revert(ctx, buildID)
+	})
+}
+
+func (d *lockedDriver) finalizeFn(ctx context.Context, finalizeFn FinalizeFn) FinalizeFn {
+	if finalizeFn == nil {
+		return nil
+	}
+	return func() error {
+		return d.do(ctx, lock.Exclusive, finalizeFn)
+	}
+}
+
+// do runs fn while storage is locked. State cached by the driver is dropped once the lock is acquired,
+// because storage might have been modified by other processes in the meantime.
+func (d *lockedDriver) do(ctx context.Context, mode lock.Mode, fn func() error) (retErr error) {
+	unlock, err := d.locks.Storage(ctx, d.storage, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := unlock(); retErr == nil {
+			retErr = err
+		}
+	}()
+
+	if invalidator, ok := d.driver.(Invalidator); ok {
+		invalidator.Invalidate()
+	}
+	return fn()
+}
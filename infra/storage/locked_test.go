@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/outofforest/logger"
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/lock"
+	"github.com/outofforest/osman/infra/types"
+)
+
+type probedDriver struct {
+	Driver
+
+	t           *testing.T
+	storage     config.Storage
+	locks       *lock.Manager
+	invalidated int
+	tagged      bool
+}
+
+func (d *probedDriver) Invalidate() {
+	d.invalidated++
+}
+
+func (d *probedDriver) Tag(ctx context.Context, buildID types.BuildID, tag types.Tag) error {
+	if _, err := d.locks.Storage(ctx, d.storage, lock.Shared); err == nil {
+		d.t.Error("storage is not locked while build is tagged")
+	}
+	d.tagged = true
+	return d.Driver.Tag(ctx, buildID, tag)
+}
+
+func TestLockedDriverLocksStorageOnlyDuringOperations(t *testing.T) {
+	ctx := logger.WithLogger(context.Background(), logger.New(logger.DefaultConfig))
+	storage := config.Storage{Root: t.TempDir(), Driver: "memory"}
+	locks := lock.NewManager(config.Lock{Dir: t.TempDir(), Timeout: 200 * time.Millisecond})
+
+	driver := &probedDriver{
+		Driver:  NewMemoryDriver(storage),
+		t:       t,
+		storage: storage,
+		locks:   locks,
+	}
+	d := NewLockedDriver(driver, storage, locks)
+
+	buildID := types.NewBuildID(types.BuildTypeImage)
+	finalizeFn, _, err := d.CreateEmpty(ctx, "image", buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Storage is not locked while the content of the build is created.
+	unlock, err := locks.Storage(ctx, storage, lock.Exclusive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := finalizeFn(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Tag(ctx, buildID, "tag"); err != nil {
+		t.Fatal(err)
+	}
+	if !driver.tagged {
+		t.Fatal("build not tagged")
+	}
+	if driver.invalidated != 3 {
+		t.Fatalf("unexpected number of invalidations: %d", driver.invalidated)
+	}
+}
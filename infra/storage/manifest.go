@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/types"
+)
+
+// manifestVersion is the current version of the schema used to store build info.
+const manifestVersion = 1
+
+// manifestEnvelope wraps stored build info together with the version of its schema.
+type manifestEnvelope struct {
+	Version int
+	Info    json.RawMessage
+
+	// Chunks is the number of zfs properties following the one storing the envelope, build info is split into them
+	// if it is too long to be stored in single property.
+	Chunks int `json:",omitempty"`
+}
+
+// migrationFn upgrades build info stored in one version of the schema to the next one.
+type migrationFn func(info map[string]interface{}) error
+
+// migrations maps version of the schema to the function upgrading build info to the next version.
+// Whenever schema of build info is changed, manifestVersion is incremented and migration is added here.
+var migrations = map[int]migrationFn{
+	// Before version 1 build info was stored without envelope. Fields were not changed.
+	0: func(info map[string]interface{}) error {
+		return nil
+	},
+}
+
+// marshalInfo encodes build info using the current version of the schema.
+func marshalInfo(info types.BuildInfo) ([]byte, error) {
+	infoRaw, err := json.Marshal(info)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	data, err := json.Marshal(manifestEnvelope{
+		Version: manifestVersion,
+		Info:    infoRaw,
+	})
+	return data, errors.WithStack(err)
+}
+
+// unmarshalInfo decodes stored build info and upgrades it to the current version of the schema.
+// Version the info was stored in is returned too.
+func unmarshalInfo(data []byte) (types.BuildInfo, int, error) {
+	var envelope manifestEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return types.BuildInfo{}, 0, errors.WithStack(err)
+	}
+	if envelope.Info == nil {
+		// Info stored before envelope was introduced.
+		envelope = manifestEnvelope{Info: data}
+	}
+	if envelope.Version > manifestVersion {
+		return types.BuildInfo{}, 0, errors.Errorf(
+			"build info is stored in schema version %d, the newest supported one is %d, upgrade osman",
+			envelope.Version, manifestVersion)
+	}
+
+	infoRaw := []byte(envelope.Info)
+	if envelope.Version < manifestVersion {
+		var info map[string]interface{}
+		if err := json.Unmarshal(infoRaw, &info); err != nil {
+			return types.BuildInfo{}, 0, errors.WithStack(err)
+		}
+		for version := envelope.Version; version < manifestVersion; version++ {
+			migration, exists := migrations[version]
+			if !exists {
+				return types.BuildInfo{}, 0, errors.Errorf("migration of build info from version %d is not defined",
+					version)
+			}
+			if err := migration(info); err != nil {
+				return types.BuildInfo{}, 0, err
+			}
+		}
+		var err error
+		infoRaw, err = json.Marshal(info)
+		if err != nil {
+			return types.BuildInfo{}, 0, errors.WithStack(err)
+		}
+	}
+
+	var info types.BuildInfo
+	if err := json.Unmarshal(infoRaw, &info); err != nil {
+		return types.BuildInfo{}, 0, errors.WithStack(err)
+	}
+	return info, envelope.Version, nil
+}
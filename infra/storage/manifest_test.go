@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/types"
+)
+
+func TestUnmarshalInfoWithoutEnvelope(t *testing.T) {
+	buildID := types.NewBuildID(types.BuildTypeImage)
+	data, err := json.Marshal(types.BuildInfo{BuildID: buildID, Name: "image", Tags: types.Tags{"tag"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, version, err := unmarshalInfo(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Fatalf("unexpected version: %d", version)
+	}
+	if info.BuildID != buildID || info.Name != "image" || len(info.Tags) != 1 || info.Tags[0] != "tag" {
+		t.Fatalf("unexpected info: %#v", info)
+	}
+
+	data, err = marshalInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info2, version, err := unmarshalInfo(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != manifestVersion || info2.BuildID != buildID {
+		t.Fatalf("unexpected info: %#v, version: %d", info2, version)
+	}
+}
+
+func TestUnmarshalInfoFromNewerVersionFails(t *testing.T) {
+	data, err := json.Marshal(manifestEnvelope{Version: manifestVersion + 1, Info: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := unmarshalInfo(data); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestMigrationsAreDefined(t *testing.T) {
+	for version := 0; version < manifestVersion; version++ {
+		if _, exists := migrations[version]; !exists {
+			t.Fatalf("migration from version %d is not defined", version)
+		}
+	}
+}
+
+func TestDirDriverMigratesInfo(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	d := NewDirDriver(config.Storage{Root: root})
+
+	buildID := types.NewBuildID(types.BuildTypeImage)
+	finalizeFn, _, err := d.CreateEmpty(ctx, "image", buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := finalizeFn(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(types.BuildInfo{BuildID: buildID, Name: "image"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoFile := filepath.Join(root, string(buildID), fsInfoFile)
+	if err := os.WriteFile(infoFile, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := d.(Migrator)
+	migrated, err := m.Migrate(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !migrated {
+		t.Fatal("build info should be migrated")
+	}
+	migrated, err = m.Migrate(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated {
+		t.Fatal("build info should not be migrated again")
+	}
+
+	info, err := d.Info(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "image" {
+		t.Fatalf("unexpected info: %#v", info)
+	}
+}
@@ -0,0 +1,417 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// NewMemoryDriver returns new storage driver keeping build information in memory.
+// Content of builds is stored in directories created under the storage root, which is expected to be a temporary
+// directory. Driver is intended to be used in tests.
+func NewMemoryDriver(config config.Storage) Driver {
+	return &memoryDriver{
+		config: config,
+		builds: map[types.BuildID]*memoryBuild{},
+	}
+}
+
+type memoryBuild struct {
+	info     types.BuildInfo
+	mounted  bool
+	snapshot bool
+}
+
+type memoryDriver struct {
+	config config.Storage
+
+	mu     sync.Mutex
+	builds map[types.BuildID]*memoryBuild
+}
+
+// Builds returns available builds.
+func (d *memoryDriver) Builds(ctx context.Context) ([]types.BuildID, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	builds := make([]types.BuildID, 0, len(d.builds))
+	for buildID := range d.builds {
+		builds = append(builds, buildID)
+	}
+	return builds, nil
+}
+
+// Info returns information about build.
+func (d *memoryDriver) Info(ctx context.Context, buildID types.BuildID) (types.BuildInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	build, err := d.build(buildID)
+	if err != nil {
+		return types.BuildInfo{}, err
+	}
+	return d.info(build), nil
+}
+
+// BuildID returns build ID for build given by name and tag.
+func (d *memoryDriver) BuildID(ctx context.Context, buildKey types.BuildKey) (types.BuildID, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	build, exists := d.buildByKey(buildKey)
+	if !exists {
+		return "", errors.WithStack(fmt.Errorf("image %s does not exist: %w", buildKey, types.ErrImageDoesNotExist))
+	}
+	return build.info.BuildID, nil
+}
+
+// CreateEmpty creates blank build.
+func (d *memoryDriver) CreateEmpty(
+	ctx context.Context,
+	imageName string,
+	buildID types.BuildID,
+) (FinalizeFn, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	path := d.path(buildID)
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+
+	build := &memoryBuild{
+		info: types.BuildInfo{
+			BuildID:   buildID,
+			Name:      imageName,
+			CreatedAt: time.Now(),
+		},
+		mounted: true,
+	}
+	d.builds[buildID] = build
+
+	return func() error {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		build.mounted = false
+		build.snapshot = true
+		return nil
+	}, path, nil
+}
+
+// Clone clones source build to destination build.
+func (d *memoryDriver) Clone(
+	ctx context.Context,
+	srcBuildID types.BuildID,
+	dstImageName string,
+	dstBuildID types.BuildID,
+) (FinalizeFn, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	srcBuild, exists := d.builds[srcBuildID]
+	if !exists || !srcBuild.snapshot {
+		return nil, "", errors.WithStack(fmt.Errorf("snapshot of build %s does not exist: %w", srcBuildID,
+			types.ErrImageDoesNotExist))
+	}
+	if _, exists := d.builds[dstBuildID]; exists {
+		return nil, "", errors.Errorf("build %s already exists", dstBuildID)
+	}
+
+	path := d.path(dstBuildID)
+	if err := copyTree(path, d.path(srcBuildID)); err != nil {
+		return nil, "", err
+	}
+
+	properties := dstBuildID.Type().Properties()
+	build := &memoryBuild{
+		info: types.BuildInfo{
+			BuildID:   dstBuildID,
+			BasedOn:   srcBuildID,
+			Name:      dstImageName,
+			CreatedAt: time.Now(),
+		},
+		mounted: true,
+	}
+	d.builds[dstBuildID] = build
+
+	return func() error {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		if !properties.Mountable || !properties.AutoMount {
+			build.mounted = false
+		}
+		build.snapshot = properties.Cloneable || properties.Revertable
+		if build.snapshot && properties.Mountable {
+			return copyTree(d.snapshotPath(dstBuildID), path)
+		}
+		return nil
+	}, path, nil
+}
+
+// Commit creates image from the current content of the mounted build.
+func (d *memoryDriver) Commit(
+	ctx context.Context,
+	srcBuildID types.BuildID,
+	dstImageName string,
+	dstBuildID types.BuildID,
+	quiesce QuiesceFn,
+) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	srcBuild, err := d.build(srcBuildID)
+	if err != nil {
+		return err
+	}
+	if !srcBuild.mounted {
+		return errors.Errorf("build %s is not mounted", srcBuildID)
+	}
+	if _, exists := d.builds[dstBuildID]; exists {
+		return errors.Errorf("build %s already exists", dstBuildID)
+	}
+
+	resumeFn, err := quiesce()
+	if err != nil {
+		return err
+	}
+	err = copyTree(d.path(dstBuildID), d.path(srcBuildID))
+	if err2 := resumeFn(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+
+	d.builds[dstBuildID] = &memoryBuild{
+		info: types.BuildInfo{
+			BuildID:   dstBuildID,
+			BasedOn:   srcBuild.info.BasedOn,
+			Name:      dstImageName,
+			CreatedAt: time.Now(),
+		},
+		snapshot: true,
+	}
+	return nil
+}
+
+// StoreManifest stores manifest of build.
+func (d *memoryDriver) StoreManifest(ctx context.Context, manifest types.ImageManifest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	build, err := d.build(manifest.BuildID)
+	if err != nil {
+		return err
+	}
+	if !manifest.CreatedAt.IsZero() {
+		build.info.CreatedAt = manifest.CreatedAt
+	}
+	build.info.Params = manifest.Params
+	build.info.Boots = manifest.Boots
+	build.info.Env = manifest.Env
+	build.info.WorkDir = manifest.WorkDir
+	build.info.User = manifest.User
+	build.info.Args = manifest.Args
+	build.info.Labels = manifest.Labels
+	build.info.CacheKey = manifest.CacheKey
+	build.info.Provenance = manifest.Provenance
+	return nil
+}
+
+// Tag tags build with tag.
+func (d *memoryDriver) Tag(ctx context.Context, buildID types.BuildID, tag types.Tag) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	build, err := d.build(buildID)
+	if err != nil {
+		return err
+	}
+
+	if existingBuild, exists := d.buildByKey(types.NewBuildKey(build.info.Name, tag)); exists {
+		if existingBuild == build {
+			return nil
+		}
+		existingBuild.info.Tags = removeTag(existingBuild.info.Tags, tag)
+	}
+
+	build.info.Tags = append(build.info.Tags, tag)
+	return nil
+}
+
+// Untag removes tag from the build.
+func (d *memoryDriver) Untag(ctx context.Context, buildID types.BuildID, tag types.Tag) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	build, err := d.build(buildID)
+	if err != nil {
+		return err
+	}
+	tags := removeTag(build.info.Tags, tag)
+	if len(tags) == len(build.info.Tags) {
+		return errors.Errorf("build %s is not tagged with %s", buildID, tag)
+	}
+	build.info.Tags = tags
+	return nil
+}
+
+// SetLabels replaces labels of the build.
+func (d *memoryDriver) SetLabels(ctx context.Context, buildID types.BuildID, labels types.Labels) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	build, err := d.build(buildID)
+	if err != nil {
+		return err
+	}
+	build.info.Labels = labels
+	return nil
+}
+
+// Drop drops build.
+func (d *memoryDriver) Drop(ctx context.Context, buildID types.BuildID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.build(buildID); err != nil {
+		return err
+	}
+	for _, b := range d.builds {
+		if b.info.BasedOn == buildID {
+			return errors.WithStack(fmt.Errorf("build %s have children: %w", buildID, ErrImageHasChildren))
+		}
+	}
+
+	delete(d.builds, buildID)
+	return errors.WithStack(os.RemoveAll(filepath.Join(d.config.Root, string(buildID))))
+}
+
+// Revert reverts revertable build to the state it had when it was created.
+func (d *memoryDriver) Revert(ctx context.Context, buildID types.BuildID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	build, err := d.build(buildID)
+	if err != nil {
+		return err
+	}
+	properties := buildID.Type().Properties()
+	if !properties.Revertable || !build.snapshot {
+		return errors.Errorf("build %s is not revertable", buildID)
+	}
+	if !properties.Mountable {
+		return nil
+	}
+
+	if err := os.RemoveAll(d.path(buildID)); err != nil {
+		return errors.WithStack(err)
+	}
+	return copyTree(d.path(buildID), d.snapshotPath(buildID))
+}
+
+func (d *memoryDriver) build(buildID types.BuildID) (*memoryBuild, error) {
+	build, exists := d.builds[buildID]
+	if !exists {
+		return nil, errors.WithStack(fmt.Errorf("build %s does not exist: %w", buildID, types.ErrImageDoesNotExist))
+	}
+	return build, nil
+}
+
+func (d *memoryDriver) buildByKey(buildKey types.BuildKey) (*memoryBuild, bool) {
+	for _, build := range d.builds {
+		if build.info.Name == buildKey.Name && inTags(build.info.Tags, buildKey.Tag) {
+			return build, true
+		}
+	}
+	return nil, false
+}
+
+func (d *memoryDriver) info(build *memoryBuild) types.BuildInfo {
+	info := build.info
+	info.Tags = append(types.Tags{}, build.info.Tags...)
+	if build.mounted && info.BuildID.Type().Properties().Mountable {
+		info.Mounted = d.path(info.BuildID)
+	}
+	return info
+}
+
+func (d *memoryDriver) path(buildID types.BuildID) string {
+	return filepath.Join(d.config.Root, string(buildID), "root")
+}
+
+func (d *memoryDriver) snapshotPath(buildID types.BuildID) string {
+	return filepath.Join(d.config.Root, string(buildID), "image")
+}
+
+func removeTag(tags types.Tags, tag types.Tag) types.Tags {
+	res := make(types.Tags, 0, len(tags))
+	for _, t := range tags {
+		if t != tag {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+func copyTree(dst, src string) error {
+	return errors.WithStack(filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, relPath)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(dstPath, info.Mode().Perm())
+		case entry.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dstPath)
+		case entry.Type().IsRegular():
+			srcFile, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer srcFile.Close()
+
+			dstFile, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			defer dstFile.Close()
+
+			if _, err := io.Copy(dstFile, srcFile); err != nil {
+				return err
+			}
+			// Modification time is preserved, so copied files are not reported as changed.
+			return os.Chtimes(dstPath, info.ModTime(), info.ModTime())
+		default:
+			return nil
+		}
+	}))
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"io"
 
 	"github.com/pkg/errors"
 
@@ -13,9 +14,15 @@ import (
 // ErrImageHasChildren is returned if image being deleted has children.
 var ErrImageHasChildren = errors.New("image has children")
 
+// ErrDiffNotSupported is returned if driver can't compare builds natively.
+var ErrDiffNotSupported = errors.New("diff is not supported")
+
 // FinalizeFn unmounts mounted image.
 type FinalizeFn = func() error
 
+// QuiesceFn suspends writes to the build and returns function resuming them.
+type QuiesceFn = func() (func() error, error)
+
 // Driver represents storage driver.
 type Driver interface {
 	// Builds returns available builds.
@@ -38,6 +45,16 @@ type Driver interface {
 		dstBuildID types.BuildID,
 	) (FinalizeFn, string, error)
 
+	// Commit creates image from the current content of the mounted build. Image is based on the parent
+	// of the build. Writes to the build are suspended using quiesce only while its content is captured.
+	Commit(
+		ctx context.Context,
+		srcBuildID types.BuildID,
+		dstImageName string,
+		dstBuildID types.BuildID,
+		quiesce QuiesceFn,
+	) error
+
 	// StoreManifest stores manifest of build.
 	StoreManifest(ctx context.Context, manifest types.ImageManifest) error
 
@@ -47,8 +64,56 @@ type Driver interface {
 	// Untag removes tag from the build.
 	Untag(ctx context.Context, buildID types.BuildID, tag types.Tag) error
 
+	// SetLabels replaces labels of the build.
+	SetLabels(ctx context.Context, buildID types.BuildID, labels types.Labels) error
+
 	// Drop drops build.
 	Drop(ctx context.Context, buildID types.BuildID) error
+
+	// Revert reverts revertable build to the state it had when it was created.
+	Revert(ctx context.Context, buildID types.BuildID) error
+}
+
+// Streamer is implemented by drivers able to transfer builds using their native streams.
+type Streamer interface {
+	// StreamFormat returns the name of the stream format.
+	StreamFormat() string
+
+	// Send writes stream of the image to the writer. If image is based on another one,
+	// stream contains only changes made since its parent.
+	Send(ctx context.Context, buildID types.BuildID, w io.Writer) error
+
+	// Receive creates image from the stream. Parent of the image must exist.
+	Receive(ctx context.Context, info types.BuildInfo, r io.Reader) error
+}
+
+// Differ is implemented by drivers able to compare builds natively.
+type Differ interface {
+	// Diff returns paths changed in the build since the base build. ErrDiffNotSupported is returned
+	// if builds can't be compared natively. Modified directories are not reported, their changed
+	// children are.
+	Diff(ctx context.Context, buildID types.BuildID, baseBuildID types.BuildID) ([]types.Change, error)
+}
+
+// Invalidator is implemented by drivers caching the state of the storage.
+type Invalidator interface {
+	// Invalidate drops the cached state, so changes made by other processes are noticed.
+	Invalidate()
+}
+
+// Migrator is implemented by drivers storing build info persistently.
+type Migrator interface {
+	// Migrate stores build info using the current version of the schema.
+	// It returns true if build info was stored using an older one.
+	Migrate(ctx context.Context, buildID types.BuildID) (bool, error)
+}
+
+// Register registers storage drivers in the container.
+func Register(c *ioc.Container) {
+	c.Singleton(Resolve)
+	c.SingletonNamed("zfs", NewZFSDriver)
+	c.SingletonNamed("btrfs", NewBTRFSDriver)
+	c.SingletonNamed("dir", NewDirDriver)
 }
 
 // Resolve resolves concrete storage driver based on config.
@@ -1,12 +1,20 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 	"github.com/ridge/must"
@@ -16,7 +24,16 @@ import (
 	"github.com/outofforest/osman/infra/types"
 )
 
-const propertyName = "co.exw:info"
+const (
+	propertyName = "co.exw:info"
+
+	// infoChunkSize is the maximum length of build info stored in single property, zfs limits length of user
+	// property values to 8KiB.
+	infoChunkSize = 8000
+
+	// infoChunks is the maximum number of properties build info might be split into.
+	infoChunks = 16
+)
 
 // NewZFSDriver returns new storage driver based on zfs datasets.
 func NewZFSDriver(config config.Storage) Driver {
@@ -27,77 +44,99 @@ func NewZFSDriver(config config.Storage) Driver {
 
 type zfsDriver struct {
 	config config.Storage
+
+	// index caches metadata of all the builds, it is loaded once and updated or invalidated on modifications
+	// to avoid calling zfs for each build separately.
+	index *zfsIndex
 }
 
-func (d *zfsDriver) Builds(ctx context.Context) ([]types.BuildID, error) {
-	rootFs, err := zfs.GetFilesystem(ctx, d.config.Root)
-	if err != nil {
-		return nil, err
+type zfsDataset struct {
+	info    types.BuildInfo
+	mounted bool
+
+	// encryptionRoot is the name of the dataset encryption key is inherited from.
+	encryptionRoot string
+
+	// chunks is the number of properties build info is stored in.
+	chunks int
+
+	// version is the version of the schema build info is stored in.
+	version int
+}
+
+type zfsIndex struct {
+	builds   []types.BuildID
+	datasets map[types.BuildID]*zfsDataset
+	keys     map[types.BuildKey]types.BuildID
+}
+
+func (i *zfsIndex) store(info types.BuildInfo) {
+	ds := i.datasets[info.BuildID]
+	for _, tag := range ds.info.Tags {
+		delete(i.keys, types.NewBuildKey(ds.info.Name, tag))
 	}
+	ds.info = info
+	for _, tag := range info.Tags {
+		i.keys[types.NewBuildKey(info.Name, tag)] = info.BuildID
+	}
+}
 
-	builds := []types.BuildID{}
-	prefixLen := len(d.config.Root + "/")
-	filesystems, err := rootFs.Children(ctx)
-	if err != nil {
-		return nil, err
+func (i *zfsIndex) delete(buildID types.BuildID) {
+	ds, exists := i.datasets[buildID]
+	if !exists {
+		return
 	}
-	for _, fs := range filesystems {
-		buildID, err := types.ParseBuildID(fs.Info.Name[prefixLen:])
-		if err != nil {
-			return nil, err
+	for _, tag := range ds.info.Tags {
+		delete(i.keys, types.NewBuildKey(ds.info.Name, tag))
+	}
+	delete(i.datasets, buildID)
+	builds := make([]types.BuildID, 0, len(i.builds))
+	for _, b := range i.builds {
+		if b != buildID {
+			builds = append(builds, b)
 		}
-		builds = append(builds, buildID)
 	}
-	return builds, nil
+	i.builds = builds
 }
 
-// Info returns information about build.
-func (d *zfsDriver) Info(ctx context.Context, buildID types.BuildID) (types.BuildInfo, error) {
-	filesystem, err := zfs.GetFilesystem(ctx, d.config.Root+"/"+string(buildID))
+// Invalidate drops cached metadata of builds.
+func (d *zfsDriver) Invalidate() {
+	d.index = nil
+}
+
+// Builds returns available builds.
+func (d *zfsDriver) Builds(ctx context.Context) ([]types.BuildID, error) {
+	index, err := d.loadIndex(ctx)
 	if err != nil {
-		return types.BuildInfo{}, err
+		return nil, err
 	}
+	return append([]types.BuildID{}, index.builds...), nil
+}
 
-	info, exists, err := filesystem.GetProperty(ctx, propertyName)
+// Info returns information about build.
+func (d *zfsDriver) Info(ctx context.Context, buildID types.BuildID) (types.BuildInfo, error) {
+	ds, err := d.dataset(ctx, buildID)
 	if err != nil {
 		return types.BuildInfo{}, err
 	}
-	if !exists {
-		return types.BuildInfo{}, errors.Errorf("property %s does not exist on filesystem %s", propertyName,
-			filesystem.Info.Name)
-	}
-
-	var buildInfo types.BuildInfo
-	if err := json.Unmarshal([]byte(info), &buildInfo); err != nil {
-		return types.BuildInfo{}, errors.WithStack(err)
-	}
-
-	mounted := ""
-	if buildID.Type().Properties().Mountable && filesystem.Info.Mountpoint != "none" {
-		mounted = filesystem.Info.Mountpoint
-	}
-	buildInfo.Mounted = mounted
 
+	buildInfo := ds.info
+	buildInfo.Tags = append(types.Tags{}, ds.info.Tags...)
 	return buildInfo, nil
 }
 
 // BuildID returns build ID for build given by name and tag.
 func (d *zfsDriver) BuildID(ctx context.Context, buildKey types.BuildKey) (types.BuildID, error) {
-	builds, err := d.Builds(ctx)
+	index, err := d.loadIndex(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	for _, buildID := range builds {
-		info, err := d.Info(ctx, buildID)
-		if err != nil {
-			return "", err
-		}
-		if info.Name == buildKey.Name && inTags(info.Tags, buildKey.Tag) {
-			return buildID, nil
-		}
+	buildID, exists := index.keys[buildKey]
+	if !exists {
+		return "", errors.WithStack(fmt.Errorf("image %s does not exist: %w", buildKey, types.ErrImageDoesNotExist))
 	}
-	return "", errors.WithStack(fmt.Errorf("image %s does not exist: %w", buildKey, types.ErrImageDoesNotExist))
+	return buildID, nil
 }
 
 // CreateEmpty creates blank build.
@@ -108,20 +147,35 @@ func (d *zfsDriver) CreateEmpty(
 ) (FinalizeFn, string, error) {
 	buildDir := filepath.Join("/", d.config.Root, string(buildID))
 	mountPoint := filepath.Join(buildDir, "root")
-	filesystem, err := zfs.CreateFilesystem(ctx, d.config.Root+"/"+string(buildID),
-		zfs.CreateFilesystemOptions{Properties: map[string]string{
+	name := d.config.Root + "/" + string(buildID)
+	info := string(must.Bytes(marshalInfo(types.BuildInfo{
+		BuildID:   buildID,
+		Name:      imageName,
+		CreatedAt: time.Now(),
+	})))
+	if d.config.Encrypt {
+		args := append([]string{"create"}, d.encryptionArgs()...)
+		args = append(args, "-o", "mountpoint="+mountPoint, "-o", propertyName+"="+info, name)
+		if err := d.runZFSWithKey(ctx, exec.CommandContext(ctx, "zfs", args...)); err != nil {
+			return nil, "", err
+		}
+		d.index = nil
+		if err := d.setKeyLocation(ctx, name); err != nil {
+			return nil, "", err
+		}
+	} else {
+		if _, err := zfs.CreateFilesystem(ctx, name, zfs.CreateFilesystemOptions{Properties: map[string]string{
 			"mountpoint": mountPoint,
-			propertyName: string(must.Bytes(json.Marshal(types.BuildInfo{
-				BuildID:   buildID,
-				Name:      imageName,
-				CreatedAt: time.Now(),
-			}))),
-		}})
-	if err != nil {
-		return nil, "", err
+			propertyName: info,
+		}}); err != nil {
+			return nil, "", err
+		}
 	}
+	d.index = nil
+	filesystem := d.filesystem(buildID)
 
 	return func() error {
+		d.index = nil
 		if err := filesystem.Unmount(ctx); err != nil {
 			return err
 		}
@@ -134,8 +188,13 @@ func (d *zfsDriver) CreateEmpty(
 		if err := os.RemoveAll(buildDir); err != nil && !errors.Is(err, os.ErrNotExist) {
 			return errors.WithStack(err)
 		}
-		_, err := filesystem.Snapshot(ctx, "image")
-		return err
+		if _, err := filesystem.Snapshot(ctx, "image"); err != nil {
+			return err
+		}
+		if d.config.Encrypt {
+			return d.unloadKey(ctx, buildID)
+		}
+		return nil
 	}, mountPoint, nil
 }
 
@@ -146,7 +205,11 @@ func (d *zfsDriver) Clone(
 	dstImageName string,
 	dstBuildID types.BuildID,
 ) (FinalizeFn, string, error) {
-	snapshot, err := zfs.GetSnapshot(ctx, d.config.Root+"/"+string(srcBuildID)+"@image")
+	srcDataset, err := d.dataset(ctx, srcBuildID)
+	if err != nil {
+		return nil, "", err
+	}
+	snapshot, err := zfs.GetSnapshot(ctx, d.snapshotName(srcBuildID))
 	if err != nil {
 		return nil, "", err
 	}
@@ -154,21 +217,40 @@ func (d *zfsDriver) Clone(
 	properties := dstBuildID.Type().Properties()
 	buildDir := filepath.Join("/", d.config.Root, string(dstBuildID))
 	mountPoint := filepath.Join(buildDir, "root")
-	filesystem, err := snapshot.Clone(ctx, d.config.Root+"/"+string(dstBuildID),
-		zfs.CloneOptions{Properties: map[string]string{
+	name := d.config.Root + "/" + string(dstBuildID)
+	info := string(must.Bytes(marshalInfo(types.BuildInfo{
+		BuildID:   dstBuildID,
+		BasedOn:   srcBuildID,
+		Name:      dstImageName,
+		CreatedAt: time.Now(),
+	})))
+
+	var encryptionRoot types.BuildID
+	switch {
+	case srcDataset.info.Encryption.Cipher != "":
+		encryptionRoot = srcDataset.info.Encryption.Root
+		if err := d.loadKey(ctx, srcBuildID); err != nil {
+			return nil, "", err
+		}
+		fallthrough
+	case !d.config.Encrypt:
+		if _, err := snapshot.Clone(ctx, name, zfs.CloneOptions{Properties: map[string]string{
 			"mountpoint": mountPoint,
-			propertyName: string(must.Bytes(json.Marshal(types.BuildInfo{
-				BuildID:   dstBuildID,
-				BasedOn:   srcBuildID,
-				Name:      dstImageName,
-				CreatedAt: time.Now(),
-			}))),
-		}})
-	if err != nil {
-		return nil, "", err
+			propertyName: info,
+		}}); err != nil {
+			return nil, "", err
+		}
+	default:
+		encryptionRoot = dstBuildID
+		if err := d.copyEncrypted(ctx, srcBuildID, name, mountPoint, info); err != nil {
+			return nil, "", err
+		}
 	}
+	d.index = nil
+	filesystem := d.filesystem(dstBuildID)
 
 	return func() error {
+		d.index = nil
 		if !properties.Mountable || !properties.AutoMount {
 			if err := filesystem.Unmount(ctx); err != nil {
 				return err
@@ -190,18 +272,154 @@ func (d *zfsDriver) Clone(
 				return err
 			}
 		}
+		if encryptionRoot != "" {
+			return d.unloadKey(ctx, encryptionRoot)
+		}
 		return nil
 	}, mountPoint, nil
 }
 
+// copyEncrypted creates new encryption root containing copy of the unencrypted source build.
+func (d *zfsDriver) copyEncrypted(ctx context.Context, srcBuildID types.BuildID, name, mountPoint, info string) error {
+	send := exec.CommandContext(ctx, "zfs", "send", d.snapshotName(srcBuildID))
+	args := append([]string{"receive"}, d.encryptionArgs()...)
+	receive := exec.CommandContext(ctx, "zfs", append(args, "-o", "mountpoint="+mountPoint,
+		"-o", propertyName+"="+info, name)...)
+	if err := sendReceive(send, receive, func(cmd *exec.Cmd) error {
+		return d.runZFSWithKey(ctx, cmd)
+	}); err != nil {
+		return err
+	}
+	if err := d.setKeyLocation(ctx, name); err != nil {
+		return err
+	}
+
+	// Snapshot received from the stream is replaced by the one created when build is finalized.
+	return runZFS(exec.CommandContext(ctx, "zfs", "destroy", name+"@image"))
+}
+
+// Commit creates image from the current content of the mounted build.
+func (d *zfsDriver) Commit(
+	ctx context.Context,
+	srcBuildID types.BuildID,
+	dstImageName string,
+	dstBuildID types.BuildID,
+	quiesce QuiesceFn,
+) error {
+	srcDataset, err := d.dataset(ctx, srcBuildID)
+	if err != nil {
+		return err
+	}
+	if !srcDataset.mounted {
+		return errors.Errorf("build %s is not mounted", srcBuildID)
+	}
+
+	// Temporary snapshot of the build is transferred to the new dataset, so the image is not a clone
+	// of the build and both of them might be dropped independently.
+	srcName := d.config.Root + "/" + string(srcBuildID)
+	snapshot := srcName + "@" + string(dstBuildID)
+	resumeFn, err := quiesce()
+	if err != nil {
+		return err
+	}
+	err = runZFS(exec.CommandContext(ctx, "zfs", "snapshot", snapshot))
+	if err2 := resumeFn(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	d.index = nil
+	defer func() {
+		_ = runZFS(exec.CommandContext(ctx, "zfs", "destroy", snapshot))
+	}()
+
+	info := types.BuildInfo{
+		BuildID:   dstBuildID,
+		BasedOn:   srcDataset.info.BasedOn,
+		Name:      dstImageName,
+		CreatedAt: time.Now(),
+	}
+	chunks, err := infoChunksOf(info)
+	if err != nil {
+		return err
+	}
+
+	sendArgs := []string{"send"}
+	if srcDataset.info.Encryption.Cipher != "" {
+		sendArgs = append(sendArgs, "-w")
+	}
+	receiveArgs := []string{"receive", "-u", "-o", "mountpoint=none", "-o", "canmount=off"}
+	if info.BasedOn != "" && !isEncryptionCopy(srcDataset.info) {
+		sendArgs = append(sendArgs, "-i", d.snapshotName(info.BasedOn))
+		receiveArgs = append(receiveArgs, "-o", "origin="+d.snapshotName(info.BasedOn))
+	}
+	for i, chunk := range chunks {
+		receiveArgs = append(receiveArgs, "-o", infoProperty(i)+"="+chunk)
+	}
+	name := d.config.Root + "/" + string(dstBuildID)
+	if err := sendReceive(
+		exec.CommandContext(ctx, "zfs", append(sendArgs, snapshot)...),
+		exec.CommandContext(ctx, "zfs", append(receiveArgs, name)...),
+		runZFS,
+	); err != nil {
+		return err
+	}
+	d.index = nil
+
+	if err := runZFS(exec.CommandContext(ctx, "zfs", "rename", name+"@"+string(dstBuildID),
+		d.snapshotName(dstBuildID))); err != nil {
+		return err
+	}
+	if isEncryptionCopy(srcDataset.info) {
+		return d.setKeyLocation(ctx, name)
+	}
+	return nil
+}
+
+// sendReceive pipes the stream produced by zfs send to zfs receive.
+func sendReceive(send, receive *exec.Cmd, runReceive func(cmd *exec.Cmd) error) error {
+	stream, err := send.StdoutPipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sendErr := &bytes.Buffer{}
+	send.Stderr = sendErr
+	if err := send.Start(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	receive.Stdin = stream
+	if err := runReceive(receive); err != nil {
+		_ = send.Process.Kill()
+		_ = send.Wait()
+		return err
+	}
+	if err := send.Wait(); err != nil {
+		return errors.Wrapf(err, "command '%s' failed: %s", strings.Join(send.Args, " "),
+			strings.TrimSpace(sendErr.String()))
+	}
+	return nil
+}
+
 // StoreManifest stores manifest of build.
 func (d *zfsDriver) StoreManifest(ctx context.Context, manifest types.ImageManifest) error {
 	info, err := d.Info(ctx, manifest.BuildID)
 	if err != nil {
 		return err
 	}
+	if !manifest.CreatedAt.IsZero() {
+		info.CreatedAt = manifest.CreatedAt
+	}
 	info.Params = manifest.Params
 	info.Boots = manifest.Boots
+	info.Env = manifest.Env
+	info.WorkDir = manifest.WorkDir
+	info.User = manifest.User
+	info.Args = manifest.Args
+	info.Labels = manifest.Labels
+	info.CacheKey = manifest.CacheKey
+	info.Provenance = manifest.Provenance
 	return d.setInfo(ctx, info)
 }
 
@@ -260,38 +478,449 @@ func (d *zfsDriver) Untag(ctx context.Context, buildID types.BuildID, tag types.
 	return d.setInfo(ctx, info)
 }
 
-// Drop drops image.
-func (d *zfsDriver) Drop(ctx context.Context, buildID types.BuildID) error {
-	filesystem, err := zfs.GetFilesystem(ctx, d.config.Root+"/"+string(buildID))
+// SetLabels replaces labels of the build.
+func (d *zfsDriver) SetLabels(ctx context.Context, buildID types.BuildID, labels types.Labels) error {
+	info, err := d.Info(ctx, buildID)
 	if err != nil {
-		return errors.WithStack(fmt.Errorf("build %s does not exist: %w", buildID, types.ErrImageDoesNotExist))
+		return err
 	}
-	mounted, _, err := filesystem.GetProperty(ctx, "mounted")
+	info.Labels = labels
+	return d.setInfo(ctx, info)
+}
+
+// Drop drops image.
+func (d *zfsDriver) Drop(ctx context.Context, buildID types.BuildID) error {
+	ds, err := d.dataset(ctx, buildID)
 	if err != nil {
 		return err
 	}
-	if mounted == "yes" {
+
+	filesystem := d.filesystem(buildID)
+	if ds.mounted {
 		if err := filesystem.Unmount(ctx); err != nil {
 			return err
 		}
 	}
 
 	if err := filesystem.Destroy(ctx, zfs.DestroyRecursive); err != nil {
+		d.index = nil
 		return errors.WithStack(fmt.Errorf("build %s have children: %w", buildID, ErrImageHasChildren))
 	}
+	d.index.delete(buildID)
+
 	if err := os.RemoveAll("/" + d.config.Root + "/" + string(buildID)); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return errors.WithStack(err)
 	}
+	if root := ds.info.Encryption.Root; root != "" && root != buildID {
+		return d.unloadKey(ctx, root)
+	}
 	return nil
 }
 
+// Revert reverts revertable build to the state it had when it was created.
+func (d *zfsDriver) Revert(ctx context.Context, buildID types.BuildID) error {
+	if !buildID.Type().Properties().Revertable {
+		return errors.Errorf("build %s is not revertable", buildID)
+	}
+	if _, err := d.dataset(ctx, buildID); err != nil {
+		return err
+	}
+
+	// Space used by build changes.
+	d.index = nil
+	return runZFS(exec.CommandContext(ctx, "zfs", "rollback", d.snapshotName(buildID)))
+}
+
+// StreamFormat returns the name of the stream format.
+func (d *zfsDriver) StreamFormat() string {
+	return "zfs"
+}
+
+// Send writes stream of the image to the writer.
+func (d *zfsDriver) Send(ctx context.Context, buildID types.BuildID, w io.Writer) error {
+	info, err := d.Info(ctx, buildID)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"send"}
+	if info.Encryption.Cipher != "" {
+		// Encrypted builds are sent as they are stored, so the key is not required and data stays encrypted.
+		args = append(args, "-w")
+	}
+	if info.BasedOn != "" && !isEncryptionCopy(info) {
+		args = append(args, "-i", d.snapshotName(info.BasedOn))
+	}
+	cmd := exec.CommandContext(ctx, "zfs", append(args, d.snapshotName(buildID))...)
+	cmd.Stdout = w
+	return runZFS(cmd)
+}
+
+// Receive creates image from the stream.
+func (d *zfsDriver) Receive(ctx context.Context, info types.BuildInfo, r io.Reader) error {
+	chunks, err := infoChunksOf(info)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"receive", "-u", "-o", "mountpoint=none", "-o", "canmount=off"}
+	if info.BasedOn != "" && !isEncryptionCopy(info) {
+		args = append(args, "-o", "origin="+d.snapshotName(info.BasedOn))
+	}
+	for i, chunk := range chunks {
+		args = append(args, "-o", infoProperty(i)+"="+chunk)
+	}
+	cmd := exec.CommandContext(ctx, "zfs", append(args, d.config.Root+"/"+string(info.BuildID))...)
+	cmd.Stdin = r
+	d.index = nil
+	return runZFS(cmd)
+}
+
+// Migrate stores build info using the current version of the schema.
+func (d *zfsDriver) Migrate(ctx context.Context, buildID types.BuildID) (bool, error) {
+	ds, err := d.dataset(ctx, buildID)
+	if err != nil {
+		return false, err
+	}
+	if ds.version == manifestVersion {
+		return false, nil
+	}
+	return true, d.setInfo(ctx, ds.info)
+}
+
 func (d *zfsDriver) setInfo(ctx context.Context, info types.BuildInfo) error {
-	filesystem, err := zfs.GetFilesystem(ctx, d.config.Root+"/"+string(info.BuildID))
+	chunks, err := infoChunksOf(info)
+	if err != nil {
+		return err
+	}
+	ds, err := d.dataset(ctx, info.BuildID)
 	if err != nil {
 		return err
 	}
 
-	return filesystem.SetProperty(ctx, propertyName, string(must.Bytes(json.Marshal(info))))
+	filesystem := d.filesystem(info.BuildID)
+	for i, chunk := range chunks {
+		if err := filesystem.SetProperty(ctx, infoProperty(i), chunk); err != nil {
+			d.index = nil
+			return err
+		}
+	}
+	// Chunks left from the previous, longer version of build info are removed.
+	for i := len(chunks); i < ds.chunks; i++ {
+		if err := runZFS(exec.CommandContext(ctx, "zfs", "inherit", infoProperty(i),
+			d.config.Root+"/"+string(info.BuildID))); err != nil {
+			d.index = nil
+			return err
+		}
+	}
+
+	info.Mounted = ds.info.Mounted
+	info.Used = ds.info.Used
+	info.Referenced = ds.info.Referenced
+	info.Written = ds.info.Written
+	info.CompressRatio = ds.info.CompressRatio
+	info.Encryption = ds.info.Encryption
+	ds.chunks = len(chunks)
+	ds.version = manifestVersion
+	d.index.store(info)
+	return nil
+}
+
+// infoChunksOf returns chunks of build info to be stored in zfs properties. Fields computed by zfs are not stored.
+func infoChunksOf(info types.BuildInfo) ([]string, error) {
+	info.Mounted = ""
+	info.Used = 0
+	info.Referenced = 0
+	info.Written = 0
+	info.CompressRatio = 0
+	info.Encryption = types.Encryption{}
+	infoRaw, err := marshalInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	if len(infoRaw) <= infoChunkSize {
+		return []string{string(infoRaw)}, nil
+	}
+
+	chunks, err := splitInfo(string(infoRaw))
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) >= infoChunks {
+		return nil, errors.Errorf("build info is too long to be stored, %d properties required, %d allowed",
+			len(chunks)+1, infoChunks)
+	}
+
+	// First property stores the envelope without info, pointing to the properties storing its chunks.
+	header, err := json.Marshal(manifestEnvelope{
+		Version: manifestVersion,
+		Info:    json.RawMessage(`{}`),
+		Chunks:  len(chunks),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return append([]string{string(header)}, chunks...), nil
+}
+
+// infoProperty returns the name of the property storing i-th chunk of build info.
+func infoProperty(i int) string {
+	if i == 0 {
+		return propertyName
+	}
+	return propertyName + "." + strconv.Itoa(i)
+}
+
+// infoProperties returns the names of all the properties build info might be stored in.
+func infoProperties() []string {
+	properties := make([]string, 0, infoChunks)
+	for i := range infoChunks {
+		properties = append(properties, infoProperty(i))
+	}
+	return properties
+}
+
+// splitInfo splits build info into chunks fitting into zfs properties. Multibyte characters are never split.
+func splitInfo(info string) ([]string, error) {
+	chunks := []string{}
+	for len(info) > infoChunkSize {
+		end := infoChunkSize
+		for end > 0 && !utf8.RuneStart(info[end]) {
+			end--
+		}
+		chunks = append(chunks, info[:end])
+		info = info[end:]
+	}
+	chunks = append(chunks, info)
+	if len(chunks) > infoChunks {
+		return nil, errors.Errorf("build info is too long to be stored, %d properties required, %d allowed",
+			len(chunks), infoChunks)
+	}
+	return chunks, nil
+}
+
+// joinInfo joins build info stored in chunks and returns the number of properties it is stored in.
+func joinInfo(props map[string]string) (string, int) {
+	info, exists := props[propertyName]
+	if !exists {
+		return "", 0
+	}
+
+	var header manifestEnvelope
+	if err := json.Unmarshal([]byte(info), &header); err != nil || header.Chunks == 0 {
+		return info, 1
+	}
+
+	last := min(header.Chunks+1, infoChunks)
+	sb := &strings.Builder{}
+	for i := 1; i < last; i++ {
+		chunk, exists := props[infoProperty(i)]
+		if !exists {
+			return sb.String(), i
+		}
+		sb.WriteString(chunk)
+	}
+	return sb.String(), last
+}
+
+// isEncryptionCopy returns true if build is an encryption root copied from its parent, so it is not a zfs clone.
+func isEncryptionCopy(info types.BuildInfo) bool {
+	return info.BasedOn != "" && info.Encryption.Root == info.BuildID
+}
+
+func (d *zfsDriver) snapshotName(buildID types.BuildID) string {
+	return d.config.Root + "/" + string(buildID) + "@image"
+}
+
+func (d *zfsDriver) filesystem(buildID types.BuildID) *zfs.Filesystem {
+	return &zfs.Filesystem{Info: zfs.Info{Name: d.config.Root + "/" + string(buildID)}}
+}
+
+func (d *zfsDriver) dataset(ctx context.Context, buildID types.BuildID) (*zfsDataset, error) {
+	index, err := d.loadIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ds, exists := index.datasets[buildID]
+	if !exists {
+		return nil, errors.WithStack(fmt.Errorf("build %s does not exist: %w", buildID, types.ErrImageDoesNotExist))
+	}
+	return ds, nil
+}
+
+// loadIndex loads metadata of all the builds using single zfs invocation.
+func (d *zfsDriver) loadIndex(ctx context.Context) (*zfsIndex, error) {
+	if d.index != nil {
+		return d.index, nil
+	}
+
+	properties, err := zfsProperties(ctx, d.config.Root, append(infoProperties(), "mountpoint", "mounted", "used",
+		"referenced", "written", "compressratio", "encryption", "encryptionroot", "keystatus")...)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &zfsIndex{
+		builds:   make([]types.BuildID, 0, len(properties)),
+		datasets: make(map[types.BuildID]*zfsDataset, len(properties)),
+		keys:     map[types.BuildKey]types.BuildID{},
+	}
+	prefix := d.config.Root + "/"
+	for _, name := range slices.Sorted(maps.Keys(properties)) {
+		if name == d.config.Root || strings.Contains(name, "@") {
+			continue
+		}
+		buildID, err := types.ParseBuildID(strings.TrimPrefix(name, prefix))
+		if err != nil {
+			return nil, err
+		}
+
+		props := properties[name]
+		info, chunks := joinInfo(props)
+		if chunks == 0 {
+			return nil, errors.Errorf("property %s does not exist on filesystem %s", propertyName, name)
+		}
+
+		buildInfo, version, err := unmarshalInfo([]byte(info))
+		if err != nil {
+			return nil, errors.WithMessagef(err, "reading info of build %s failed", buildID)
+		}
+
+		if buildID.Type().Properties().Mountable && props["mountpoint"] != "none" {
+			buildInfo.Mounted = props["mountpoint"]
+		}
+		if err := zfsSpace(&buildInfo, props, properties[name+"@image"]); err != nil {
+			return nil, err
+		}
+
+		var encryptionRoot string
+		buildInfo.Encryption, encryptionRoot = zfsEncryption(props, prefix)
+
+		index.builds = append(index.builds, buildID)
+		index.datasets[buildID] = &zfsDataset{
+			mounted:        props["mounted"] == "yes",
+			version:        version,
+			encryptionRoot: encryptionRoot,
+			chunks:         chunks,
+		}
+		index.store(buildInfo)
+	}
+
+	d.index = index
+	return index, nil
+}
+
+// zfsSpace fills space accounting fields of build info. Data written while building the image is accounted
+// by its snapshot, data written later by the filesystem itself.
+func zfsSpace(info *types.BuildInfo, props map[string]string, snapshotProps map[string]string) error {
+	for _, size := range []struct {
+		Property string
+		Value    *types.Size
+	}{
+		{Property: "used", Value: &info.Used},
+		{Property: "referenced", Value: &info.Referenced},
+		{Property: "written", Value: &info.Written},
+	} {
+		value, err := parseZFSSize(props[size.Property])
+		if err != nil {
+			return err
+		}
+		*size.Value = value
+	}
+
+	written, err := parseZFSSize(snapshotProps["written"])
+	if err != nil {
+		return err
+	}
+	info.Written += written
+
+	if ratio := strings.TrimSuffix(props["compressratio"], "x"); ratio != "" {
+		value, err := strconv.ParseFloat(ratio, 64)
+		if err != nil {
+			return errors.Wrapf(err, "invalid compression ratio '%s'", ratio)
+		}
+		info.CompressRatio = types.Ratio(value)
+	}
+	return nil
+}
+
+// zfsEncryption returns encryption status of the filesystem and the name of its encryption root. Root of the build
+// is set only if encryption root is a build, it means it is managed by osman.
+func zfsEncryption(props map[string]string, prefix string) (types.Encryption, string) {
+	cipher := props["encryption"]
+	if cipher == "" || cipher == "off" {
+		return types.Encryption{}, ""
+	}
+
+	encryptionRoot := props["encryptionroot"]
+	encryption := types.Encryption{
+		Cipher:    cipher,
+		KeyLoaded: props["keystatus"] == "available",
+	}
+	if buildID, err := types.ParseBuildID(strings.TrimPrefix(encryptionRoot, prefix)); err == nil &&
+		strings.HasPrefix(encryptionRoot, prefix) {
+		encryption.Root = buildID
+	}
+	return encryption, encryptionRoot
+}
+
+func parseZFSSize(value string) (types.Size, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid size '%s'", value)
+	}
+	return types.Size(size), nil
+}
+
+// zfsProperties returns properties of the root filesystem, its children and their snapshots.
+func zfsProperties(ctx context.Context, root string, properties ...string) (map[string]map[string]string, error) {
+	args := []string{"get", "-H", "-p", "-r", "-d", "2", "-t", "filesystem,snapshot", "-o", "name,property,value,source",
+		strings.Join(properties, ","), root}
+	cmd := exec.CommandContext(ctx, "zfs", args...)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	if err := runZFS(cmd); err != nil {
+		return nil, err
+	}
+	return parseZFSProperties(out.Bytes())
+}
+
+func runZFS(cmd *exec.Cmd) error {
+	stdErr := &bytes.Buffer{}
+	cmd.Stderr = stdErr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "command '%s' failed: %s", strings.Join(cmd.Args, " "),
+			strings.TrimSpace(stdErr.String()))
+	}
+	return nil
+}
+
+// parseZFSProperties parses output of `zfs get -H -o name,property,value,source`.
+func parseZFSProperties(out []byte) (map[string]map[string]string, error) {
+	result := map[string]map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 4)
+		if len(fields) != 4 {
+			return nil, errors.Errorf("unexpected output of zfs get: %q", line)
+		}
+		name, property, value, source := fields[0], fields[1], fields[2], fields[3]
+		if result[name] == nil {
+			result[name] = map[string]string{}
+		}
+		// Not set user property is reported as "-" both in value and source.
+		if value == "-" && source == "-" {
+			continue
+		}
+		result[name][property] = value
+	}
+	return result, nil
 }
 
 func inTags(slice types.Tags, el types.Tag) bool {
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/types"
+)
+
+// Diff returns paths changed in the build since the base build using zfs diff. Only builds cloned
+// from the base build might be compared.
+func (d *zfsDriver) Diff(ctx context.Context, buildID types.BuildID, baseBuildID types.BuildID) (
+	retChanges []types.Change,
+	retErr error,
+) {
+	info, err := d.Info(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	if info.BasedOn != baseBuildID || isEncryptionCopy(info) {
+		return nil, errors.WithStack(ErrDiffNotSupported)
+	}
+
+	// Zfs diff resolves paths using mounted filesystem, and base build is mounted to read sizes of files.
+	basePath, unmountBaseFn, err := d.mountTemporarily(ctx, baseBuildID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := unmountBaseFn(); retErr == nil {
+			retErr = err
+		}
+	}()
+	path, unmountFn, err := d.mountTemporarily(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := unmountFn(); retErr == nil {
+			retErr = err
+		}
+	}()
+
+	cmd := exec.CommandContext(ctx, "zfs", "diff", "-H", "-F", d.snapshotName(baseBuildID),
+		d.config.Root+"/"+string(buildID))
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	if err := runZFS(cmd); err != nil {
+		return nil, err
+	}
+
+	changes, err := parseZFSDiff(out.Bytes(), path)
+	if err != nil {
+		return nil, err
+	}
+	for i, change := range changes {
+		if change.Kind != types.ChangeDeleted {
+			size, err := regularFileSize(filepath.Join(path, change.Path))
+			if err != nil {
+				return nil, err
+			}
+			changes[i].Size = size
+			changes[i].Delta = types.SizeDelta(size)
+		}
+		if change.Kind != types.ChangeAdded {
+			size, err := regularFileSize(filepath.Join(basePath, change.Path))
+			if err != nil {
+				return nil, err
+			}
+			changes[i].Delta -= types.SizeDelta(size)
+		}
+	}
+	return changes, nil
+}
+
+// mountTemporarily mounts build read-only if it is not mounted already. Returned function restores
+// the original state.
+func (d *zfsDriver) mountTemporarily(ctx context.Context, buildID types.BuildID) (string, func() error, error) {
+	ds, err := d.dataset(ctx, buildID)
+	if err != nil {
+		return "", nil, err
+	}
+	if ds.mounted {
+		return ds.info.Mounted, func() error { return nil }, nil
+	}
+
+	if err := d.loadKey(ctx, buildID); err != nil {
+		return "", nil, err
+	}
+
+	canMount := "on"
+	if !buildID.Type().Properties().Mountable {
+		canMount = "off"
+	}
+	name := d.config.Root + "/" + string(buildID)
+	buildDir := filepath.Join("/", d.config.Root, string(buildID))
+	mountPoint := filepath.Join(buildDir, "root")
+	filesystem := d.filesystem(buildID)
+
+	d.index = nil
+	unmountFn := func() error {
+		d.index = nil
+		if err := filesystem.Unmount(ctx); err != nil {
+			return err
+		}
+		if err := filesystem.SetProperty(ctx, "mountpoint", "none"); err != nil {
+			return err
+		}
+		if err := filesystem.SetProperty(ctx, "canmount", canMount); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(buildDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return errors.WithStack(err)
+		}
+		if root := ds.info.Encryption.Root; root != "" {
+			return d.unloadKey(ctx, root)
+		}
+		return nil
+	}
+
+	if err := filesystem.SetProperty(ctx, "canmount", "noauto"); err != nil {
+		return "", nil, err
+	}
+	if err := filesystem.SetProperty(ctx, "mountpoint", mountPoint); err != nil {
+		_ = filesystem.SetProperty(ctx, "canmount", canMount)
+		return "", nil, err
+	}
+	if err := runZFS(exec.CommandContext(ctx, "zfs", "mount", "-o", "ro", name)); err != nil {
+		_ = filesystem.SetProperty(ctx, "mountpoint", "none")
+		_ = filesystem.SetProperty(ctx, "canmount", canMount)
+		return "", nil, err
+	}
+	return mountPoint, unmountFn, nil
+}
+
+// parseZFSDiff parses output of `zfs diff -H -F`. Paths are returned relative to the mount point.
+// Renamed paths are reported as deleted and added, modified directories are skipped.
+func parseZFSDiff(out []byte, mountPoint string) ([]types.Change, error) {
+	var changes []types.Change
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			return nil, errors.Errorf("unexpected output of zfs diff: %q", line)
+		}
+
+		paths := make([]string, 0, 2)
+		for _, p := range fields[2:] {
+			path, err := unescapeZFSPath(p)
+			if err != nil {
+				return nil, err
+			}
+			path = strings.TrimPrefix(path, mountPoint)
+			if path == "" {
+				path = "/"
+			}
+			paths = append(paths, path)
+		}
+
+		switch fields[0] {
+		case "+":
+			changes = append(changes, types.Change{Kind: types.ChangeAdded, Path: paths[0]})
+		case "-":
+			changes = append(changes, types.Change{Kind: types.ChangeDeleted, Path: paths[0]})
+		case "M":
+			if fields[1] != "/" {
+				changes = append(changes, types.Change{Kind: types.ChangeModified, Path: paths[0]})
+			}
+		case "R":
+			if len(paths) != 2 {
+				return nil, errors.Errorf("unexpected output of zfs diff: %q", line)
+			}
+			changes = append(changes,
+				types.Change{Kind: types.ChangeDeleted, Path: paths[0]},
+				types.Change{Kind: types.ChangeAdded, Path: paths[1]},
+			)
+		default:
+			return nil, errors.Errorf("unexpected output of zfs diff: %q", line)
+		}
+	}
+	return changes, nil
+}
+
+// unescapeZFSPath decodes characters printed by zfs diff as backslash followed by four octal digits.
+func unescapeZFSPath(path string) (string, error) {
+	if !strings.Contains(path, `\`) {
+		return path, nil
+	}
+
+	res := make([]byte, 0, len(path))
+	for i := 0; i < len(path); i++ {
+		if path[i] != '\\' {
+			res = append(res, path[i])
+			continue
+		}
+		if i+5 > len(path) {
+			return "", errors.Errorf("invalid escape sequence in path %q", path)
+		}
+		c, err := strconv.ParseUint(path[i+1:i+5], 8, 8)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid escape sequence in path %q", path)
+		}
+		res = append(res, byte(c))
+		i += 4
+	}
+	return string(res), nil
+}
+
+// regularFileSize returns size of regular file, zero is returned for other types of files.
+func regularFileSize(path string) (types.Size, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if !info.Mode().IsRegular() {
+		return 0, nil
+	}
+	return types.Size(info.Size()), nil
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/types"
+)
+
+// Encryption of builds follows these rules:
+//   - build created from scratch is encrypted if encryption is enabled in config, it becomes an encryption root,
+//   - build cloned from an encrypted one is always encrypted and shares the encryption root (and the key)
+//     with its source, no matter if encryption is enabled in config,
+//   - encrypted build created from an unencrypted one becomes a new encryption root, zfs can't change encryption
+//     of a clone, so its content is copied from the source instead of being cloned,
+//   - build cloned from an unencrypted one while encryption is disabled is not encrypted.
+//
+// Keys are loaded whenever build sharing the encryption root is created, and unloaded once none of the builds
+// sharing it stays mounted. Keys of encryption roots not managed by osman are never loaded nor unloaded.
+
+// keyLocation is the location zfs reads the key from, the key is passed to it using extra file descriptor,
+// so it is never stored on disk or visible in the process list.
+const keyLocation = "file:///dev/fd/3"
+
+// key returns the encryption key.
+func (d *zfsDriver) key(ctx context.Context) ([]byte, error) {
+	switch {
+	case d.config.KeyFile != "":
+		key, err := os.ReadFile(d.config.KeyFile)
+		return key, errors.WithStack(err)
+	case d.config.KeyProvider != "":
+		cmd := exec.CommandContext(ctx, "sh", "-c", d.config.KeyProvider)
+		cmd.Stderr = os.Stderr
+		key, err := cmd.Output()
+		if err != nil {
+			return nil, errors.Wrapf(err, "key provider '%s' failed", d.config.KeyProvider)
+		}
+		return key, nil
+	default:
+		return nil, errors.New("key file or key provider is required to encrypt builds")
+	}
+}
+
+// encryptionArgs returns arguments of zfs create and zfs receive setting up new encryption root.
+func (d *zfsDriver) encryptionArgs() []string {
+	return []string{"-o", "encryption=on", "-o", "keyformat=" + d.config.KeyFormat, "-o", "keylocation=" + keyLocation}
+}
+
+// runZFSWithKey runs zfs command passing the key to it.
+func (d *zfsDriver) runZFSWithKey(ctx context.Context, cmd *exec.Cmd) error {
+	key, err := d.key(ctx)
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer r.Close()
+
+	// Key is much smaller than the pipe buffer, so it may be written before the command is started.
+	_, err = w.Write(key)
+	if err := w.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	cmd.ExtraFiles = []*os.File{r}
+	return runZFS(cmd)
+}
+
+// setKeyLocation stores the location of the key in the encryption root, so keys might be loaded using zfs tools.
+func (d *zfsDriver) setKeyLocation(ctx context.Context, encryptionRoot string) error {
+	location := "prompt"
+	if d.config.KeyFile != "" {
+		keyFile, err := filepath.Abs(d.config.KeyFile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		location = "file://" + keyFile
+	}
+	return runZFS(exec.CommandContext(ctx, "zfs", "set", "keylocation="+location, encryptionRoot))
+}
+
+// loadKey loads the key of the encryption root used by the build.
+func (d *zfsDriver) loadKey(ctx context.Context, buildID types.BuildID) error {
+	ds, err := d.dataset(ctx, buildID)
+	if err != nil {
+		return err
+	}
+
+	encryption := ds.info.Encryption
+	switch {
+	case encryption.Cipher == "" || encryption.KeyLoaded:
+		return nil
+	case encryption.Root == "":
+		return errors.Errorf("key of encryption root %s used by build %s is not loaded", ds.encryptionRoot, buildID)
+	}
+
+	d.index = nil
+	return d.runZFSWithKey(ctx, exec.CommandContext(ctx, "zfs", "load-key", "-L", keyLocation, ds.encryptionRoot))
+}
+
+// unloadKey unloads the key of the encryption root if none of the builds sharing it is mounted.
+func (d *zfsDriver) unloadKey(ctx context.Context, encryptionRoot types.BuildID) error {
+	d.index = nil
+	index, err := d.loadIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	loaded := false
+	for _, ds := range index.datasets {
+		if ds.info.Encryption.Root != encryptionRoot {
+			continue
+		}
+		if ds.mounted {
+			return nil
+		}
+		loaded = loaded || ds.info.Encryption.KeyLoaded
+	}
+	if !loaded {
+		return nil
+	}
+
+	d.index = nil
+	return runZFS(exec.CommandContext(ctx, "zfs", "unload-key", d.config.Root+"/"+string(encryptionRoot)))
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/outofforest/osman/infra/types"
+)
+
+func TestParseZFSProperties(t *testing.T) {
+	out := "pool/osman\tco.exw:info\t-\t-\n" +
+		"pool/osman\tmountpoint\t/pool/osman\tdefault\n" +
+		"pool/osman/iid1\tco.exw:info\t{\"Name\":\"image\"}\tlocal\n" +
+		"pool/osman/iid1\tmountpoint\tnone\tlocal\n" +
+		"pool/osman/iid1\tmounted\tno\t-\n"
+
+	properties, err := parseZFSProperties([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(properties) != 2 {
+		t.Fatalf("expected 2 filesystems, got %d", len(properties))
+	}
+	if _, exists := properties["pool/osman"]["co.exw:info"]; exists {
+		t.Fatal("unset property must not be reported")
+	}
+	if properties["pool/osman"]["mountpoint"] != "/pool/osman" {
+		t.Fatalf("unexpected mountpoint: %s", properties["pool/osman"]["mountpoint"])
+	}
+	if properties["pool/osman/iid1"]["co.exw:info"] != `{"Name":"image"}` {
+		t.Fatalf("unexpected info: %s", properties["pool/osman/iid1"]["co.exw:info"])
+	}
+	if properties["pool/osman/iid1"]["mounted"] != "no" {
+		t.Fatalf("unexpected mounted: %s", properties["pool/osman/iid1"]["mounted"])
+	}
+
+	if _, err := parseZFSProperties([]byte("pool/osman\tmounted\n")); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestZFSEncryption(t *testing.T) {
+	buildID := types.NewBuildID(types.BuildTypeImage)
+
+	encryption, encryptionRoot := zfsEncryption(map[string]string{"encryption": "off"}, "pool/osman/")
+	if encryption.Cipher != "" || encryptionRoot != "" {
+		t.Fatalf("unexpected encryption of unencrypted filesystem: %#v", encryption)
+	}
+
+	encryption, encryptionRoot = zfsEncryption(map[string]string{
+		"encryption":     "aes-256-gcm",
+		"encryptionroot": "pool/osman/" + string(buildID),
+		"keystatus":      "available",
+	}, "pool/osman/")
+	if encryption.Cipher != "aes-256-gcm" || encryption.Root != buildID || !encryption.KeyLoaded {
+		t.Fatalf("unexpected encryption: %#v", encryption)
+	}
+	if encryptionRoot != "pool/osman/"+string(buildID) {
+		t.Fatalf("unexpected encryption root: %s", encryptionRoot)
+	}
+
+	encryption, encryptionRoot = zfsEncryption(map[string]string{
+		"encryption":     "aes-256-gcm",
+		"encryptionroot": "pool",
+		"keystatus":      "unavailable",
+	}, "pool/osman/")
+	if encryption.Root != "" || encryption.KeyLoaded || encryptionRoot != "pool" {
+		t.Fatalf("unexpected encryption inherited from outside of storage: %#v", encryption)
+	}
+	if encryption.String() != "aes-256-gcm (locked)" {
+		t.Fatalf("unexpected encryption status: %s", encryption)
+	}
+}
+
+func TestParseZFSDiff(t *testing.T) {
+	out := "M\t/\t/pool/osman/mid1/root/etc\n" +
+		"M\tF\t/pool/osman/mid1/root/etc/hosts\n" +
+		"+\tF\t/pool/osman/mid1/root/etc/new\\0040file\n" +
+		"-\t@\t/pool/osman/mid1/root/lib\n" +
+		"R\tF\t/pool/osman/mid1/root/old\t/pool/osman/mid1/root/new\n"
+
+	changes, err := parseZFSDiff([]byte(out), "/pool/osman/mid1/root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []types.Change{
+		{Kind: types.ChangeModified, Path: "/etc/hosts"},
+		{Kind: types.ChangeAdded, Path: "/etc/new file"},
+		{Kind: types.ChangeDeleted, Path: "/lib"},
+		{Kind: types.ChangeDeleted, Path: "/old"},
+		{Kind: types.ChangeAdded, Path: "/new"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	for i, change := range changes {
+		if change != expected[i] {
+			t.Fatalf("unexpected change %d: %v, expected: %v", i, change, expected[i])
+		}
+	}
+
+	if _, err := parseZFSDiff([]byte("X\tF\t/pool/osman/mid1/root/file\n"), "/pool/osman/mid1/root"); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestSplitInfo(t *testing.T) {
+	info := strings.Repeat("a", infoChunkSize-1) + "ż" + strings.Repeat("b", infoChunkSize)
+
+	chunks, err := splitInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > infoChunkSize || !utf8.ValidString(chunk) {
+			t.Fatalf("invalid chunk %d", i)
+		}
+	}
+	if strings.Join(chunks, "") != info {
+		t.Fatal("joined info differs from the original one")
+	}
+
+	if _, err := splitInfo(strings.Repeat("a", infoChunkSize*infoChunks+1)); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestLongInfoIsStoredInChunks(t *testing.T) {
+	buildID := types.NewBuildID(types.BuildTypeImage)
+	info := types.BuildInfo{
+		BuildID: buildID,
+		Name:    "image",
+		Params:  types.Params{strings.Repeat("a", 2*infoChunkSize)},
+	}
+
+	chunks, err := infoChunksOf(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 4 {
+		t.Fatalf("expected 4 chunks, got %d", len(chunks))
+	}
+
+	var header manifestEnvelope
+	if err := json.Unmarshal([]byte(chunks[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != manifestVersion || header.Info == nil {
+		t.Fatalf("unexpected header: %#v", header)
+	}
+
+	props := map[string]string{}
+	for i, chunk := range chunks {
+		props[infoProperty(i)] = chunk
+	}
+	joined, n := joinInfo(props)
+	if n != len(chunks) {
+		t.Fatalf("unexpected number of chunks: %d", n)
+	}
+	info2, version, err := unmarshalInfo([]byte(joined))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != manifestVersion || info2.BuildID != buildID || info2.Params.String() != info.Params.String() {
+		t.Fatalf("unexpected info: %#v", info2)
+	}
+}
@@ -0,0 +1,49 @@
+package types
+
+import (
+	"time"
+)
+
+// Provenance describes how the image was produced.
+type Provenance struct {
+	// SpecFile is the spec file image was built from, it is empty if image was not built from file.
+	SpecFile *SpecFile `json:",omitempty"`
+
+	// Includes are the files included by the spec file.
+	Includes []SpecFile `json:",omitempty"`
+
+	// Parents is the chain of images the image is based on, starting from its parent.
+	Parents []BuildID `json:",omitempty"`
+
+	// BaseImage is the reference of the image the chain of parents was initialized from.
+	BaseImage string `json:",omitempty"`
+
+	// Version is the version of osman used to build the image.
+	Version string
+
+	// Host is the name of the host image was built on.
+	Host string
+
+	// StartedAt is the time build of the image started at.
+	StartedAt time.Time
+
+	// FinishedAt is the time build of the image finished at.
+	FinishedAt time.Time
+
+	// Steps are the build commands, with includes expanded, and the time spent on executing them.
+	Steps []ProvenanceStep `json:",omitempty"`
+}
+
+// SpecFile identifies file image was built from.
+type SpecFile struct {
+	Path string
+
+	// Digest is the sha256 hash of file content.
+	Digest string
+}
+
+// ProvenanceStep is a build command executed to produce the image.
+type ProvenanceStep struct {
+	Command  string
+	Duration time.Duration
+}
@@ -83,6 +83,9 @@ func (bt BuildType) Properties() BuildTypeProperties {
 
 // BuildTypeProperties contains properties of build type.
 type BuildTypeProperties struct {
+	// Name is the human-readable name of build type.
+	Name string
+
 	// Cloneable means image may be cloned.
 	Cloneable bool
 
@@ -115,21 +118,27 @@ const (
 
 var buildTypes = map[BuildType]BuildTypeProperties{
 	BuildTypeImage: {
+		Name:       "image",
 		Cloneable:  true,
 		Revertable: true,
 	},
 	BuildTypeMount: {
-		Mountable: true,
-		AutoMount: true,
+		Name:       "mount",
+		Mountable:  true,
+		AutoMount:  true,
+		Revertable: true,
 	},
 	BuildTypeBoot: {
+		Name:       "boot",
 		Mountable:  true,
 		Revertable: true,
 	},
 	BuildTypeVM: {
-		Mountable: true,
-		AutoMount: true,
-		VM:        true,
+		Name:       "vm",
+		Mountable:  true,
+		AutoMount:  true,
+		Revertable: true,
+		VM:         true,
 	},
 }
 
@@ -256,12 +265,84 @@ func (p Params) String() string {
 	return strings.Join(values, ", ")
 }
 
+// Env is the set of environment variables configured on image.
+type Env map[string]string
+
+// Pairs returns variables in the form of name=value sorted by name.
+func (e Env) Pairs() []string {
+	pairs := make([]string, 0, len(e))
+	for name, value := range e {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+func (e Env) String() string {
+	return strings.Join(e.Pairs(), ", ")
+}
+
+// Args are the values of arguments image was built with.
+type Args map[string]string
+
+func (a Args) String() string {
+	return Env(a).String()
+}
+
+var labelKeyRegExp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9\-_./]*$`)
+
+// IsLabelKeyValid returns true if key of label is valid.
+func IsLabelKeyValid(key string) bool {
+	return labelKeyRegExp.MatchString(key)
+}
+
+// Labels are the key-value pairs describing the image.
+type Labels map[string]string
+
+func (l Labels) String() string {
+	return Env(l).String()
+}
+
+// Matches returns true if all the labels are set to the same values.
+func (l Labels) Matches(labels Labels) bool {
+	for key, value := range labels {
+		if v, exists := l[key]; !exists || v != value {
+			return false
+		}
+	}
+	return true
+}
+
 // ImageManifest contains info about built image.
 type ImageManifest struct {
 	BuildID BuildID
 	BasedOn BuildID
 	Params  Params
 	Boots   []Boot
+
+	// CreatedAt is the time the image was created, if it is zero the time of storing the image is kept.
+	CreatedAt time.Time
+
+	// Env is the environment applied to commands executed in the image and its children.
+	Env Env
+
+	// WorkDir is the working directory of commands executed in the image and its children.
+	WorkDir string
+
+	// User is the user, in the form of user[:group], commands are executed as in the image and its children.
+	User string
+
+	// Args are the values of arguments declared in spec file, they are not inherited by children.
+	Args Args
+
+	// Labels describe the image and its children.
+	Labels Labels
+
+	// CacheKey identifies the parent and the instructions the image was built from.
+	CacheKey string
+
+	// Provenance describes how the image was produced.
+	Provenance *Provenance
 }
 
 // BuildInfo stores all the information about build.
@@ -274,4 +355,163 @@ type BuildInfo struct {
 	Params    Params
 	Boots     []Boot
 	Mounted   string
+
+	// Env is the environment applied to commands executed in the image and its children.
+	Env Env `json:",omitempty"`
+
+	// WorkDir is the working directory of commands executed in the image and its children.
+	WorkDir string `json:",omitempty"`
+
+	// User is the user, in the form of user[:group], commands are executed as in the image and its children.
+	User string `json:",omitempty"`
+
+	// Args are the values of arguments declared in spec file, they are not inherited by children.
+	Args Args `json:",omitempty"`
+
+	// Labels describe the image and its children.
+	Labels Labels `json:",omitempty"`
+
+	// CacheKey identifies the parent and the instructions the image was built from.
+	CacheKey string `json:",omitempty"`
+
+	// Provenance describes how the image was produced.
+	Provenance *Provenance `json:",omitempty"`
+
+	// Used is the space consumed by the build and its snapshots.
+	Used Size
+
+	// Referenced is the amount of data accessible by the build.
+	Referenced Size
+
+	// Written is the amount of data written since the build was created from its parent.
+	Written Size
+
+	// CompressRatio is the compression ratio achieved for the referenced data.
+	CompressRatio Ratio
+
+	// Encryption describes encryption of the build.
+	Encryption Encryption
+}
+
+// NodeID returns ID of the build in the graph of builds.
+func (bi BuildInfo) NodeID() string {
+	return string(bi.BuildID)
+}
+
+// ParentID returns ID of the build this one is based on.
+func (bi BuildInfo) ParentID() string {
+	return string(bi.BasedOn)
+}
+
+// NodeLabel returns label describing the build in the graph of builds.
+func (bi BuildInfo) NodeLabel() string {
+	keys := make([]string, 0, len(bi.Tags))
+	for _, tag := range bi.Tags {
+		keys = append(keys, NewBuildKey(bi.Name, tag).String())
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		keys = append(keys, bi.Name)
+	}
+
+	properties := bi.BuildID.Type().Properties()
+	label := fmt.Sprintf("%s %s (%s", bi.BuildID, strings.Join(keys, ", "), properties.Name)
+	switch {
+	case bi.Mounted != "":
+		label += ", mounted at " + bi.Mounted
+	case properties.Mountable:
+		label += ", not mounted"
+	}
+	return label + ")"
+}
+
+// Encryption describes encryption of the build.
+type Encryption struct {
+	// Cipher is the encryption algorithm, empty if build is not encrypted.
+	Cipher string `json:",omitempty"`
+
+	// Root is the build the encryption key is inherited from. It is empty if key is inherited from dataset
+	// not managed by osman.
+	Root BuildID `json:",omitempty"`
+
+	// KeyLoaded is true if encryption key is loaded and build content is accessible.
+	KeyLoaded bool `json:",omitempty"`
+}
+
+// String returns string representation of encryption status.
+func (e Encryption) String() string {
+	if e.Cipher == "" {
+		return "-"
+	}
+	if e.KeyLoaded {
+		return e.Cipher + " (unlocked)"
+	}
+	return e.Cipher + " (locked)"
+}
+
+// Size is the amount of space in bytes.
+type Size uint64
+
+// String returns human-readable representation of size.
+func (s Size) String() string {
+	const units = "BKMGTPE"
+
+	value := float64(s)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", s)
+	}
+	return fmt.Sprintf("%.1f%c", value, units[unit])
+}
+
+// Ratio is the compression ratio.
+type Ratio float64
+
+// String returns string representation of ratio.
+func (r Ratio) String() string {
+	if r == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2fx", float64(r))
+}
+
+// SizeDelta is the change of size in bytes.
+type SizeDelta int64
+
+// String returns human-readable representation of size delta.
+func (d SizeDelta) String() string {
+	if d < 0 {
+		return "-" + Size(-d).String()
+	}
+	return "+" + Size(d).String()
+}
+
+// ChangeKind is the kind of change made to the path.
+type ChangeKind string
+
+const (
+	// ChangeAdded means path has been added.
+	ChangeAdded ChangeKind = "added"
+
+	// ChangeModified means path has been modified.
+	ChangeModified ChangeKind = "modified"
+
+	// ChangeDeleted means path has been deleted.
+	ChangeDeleted ChangeKind = "deleted"
+)
+
+// Change describes path changed between builds.
+type Change struct {
+	Kind ChangeKind
+	Path string
+
+	// Size is the size of the file after the change, it is zero for deleted paths and files other than regular ones.
+	Size Size
+
+	// Delta is the change of the file size.
+	Delta SizeDelta
 }
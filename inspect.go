@@ -0,0 +1,144 @@
+package osman
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/config"
+	"github.com/outofforest/osman/infra/storage"
+	"github.com/outofforest/osman/infra/types"
+)
+
+// Inspection contains detailed information about build and resources depending on it.
+type Inspection struct {
+	Build types.BuildInfo
+
+	// Ancestors is the chain of builds the build is based on, starting from its parent.
+	Ancestors []types.BuildInfo
+
+	// Children are the builds based directly on the build.
+	Children []types.BuildInfo
+
+	// Mounts, Boots and VMs are the builds of those types created from the build or its descendants.
+	Mounts []types.BuildInfo
+	Boots  []types.BuildInfo
+	VMs    []types.BuildInfo
+
+	// Domains are libvirt domains using the build or its descendants.
+	Domains []Domain
+}
+
+// Domain describes libvirt domain using the build.
+type Domain struct {
+	Name    string
+	UUID    string
+	BuildID types.BuildID
+	Running bool
+}
+
+// Inspect returns detailed information about the build.
+func Inspect(
+	ctx context.Context,
+	filtering config.Filter,
+	inspect config.Inspect,
+	s storage.Driver,
+) (Inspection, error) {
+	selected, err := List(ctx, filtering, s)
+	if err != nil {
+		return Inspection{}, err
+	}
+	if len(selected) != 1 {
+		return Inspection{}, errors.Errorf("exactly one build must be selected to inspect, %d selected",
+			len(selected))
+	}
+	build := selected[0]
+
+	builds, err := List(ctx, config.Filter{Types: []types.BuildType{
+		types.BuildTypeImage, types.BuildTypeMount, types.BuildTypeBoot, types.BuildTypeVM,
+	}}, s)
+	if err != nil {
+		return Inspection{}, err
+	}
+	sort.Slice(builds, func(i int, j int) bool {
+		return builds[i].CreatedAt.Before(builds[j].CreatedAt)
+	})
+	children := map[types.BuildID][]types.BuildInfo{}
+	for _, b := range builds {
+		if b.BasedOn != "" {
+			children[b.BasedOn] = append(children[b.BasedOn], b)
+		}
+	}
+
+	inspection := Inspection{
+		Build:     build,
+		Ancestors: []types.BuildInfo{},
+		Children:  append([]types.BuildInfo{}, children[build.BuildID]...),
+		Mounts:    []types.BuildInfo{},
+		Boots:     []types.BuildInfo{},
+		VMs:       []types.BuildInfo{},
+		Domains:   []Domain{},
+	}
+
+	for basedOn := build.BasedOn; basedOn != ""; {
+		parent, err := s.Info(ctx, basedOn)
+		if err != nil {
+			return Inspection{}, err
+		}
+		inspection.Ancestors = append(inspection.Ancestors, parent)
+		basedOn = parent.BasedOn
+	}
+
+	if build.BuildID.Type().Properties().VM {
+		inspection.VMs = append(inspection.VMs, build)
+	}
+	var collect func(buildID types.BuildID)
+	collect = func(buildID types.BuildID) {
+		for _, child := range children[buildID] {
+			switch child.BuildID.Type() {
+			case types.BuildTypeMount:
+				inspection.Mounts = append(inspection.Mounts, child)
+			case types.BuildTypeBoot:
+				inspection.Boots = append(inspection.Boots, child)
+			case types.BuildTypeVM:
+				inspection.VMs = append(inspection.VMs, child)
+			}
+			collect(child.BuildID)
+		}
+	}
+	collect(build.BuildID)
+
+	if len(inspection.VMs) == 0 {
+		return inspection, nil
+	}
+
+	l, err := libvirtConn(inspect.LibvirtAddr)
+	if err != nil {
+		return Inspection{}, err
+	}
+	defer l.Disconnect() //nolint:errcheck // I don't care about the error here
+
+	domainDocs, err := vmDomains(l)
+	if err != nil {
+		return Inspection{}, err
+	}
+	running, err := runningVMs(l)
+	if err != nil {
+		return Inspection{}, err
+	}
+	for _, vm := range inspection.VMs {
+		domainDoc, exists := domainDocs[vm.BuildID]
+		if !exists {
+			continue
+		}
+		_, isRunning := running[vm.BuildID]
+		inspection.Domains = append(inspection.Domains, Domain{
+			Name:    domainDoc.Name,
+			UUID:    domainDoc.UUID,
+			BuildID: vm.BuildID,
+			Running: isRunning,
+		})
+	}
+	return inspection, nil
+}
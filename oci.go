@@ -0,0 +1,136 @@
+package osman
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/archive"
+	"github.com/outofforest/osman/infra/oci"
+	"github.com/outofforest/osman/infra/storage"
+	"github.com/outofforest/osman/infra/types"
+)
+
+const (
+	annotationBuildID = "io.github.outofforest.osman.build-id"
+	annotationParams  = "io.github.outofforest.osman.params"
+)
+
+// exportOCI writes image as OCI image layout. Each image in the chain of parents becomes a separate layer.
+// If file name ends with .tar, layout is archived into tarball, otherwise it is stored in directory.
+func exportOCI(ctx context.Context, build types.BuildInfo, file string, s storage.Driver) (retErr error) {
+	chain := []types.BuildInfo{build}
+	for info := build; info.BasedOn != ""; {
+		var err error
+		info, err = s.Info(ctx, info.BasedOn)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, info)
+	}
+
+	dir := file
+	var f *os.File
+	if strings.HasSuffix(file, ".tar") {
+		// File is created before layers are produced, so existing one is reported without doing the work.
+		var err error
+		f, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer func() {
+			_ = f.Close()
+			if retErr != nil {
+				_ = os.Remove(file)
+			}
+		}()
+
+		dir, err = os.MkdirTemp(filepath.Dir(file), ".osman-oci-")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer func() {
+			if err := os.RemoveAll(dir); retErr == nil {
+				retErr = errors.WithStack(err)
+			}
+		}()
+	} else if err := os.Mkdir(file, 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	layout, err := oci.NewLayout(dir)
+	if err != nil {
+		return err
+	}
+
+	var parentPath string
+	parentDropFn := func() error { return nil }
+	defer func() {
+		if err := parentDropFn(); retErr == nil {
+			retErr = err
+		}
+	}()
+	for i := len(chain) - 1; i >= 0; i-- {
+		info := chain[i]
+		path, dropFn, err := mountTemporarily(ctx, info, s)
+		if err != nil {
+			return err
+		}
+		if err := layout.AddLayer("osman build "+info.Name, info.CreatedAt, func(w io.Writer) error {
+			return archive.Diff(w, path, parentPath)
+		}); err != nil {
+			_ = dropFn()
+			return err
+		}
+		if err := parentDropFn(); err != nil {
+			_ = dropFn()
+			return err
+		}
+		parentPath = path
+		parentDropFn = dropFn
+	}
+
+	refNames := make([]string, 0, len(build.Tags))
+	for _, tag := range build.Tags {
+		refNames = append(refNames, build.Name+":"+string(tag))
+	}
+	labels := map[string]string{}
+	for k, v := range build.Labels {
+		labels[k] = v
+	}
+	labels[annotationBuildID] = string(build.BuildID)
+	if len(build.Params) > 0 {
+		labels[annotationParams] = strings.Join(build.Params, " ")
+	}
+	annotations := map[string]string{
+		oci.AnnotationTitle:   build.Name,
+		oci.AnnotationCreated: build.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+	}
+	for k, v := range labels {
+		annotations[k] = v
+	}
+	if err := layout.Finish(oci.Image{
+		Created:     build.CreatedAt,
+		Labels:      labels,
+		Env:         build.Env.Pairs(),
+		WorkDir:     build.WorkDir,
+		User:        build.User,
+		Annotations: annotations,
+		RefNames:    refNames,
+	}); err != nil {
+		return err
+	}
+
+	if f == nil {
+		return nil
+	}
+
+	if err := archive.Pack(f, dir); err != nil {
+		return err
+	}
+	return errors.WithStack(f.Close())
+}
@@ -0,0 +1,156 @@
+package osman
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/osman/infra/types"
+)
+
+const (
+	statementType       = "https://in-toto.io/Statement/v1"
+	slsaPredicateType   = "https://slsa.dev/provenance/v1"
+	slsaBuildType       = "https://github.com/outofforest/osman/build/v1"
+	slsaBuilderID       = "https://github.com/outofforest/osman"
+	buildIDDigest       = "osmanBuildID"
+	buildURIPrefix      = "osman://build/"
+	sha256DigestPrefix  = "sha256:"
+	sha256DigestAlgName = "sha256"
+)
+
+// ProvenanceStatement is the in-toto statement carrying SLSA provenance of the build.
+type ProvenanceStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     ProvenancePredicate  `json:"predicate"`
+}
+
+// ProvenancePredicate is the SLSA provenance predicate.
+type ProvenancePredicate struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+// BuildDefinition describes inputs of the build.
+type BuildDefinition struct {
+	BuildType            string                 `json:"buildType"`
+	ExternalParameters   map[string]interface{} `json:"externalParameters"`
+	InternalParameters   map[string]interface{} `json:"internalParameters,omitempty"`
+	ResolvedDependencies []ResourceDescriptor   `json:"resolvedDependencies,omitempty"`
+}
+
+// RunDetails describes the execution of the build.
+type RunDetails struct {
+	Builder    ProvenanceBuilder    `json:"builder"`
+	Metadata   ProvenanceMetadata   `json:"metadata"`
+	Byproducts []ResourceDescriptor `json:"byproducts,omitempty"`
+}
+
+// ProvenanceBuilder identifies the builder.
+type ProvenanceBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+// ProvenanceMetadata contains metadata of the build execution.
+type ProvenanceMetadata struct {
+	InvocationID string    `json:"invocationId"`
+	StartedOn    time.Time `json:"startedOn"`
+	FinishedOn   time.Time `json:"finishedOn"`
+}
+
+// ResourceDescriptor describes artifact used or produced by the build.
+type ResourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// NewProvenanceStatement returns in-toto statement carrying SLSA provenance of the build.
+func NewProvenanceStatement(build types.BuildInfo) (ProvenanceStatement, error) {
+	provenance := build.Provenance
+	if provenance == nil {
+		return ProvenanceStatement{}, errors.Errorf("build %s has no provenance", build.BuildID)
+	}
+
+	buildDigest := map[string]string{buildIDDigest: string(build.BuildID)}
+	subject := []ResourceDescriptor{}
+	for _, tag := range build.Tags {
+		subject = append(subject, ResourceDescriptor{
+			Name:   types.NewBuildKey(build.Name, tag).String(),
+			Digest: buildDigest,
+		})
+	}
+	if len(subject) == 0 {
+		subject = append(subject, ResourceDescriptor{Name: build.Name, Digest: buildDigest})
+	}
+
+	commands := make([]string, 0, len(provenance.Steps))
+	byproducts := make([]ResourceDescriptor, 0, len(provenance.Steps))
+	for _, step := range provenance.Steps {
+		commands = append(commands, step.Command)
+		byproducts = append(byproducts, ResourceDescriptor{
+			Name:        step.Command,
+			Annotations: map[string]string{"duration": step.Duration.String()},
+		})
+	}
+	parameters := map[string]interface{}{"commands": commands}
+	if len(build.Args) > 0 {
+		parameters["args"] = build.Args
+	}
+
+	dependencies := []ResourceDescriptor{}
+	if provenance.SpecFile != nil {
+		parameters["specFile"] = provenance.SpecFile.Path
+		dependencies = append(dependencies, specFileDescriptor(*provenance.SpecFile))
+	}
+	for _, include := range provenance.Includes {
+		dependencies = append(dependencies, specFileDescriptor(include))
+	}
+	for _, parent := range provenance.Parents {
+		dependencies = append(dependencies, ResourceDescriptor{
+			URI:    buildURIPrefix + string(parent),
+			Digest: map[string]string{buildIDDigest: string(parent)},
+		})
+	}
+	if provenance.BaseImage != "" {
+		dependencies = append(dependencies, ResourceDescriptor{Name: "baseImage", URI: provenance.BaseImage})
+	}
+
+	return ProvenanceStatement{
+		Type:          statementType,
+		Subject:       subject,
+		PredicateType: slsaPredicateType,
+		Predicate: ProvenancePredicate{
+			BuildDefinition: BuildDefinition{
+				BuildType:            slsaBuildType,
+				ExternalParameters:   parameters,
+				InternalParameters:   map[string]interface{}{"host": provenance.Host},
+				ResolvedDependencies: dependencies,
+			},
+			RunDetails: RunDetails{
+				Builder: ProvenanceBuilder{
+					ID:      slsaBuilderID,
+					Version: map[string]string{"osman": provenance.Version},
+				},
+				Metadata: ProvenanceMetadata{
+					InvocationID: buildURIPrefix + string(build.BuildID),
+					StartedOn:    provenance.StartedAt,
+					FinishedOn:   provenance.FinishedAt,
+				},
+				Byproducts: byproducts,
+			},
+		},
+	}, nil
+}
+
+func specFileDescriptor(specFile types.SpecFile) ResourceDescriptor {
+	return ResourceDescriptor{
+		URI:    "file://" + specFile.Path,
+		Digest: map[string]string{sha256DigestAlgName: strings.TrimPrefix(specFile.Digest, sha256DigestPrefix)},
+	}
+}
@@ -117,3 +117,88 @@ func parseMaybeJSON(rest string, d *directives) (*Node, map[string]bool, error)
 	node.Value = rest
 	return node, nil, nil
 }
+
+// parseNameVal parses a whitespace-delimited set of name=value pairs. Values
+// might be quoted, quotes are removed. If the first word contains no equal
+// sign, the rest of the line is the value of the single name. The result is
+// a linked list of names and values.
+func parseNameVal(rest string, _ *directives) (*Node, map[string]bool, error) {
+	if rest == "" {
+		return nil, nil, nil
+	}
+
+	var pairs []string
+	if parts := reWhitespace.Split(rest, 2); len(parts) == 2 && !strings.Contains(parts[0], "=") {
+		// Legacy form: NAME value with spaces.
+		pairs = parts
+	} else {
+		words, err := parseWords(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, word := range words {
+			name, value, found := strings.Cut(word, "=")
+			if !found || name == "" {
+				return nil, nil, errors.Errorf("expected name=value, got: %s", word)
+			}
+			pairs = append(pairs, name, value)
+		}
+	}
+
+	rootNode := &Node{Value: pairs[0]}
+	node := rootNode
+	for _, str := range pairs[1:] {
+		node.Next = &Node{Value: str}
+		node = node.Next
+	}
+	return rootNode, nil, nil
+}
+
+// parseWords splits the line into whitespace-delimited words. Single-quoted
+// text is taken literally, backslash escapes the next character outside of
+// quotes and the quote or backslash inside double quotes.
+func parseWords(rest string) ([]string, error) {
+	var words []string
+	word := &strings.Builder{}
+	inWord := false
+	quote := rune(0)
+	escaped := false
+	for _, ch := range rest {
+		switch {
+		case escaped:
+			if quote == '"' && ch != '"' && ch != '\\' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(ch)
+			escaped = false
+		case ch == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+				continue
+			}
+			word.WriteRune(ch)
+		case ch == '"' || ch == '\'':
+			quote = ch
+			inWord = true
+		case unicode.IsSpace(ch):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(ch)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.Errorf("unterminated quote or escape in: %s", rest)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -182,6 +182,12 @@ func init() {
 		"run":     parseMaybeJSON,
 		"include": parseStringsWhitespaceDelimited,
 		"boot":    parseMaybeJSONToList,
+		"copy":    parseMaybeJSONToList,
+		"env":     parseNameVal,
+		"workdir": parseStringsWhitespaceDelimited,
+		"user":    parseStringsWhitespaceDelimited,
+		"arg":     parseStringsWhitespaceDelimited,
+		"label":   parseNameVal,
 	}
 }
 
@@ -1082,6 +1082,77 @@ func stopVMs(ctx context.Context, l *libvirt.Libvirt, vmsToStop []types.BuildInf
 	return results, nil
 }
 
+// ensureNotRunning returns error if any of the builds is used by running VM.
+func ensureNotRunning(builds []types.BuildInfo, running map[types.BuildID]libvirt.Domain) error {
+	for _, build := range builds {
+		if _, exists := running[build.BuildID]; exists {
+			return errors.Errorf("build %s is used by running VM, stop it first", build.BuildID)
+		}
+	}
+	return nil
+}
+
+// runningVMs returns running domains indexed by IDs of builds used by them.
+func runningVMs(l *libvirt.Libvirt) (map[types.BuildID]libvirt.Domain, error) {
+	domains, _, err := l.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	running := map[types.BuildID]libvirt.Domain{}
+	for _, d := range domains {
+		domainXML, err := l.DomainGetXMLDesc(d, 0)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		var domainDoc libvirtxml.Domain
+		if err := domainDoc.Unmarshal(domainXML); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		meta, err := parseMetadata(domainDoc)
+		if err != nil {
+			return nil, err
+		}
+		if meta.BuildID != "" {
+			running[meta.BuildID] = d
+		}
+	}
+	return running, nil
+}
+
+// vmDomains returns documents of all the domains, both active and inactive, indexed by IDs of builds used by them.
+func vmDomains(l *libvirt.Libvirt) (map[types.BuildID]libvirtxml.Domain, error) {
+	domains, _, err := l.ConnectListAllDomains(1,
+		libvirt.ConnectListDomainsActive|libvirt.ConnectListDomainsInactive)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	domainDocs := map[types.BuildID]libvirtxml.Domain{}
+	for _, d := range domains {
+		domainXML, err := l.DomainGetXMLDesc(d, 0)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		var domainDoc libvirtxml.Domain
+		if err := domainDoc.Unmarshal(domainXML); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		meta, err := parseMetadata(domainDoc)
+		if err != nil {
+			return nil, err
+		}
+		if meta.BuildID != "" {
+			domainDocs[meta.BuildID] = domainDoc
+		}
+	}
+	return domainDocs, nil
+}
+
 type vmToDeploy struct {
 	Image     types.BuildInfo
 	Mount     types.BuildInfo